@@ -0,0 +1,58 @@
+package cmd
+
+import (
+	log "github.com/sirupsen/logrus"
+	"github.com/spf13/cobra"
+	"github.com/utu-crowdsale/defi-portal-scanner/collector"
+)
+
+var (
+	backfillFrom     uint64
+	backfillTo       uint64
+	backfillProtocol string
+	backfillNetwork  string
+)
+
+// backfillCmd represents the backfill command
+var backfillCmd = &cobra.Command{
+	Use:   "backfill",
+	Short: "Process the protocols activity over a block range",
+	Long: `Fetch the logs of the monitored protocols between two blocks and process
+them as the listen command does, so that the history of a protocol is
+posted to the UTU Trust API`,
+	Run: backfill,
+}
+
+func init() {
+	rootCmd.AddCommand(backfillCmd)
+	backfillCmd.Flags().Uint64Var(&backfillFrom, "from", 0, "First block of the range")
+	backfillCmd.Flags().Uint64Var(&backfillTo, "to", 0, "Last block of the range (default is the chain head)")
+	backfillCmd.Flags().StringVar(&backfillProtocol, "protocol", "", "Only backfill the protocol with this name")
+	backfillCmd.Flags().StringVar(&backfillNetwork, "network", "", "The network of the chain to backfill (default is the first chain)")
+	backfillCmd.Flags().BoolVar(&dryRun, "dry-run", false, "Enable dry-run for the utu api")
+	backfillCmd.Flags().StringVarP(&protocolsDescriptor, "protocols", "p", "", "Override the protocols file description location")
+	backfillCmd.MarkFlagRequired("from")
+}
+
+func backfill(cmd *cobra.Command, args []string) {
+	if debug {
+		log.SetLevel(log.DebugLevel)
+	}
+	// set the dryrun option
+	settings.UTUTrustAPI.DryRun = settings.UTUTrustAPI.DryRun || dryRun
+	if protocolsDescriptor != "" {
+		if err := settings.SetProtocolsFile(protocolsDescriptor); err != nil {
+			log.Fatal(err)
+		}
+	}
+
+	if err := collector.Ready(settings); err != nil {
+		log.Fatal(err)
+	}
+	err := collector.Backfill(settings, backfillNetwork, backfillFrom, backfillTo, backfillProtocol)
+	// wait for the queued changesets to be posted
+	collector.Stop()
+	if err != nil {
+		log.Fatal(err)
+	}
+}
@@ -61,10 +61,15 @@ func listen(cmd *cobra.Command, args []string) {
 	// set the dryrun option
 	settings.UTUTrustAPI.DryRun = settings.UTUTrustAPI.DryRun || dryRun
 	if protocolsDescriptor != "" {
-		settings.DefiSourcesFile = protocolsDescriptor
+		if err := settings.SetProtocolsFile(protocolsDescriptor); err != nil {
+			log.Fatal(err)
+		}
 	}
 
-	collector.Ready(settings)
+	if err := collector.Ready(settings); err != nil {
+		log.Fatal(err)
+	}
+	collector.AddressProcessorReady(settings)
 	collector.BalanceCollectorReady(settings)
 	wallet.Ready(settings)
 	// synchronize services
@@ -0,0 +1,213 @@
+package collector
+
+import (
+	"fmt"
+	"math/big"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/ethereum/go-ethereum/accounts/abi"
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/common/hexutil"
+	"github.com/ethereum/go-ethereum/core/types"
+	"github.com/iancoleman/strcase"
+)
+
+// DecodedEvent an event log decoded using the ABI of the contract that emitted it
+type DecodedEvent struct {
+	// Name the name of the event as it appears in the ABI
+	Name string
+	// Args the indexed and non-indexed arguments, ready to be used as properties
+	Args map[string]interface{}
+	// Actors the address arguments of the event, in the order they are declared
+	Actors []string
+}
+
+// ReadABI read a contract ABI from a json file
+func ReadABI(file string) (a *abi.ABI, err error) {
+	f, err := os.Open(file)
+	if err != nil {
+		return
+	}
+	defer f.Close()
+	parsed, err := abi.JSON(f)
+	if err != nil {
+		err = fmt.Errorf("cannot parse abi %s: %v", file, err)
+		return
+	}
+	a = &parsed
+	return
+}
+
+// LoadABIs read the ABI files referenced by the protocol and register them for
+// the protocol filter addresses on the chain. Relative paths are resolved
+// against baseDir, that is the folder of the protocols file.
+func (c *Chain) LoadABIs(p Protocol, baseDir string) (err error) {
+	parsed := make(map[string]*abi.ABI)
+	read := func(file string) (a *abi.ABI, err error) {
+		if !filepath.IsAbs(file) {
+			file = filepath.Join(baseDir, file)
+		}
+		a, found := parsed[file]
+		if found {
+			return
+		}
+		if a, err = ReadABI(file); err != nil {
+			return
+		}
+		parsed[file] = a
+		return
+	}
+	// the protocol default abi is used for every filter
+	if p.ABI != "" {
+		a, err := read(p.ABI)
+		if err != nil {
+			return err
+		}
+		for address := range p.Filters {
+			c.registerABI(address, a)
+		}
+	}
+	// per contract abi take precedence, an empty path is no abi, e.g. for a
+	// router that the default abi does not describe
+	for address, file := range p.ABIs {
+		if file == "" {
+			c.unregisterABI(address)
+			continue
+		}
+		a, err := read(file)
+		if err != nil {
+			return err
+		}
+		c.registerABI(address, a)
+	}
+	return
+}
+
+func (c *Chain) registerABI(address string, a *abi.ABI) {
+	s := c.state()
+	s.contractABIM.Lock()
+	defer s.contractABIM.Unlock()
+	s.contractABIs[strings.ToLower(strings.TrimSpace(address))] = a
+}
+
+func (c *Chain) unregisterABI(address string) {
+	s := c.state()
+	s.contractABIM.Lock()
+	defer s.contractABIM.Unlock()
+	delete(s.contractABIs, strings.ToLower(strings.TrimSpace(address)))
+}
+
+// contractABI the abi registered for the contract
+func (c *Chain) contractABI(address string) *abi.ABI {
+	s := c.state()
+	s.contractABIM.RLock()
+	defer s.contractABIM.RUnlock()
+	return s.contractABIs[strings.ToLower(strings.TrimSpace(address))]
+}
+
+func (c *Chain) lookupEvent(address common.Address, topic common.Hash) (ev *abi.Event, found bool) {
+	s := c.state()
+	s.contractABIM.RLock()
+	defer s.contractABIM.RUnlock()
+	a, found := s.contractABIs[strings.ToLower(address.Hex())]
+	if !found {
+		return
+	}
+	ev, err := a.EventByID(topic)
+	found = err == nil
+	return
+}
+
+// DecodeLog decode a log with the ABI registered for the contract that
+// emitted it on the chain, returns found false if there is no ABI describing
+// the event
+func (c *Chain) DecodeLog(l *types.Log) (evt *DecodedEvent, found bool, err error) {
+	if len(l.Topics) == 0 {
+		return
+	}
+	ev, found := c.lookupEvent(l.Address, l.Topics[0])
+	if !found {
+		return
+	}
+	evt, err = decodeEvent(ev, l)
+	return
+}
+
+func decodeEvent(ev *abi.Event, l *types.Log) (evt *DecodedEvent, err error) {
+	raw := make(map[string]interface{})
+	// non-indexed arguments are in the data field
+	if err = ev.Inputs.NonIndexed().UnpackIntoMap(raw, l.Data); err != nil {
+		err = fmt.Errorf("cannot decode data of %s in tx %s: %v", ev.Name, l.TxHash.Hex(), err)
+		return
+	}
+	// indexed arguments are in the topics, after the signature
+	var indexed abi.Arguments
+	for _, in := range ev.Inputs {
+		if in.Indexed {
+			indexed = append(indexed, in)
+		}
+	}
+	if err = abi.ParseTopicsIntoMap(raw, indexed, l.Topics[1:]); err != nil {
+		err = fmt.Errorf("cannot decode topics of %s in tx %s: %v", ev.Name, l.TxHash.Hex(), err)
+		return
+	}
+	// normalize names and values
+	evt = &DecodedEvent{
+		Name: ev.RawName,
+		Args: make(map[string]interface{}, len(raw)),
+	}
+	for _, in := range ev.Inputs {
+		v := abiValue(raw[in.Name])
+		evt.Args[argName(in.Name)] = v
+		if in.Type.T == abi.AddressTy {
+			evt.Actors = append(evt.Actors, v.(string))
+		}
+	}
+	return
+}
+
+// argName make the argument names consistent with the other properties
+func argName(name string) string {
+	return strcase.ToLowerCamel(strings.TrimLeft(name, "_"))
+}
+
+// abiValue convert the decoded values to something that can be posted to the trust api
+func abiValue(v interface{}) interface{} {
+	switch x := v.(type) {
+	case common.Address:
+		return strings.ToLower(x.Hex())
+	case common.Hash:
+		return x.Hex()
+	case *big.Int:
+		return x.String()
+	case []byte:
+		return hexutil.Encode(x)
+	case [32]byte:
+		return hexutil.Encode(x[:])
+	case []common.Address:
+		vs := make([]string, len(x))
+		for i := range x {
+			vs[i] = strings.ToLower(x[i].Hex())
+		}
+		return vs
+	case []*big.Int:
+		vs := make([]string, len(x))
+		for i := range x {
+			vs[i] = x[i].String()
+		}
+		return vs
+	}
+	return v
+}
+
+// arg the string value of an argument, ok is false if the event has not been
+// decoded or it has no such argument
+func (evt *DecodedEvent) arg(name string) (v string, ok bool) {
+	if evt == nil {
+		return
+	}
+	v, ok = evt.Args[name].(string)
+	return
+}
@@ -0,0 +1,80 @@
+package collector
+
+import (
+	"math/big"
+	"testing"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/core/types"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDecodeLog(t *testing.T) {
+	p := Protocol{
+		Name: "Uniswap V3",
+		ABI:  "abis/uniswap_v3_pool.json",
+		Filters: map[string]string{
+			"0x88E6A0c2dDD26FEEb64F039a2c41296FcB3f5640": "Uniswap V3 WETH/USDC",
+		},
+	}
+	err := Mainnet.LoadABIs(p, "..")
+	assert.Nil(t, err)
+
+	pool := common.HexToAddress("0x88e6a0c2ddd26feeb64f039a2c41296fcb3f5640")
+	sender := common.HexToAddress("0xE592427A0AEce92De3Edee1F18E0157C05861564")
+	recipient := common.HexToAddress("0xDe5CAf81E2446BA4BAf9A35E1DB1ecF247f1eF89")
+
+	a, err := ReadABI("../abis/uniswap_v3_pool.json")
+	assert.Nil(t, err)
+	swap := a.Events["Swap"]
+	data, err := swap.Inputs.NonIndexed().Pack(
+		big.NewInt(-1000000),
+		big.NewInt(500000000000000000),
+		big.NewInt(1),
+		big.NewInt(2),
+		big.NewInt(-3),
+	)
+	assert.Nil(t, err)
+
+	l := &types.Log{
+		Address: pool,
+		Topics: []common.Hash{
+			swap.ID,
+			common.BytesToHash(sender.Bytes()),
+			common.BytesToHash(recipient.Bytes()),
+		},
+		Data: data,
+	}
+	evt, found, err := Mainnet.DecodeLog(l)
+	assert.Nil(t, err)
+	assert.True(t, found)
+	assert.Equal(t, "Swap", evt.Name)
+	assert.Equal(t, "0xe592427a0aece92de3edee1f18e0157c05861564", evt.Args["sender"])
+	assert.Equal(t, "0xde5caf81e2446ba4baf9a35e1db1ecf247f1ef89", evt.Args["recipient"])
+	assert.Equal(t, "-1000000", evt.Args["amount0"])
+	assert.Equal(t, "500000000000000000", evt.Args["amount1"])
+	assert.Equal(t, "-3", evt.Args["tick"])
+	assert.Equal(t, []string{
+		"0xe592427a0aece92de3edee1f18e0157c05861564",
+		"0xde5caf81e2446ba4baf9a35e1db1ecf247f1ef89",
+	}, evt.Actors)
+
+	// the abis of a chain are not used for the others
+	_, found, err = (&Chain{ID: big.NewInt(137)}).DecodeLog(l)
+	assert.Nil(t, err)
+	assert.False(t, found)
+
+	// unknown contracts are not decoded
+	l.Address = common.HexToAddress(ZeroAddress)
+	_, found, err = Mainnet.DecodeLog(l)
+	assert.Nil(t, err)
+	assert.False(t, found)
+
+	// an empty path leaves a filter without the default abi
+	p.ABIs = map[string]string{"0x88E6A0c2dDD26FEEb64F039a2c41296FcB3f5640": ""}
+	assert.Nil(t, Mainnet.LoadABIs(p, ".."))
+	l.Address = pool
+	_, found, err = Mainnet.DecodeLog(l)
+	assert.Nil(t, err)
+	assert.False(t, found)
+}
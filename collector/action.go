@@ -0,0 +1,165 @@
+package collector
+
+import (
+	"time"
+)
+
+// ActionType is the normalized name of what an actor did with a protocol
+type ActionType string
+
+// Action types shared by all the collectors
+const (
+	ActionSwap        ActionType = "swap"
+	ActionDeposit     ActionType = "deposit"
+	ActionWithdraw    ActionType = "withdraw"
+	ActionBorrow      ActionType = "borrow"
+	ActionRepay       ActionType = "repay"
+	ActionLiquidate   ActionType = "liquidate"
+	ActionStake       ActionType = "stake"
+	ActionClaim       ActionType = "claim"
+	ActionConsume     ActionType = "consume"
+	ActionTransfer    ActionType = "transfer"
+	ActionInteraction ActionType = "interaction"
+)
+
+// Sources of the actions
+const (
+	SourceEventLog  = "eventlog"
+	SourceEtherscan = "etherscan"
+	SourceOcean     = "ocean"
+)
+
+// Property keys of the interactions, shared by all the collectors
+const (
+	PropAction      = "action"
+	PropEvent       = "event"
+	PropTxID        = "txId"
+	PropTimestamp   = "timestamp"
+	PropSource      = "source"
+	PropAssetsIn    = "assetsIn"
+	PropAssetsOut   = "assetsOut"
+	PropValueUSD    = "valueUSD"
+	PropAmount      = "amount"
+	PropAmountValue = "amountValue"
+	PropTokenSymbol = "tokenSymbol"
+	PropTokenName   = "tokenName"
+	PropPrice       = "price"
+)
+
+var eventActions map[string]ActionType
+
+func init() {
+	// event names, as they appear in the contracts, mapped to actions
+	eventActions = map[string]ActionType{
+		"Swap":            ActionSwap,
+		"TokenPurchase":   ActionSwap,
+		"TokenExchange":   ActionSwap,
+		"Mint":            ActionDeposit,
+		"Deposit":         ActionDeposit,
+		"AddLiquidity":    ActionDeposit,
+		"Burn":            ActionWithdraw,
+		"Redeem":          ActionWithdraw,
+		"Withdraw":        ActionWithdraw,
+		"RemoveLiquidity": ActionWithdraw,
+		"Borrow":          ActionBorrow,
+		"RepayBorrow":     ActionRepay,
+		"Repay":           ActionRepay,
+		"LiquidateBorrow": ActionLiquidate,
+		"LiquidationCall": ActionLiquidate,
+		"Staked":          ActionStake,
+		"Stake":           ActionStake,
+		"Claim":           ActionClaim,
+		"Claimed":         ActionClaim,
+		"RewardPaid":      ActionClaim,
+		"Transfer":        ActionTransfer,
+	}
+}
+
+// ActionFromEvent return the action type for an event name, events that are
+// not known are generic interactions
+func ActionFromEvent(event string) ActionType {
+	if t, found := eventActions[event]; found {
+		return t
+	}
+	return ActionInteraction
+}
+
+// AssetAmount an amount of an asset moved by an action
+type AssetAmount struct {
+	// Asset the address of the token, or ETH for ether
+	Asset  string `json:"asset"`
+	Symbol string `json:"symbol,omitempty"`
+	Name   string `json:"name,omitempty"`
+	// TokenID the id of an nft
+	TokenID string `json:"tokenId,omitempty"`
+	// Amount the raw amount, not adjusted for the token decimals
+	Amount string `json:"amount"`
+	// Decimals of the token, nil when they are not known
+	Decimals *uint8 `json:"decimals,omitempty"`
+	// Value the amount adjusted for the token decimals, when they are known
+	Value string `json:"value,omitempty"`
+}
+
+// Action is a DeFi action in a form that does not depend on where it has been
+// collected from
+type Action struct {
+	Type ActionType
+	// Event the name of the action at the source (eg. the event name)
+	Event string
+	// Actor who did the action
+	Actor *TrustEntity
+	// Protocol what the actor interacted with
+	Protocol  *TrustEntity
+	TxHash    string
+	Timestamp time.Time
+	// AssetsIn the assets received by the actor
+	AssetsIn []AssetAmount
+	// AssetsOut the assets sent by the actor
+	AssetsOut []AssetAmount
+	// ValueUSD the value of the action in USD, nil when unknown
+	ValueUSD *float64
+	// Source where the action has been collected from
+	Source string
+	// Properties additional properties, they never override the action ones
+	Properties map[string]interface{}
+}
+
+// NewAction create a new action
+func NewAction(t ActionType, actor, protocol *TrustEntity) *Action {
+	return &Action{
+		Type:       t,
+		Actor:      actor,
+		Protocol:   protocol,
+		Properties: make(map[string]interface{}),
+	}
+}
+
+// Relationship translate the action to a relationship for the trust api
+func (a *Action) Relationship() *TrustRelationship {
+	rel := NewTrustRelationship()
+	rel.Type = TypeInteraction
+	rel.SourceCriteria = a.Actor
+	rel.TargetCriteria = a.Protocol
+	rel.Properties[PropAction] = string(a.Type)
+	rel.Properties[PropTxID] = a.TxHash
+	rel.Properties[PropTimestamp] = a.Timestamp
+	rel.Properties[PropSource] = a.Source
+	if a.Event != "" {
+		rel.Properties[PropEvent] = a.Event
+	}
+	if len(a.AssetsIn) > 0 {
+		rel.Properties[PropAssetsIn] = a.AssetsIn
+	}
+	if len(a.AssetsOut) > 0 {
+		rel.Properties[PropAssetsOut] = a.AssetsOut
+	}
+	if a.ValueUSD != nil {
+		rel.Properties[PropValueUSD] = *a.ValueUSD
+	}
+	for k, v := range a.Properties {
+		if _, reserved := rel.Properties[k]; !reserved {
+			rel.Properties[k] = v
+		}
+	}
+	return rel
+}
@@ -0,0 +1,47 @@
+package collector
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestActionFromEvent(t *testing.T) {
+	assert.Equal(t, ActionSwap, ActionFromEvent("Swap"))
+	assert.Equal(t, ActionRepay, ActionFromEvent("RepayBorrow"))
+	assert.Equal(t, ActionWithdraw, ActionFromEvent("Redeem"))
+	assert.Equal(t, ActionInteraction, ActionFromEvent("Sync"))
+}
+
+func TestActionRelationship(t *testing.T) {
+	actor, _ := Mainnet.criteria(NewAddressFromString("0xDe5CAf81E2446BA4BAf9A35E1DB1ecF247f1eF89"), nil)
+	protocol := NewTrustEntity("")
+	protocol.Type = TypeDefiProtocol
+	protocol.Ids["address"] = "0xe592427a0aece92de3edee1f18e0157c05861564"
+
+	usd := 12.5
+	a := NewAction(ActionSwap, actor, protocol)
+	a.Event = "Swap"
+	a.TxHash = "0x01"
+	a.Timestamp = time.Unix(1600000000, 0)
+	a.Source = SourceEventLog
+	a.AssetsOut = []AssetAmount{{Asset: "ETH", Amount: "1000"}}
+	a.ValueUSD = &usd
+	a.Properties["action"] = "Swap"
+	a.Properties["amount0"] = "1000"
+
+	rel := a.Relationship()
+	assert.Equal(t, TypeInteraction, rel.Type)
+	assert.Equal(t, actor, rel.SourceCriteria)
+	assert.Equal(t, protocol, rel.TargetCriteria)
+	assert.Equal(t, "swap", rel.Properties["action"])
+	assert.Equal(t, "Swap", rel.Properties["event"])
+	assert.Equal(t, "0x01", rel.Properties["txId"])
+	assert.Equal(t, SourceEventLog, rel.Properties["source"])
+	assert.Equal(t, 12.5, rel.Properties["valueUSD"])
+	assert.Equal(t, "1000", rel.Properties["amount0"])
+	assert.Equal(t, a.AssetsOut, rel.Properties["assetsOut"])
+	_, hasIn := rel.Properties["assetsIn"]
+	assert.False(t, hasIn)
+}
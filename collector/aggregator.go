@@ -1,88 +1,330 @@
 package collector
 
 import (
+	"context"
 	"encoding/json"
-	"fmt"
+	"math/big"
 	"strings"
 	"sync"
 	"time"
 
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/core/types"
 	log "github.com/sirupsen/logrus"
 )
 
-var (
-	txBufferM  sync.RWMutex
-	txBuffer   map[string]chan EthEvent
-	doneBuffer chan string
-)
+// AggregationWindow how long the logs of a tx are collected, when no log of
+// a later block arrives in the meantime
+var AggregationWindow = 5 * time.Second
+
+// Aggregator merges the actions of the logs of a tx into one interaction per
+// (user, protocol, tx), and one changeset per (protocol, tx). All the logs of
+// a tx are in the same block, so a tx is complete when a log of a later block
+// arrives, or after the window.
+type Aggregator struct {
+	// Done is called for every log once the changeset of its tx has been
+	// posted, or right away if the log makes no changeset, it can be nil
+	Done  func(l types.Log)
+	chain *Chain
+	emit  func(cs *TrustAPIChangeSet)
+	txs   map[txKey]*txActions
+	order []txKey
+	m     sync.Mutex
+}
+
+// txKey the logs of a tx emitted by the contracts of a protocol
+type txKey struct {
+	hash     common.Hash
+	protocol string
+}
+
+// txActions the actions collected for a tx and a protocol
+type txActions struct {
+	txKey
+	block   uint64
+	updated time.Time
+	logs    []types.Log
+	actions []logAction
+	// relationships that are not aggregated
+	relationships []*TrustRelationship
+	entities      []*TrustEntity
+}
+
+// indexes the indexes of the logs of the tx
+func (tx *txActions) indexes() (indexes []uint) {
+	for _, l := range tx.logs {
+		indexes = append(indexes, l.Index)
+	}
+	return
+}
+
+// logAction an action and the index of the log it comes from
+type logAction struct {
+	index  uint
+	action *Action
+}
+
+// NewAggregator create an aggregator that passes the changesets of the
+// complete txs to emit, tagged with the chain
+func NewAggregator(chain *Chain, emit func(cs *TrustAPIChangeSet)) *Aggregator {
+	return &Aggregator{
+		chain: chain,
+		emit:  emit,
+		txs:   make(map[txKey]*txActions),
+	}
+}
+
+// Add collect the actions parsed from a log, the txs of the blocks before the
+// log are complete and emitted before Add returns
+func (ag *Aggregator) Add(l *types.Log, p *parsedLog) {
+	ag.m.Lock()
+	var done []*txActions
+	if len(ag.order) > 0 && ag.txs[ag.order[len(ag.order)-1]].block < l.BlockNumber {
+		done = ag.take(func(tx *txActions) bool { return tx.block < l.BlockNumber })
+	}
+	k := txKey{l.TxHash, ag.protocolOf(l.Address)}
+	tx, found := ag.txs[k]
+	if !found {
+		tx = &txActions{txKey: k, block: l.BlockNumber}
+		ag.txs[k] = tx
+		ag.order = append(ag.order, k)
+	}
+	tx.updated = time.Now()
+	tx.logs = append(tx.logs, *l)
+	for _, a := range p.actions {
+		tx.actions = append(tx.actions, logAction{index: l.Index, action: a})
+	}
+	tx.relationships = append(tx.relationships, p.relationships...)
+	tx.entities = append(tx.entities, p.entities...)
+	ag.m.Unlock()
+	ag.flush(done)
+}
 
-func init() {
-	// txBuffer = make(map[string]chan EthEvent)
-	// doneBuffer = make(chan string)
-	// go cleaner()
+// protocolOf the protocol of a contract, the contract itself if it is unknown
+func (ag *Aggregator) protocolOf(address common.Address) string {
+	if protocol, _, found := ag.chain.cacheGet(address.Hex()); found {
+		return strings.ToLower(protocol)
+	}
+	return strings.ToLower(address.Hex())
 }
 
-func _name(name, address string) string {
-	if name == "" {
-		return address
+// Remove drop the tx of a log removed by a reorg before it has been emitted,
+// found is false if the tx is not pending
+func (ag *Aggregator) Remove(l *types.Log) (found bool) {
+	ag.m.Lock()
+	removed := ag.take(func(tx *txActions) bool { return tx.hash == l.TxHash })
+	ag.m.Unlock()
+	for _, tx := range removed {
+		ag.done(tx.logs...)
 	}
-	return name
+	return len(removed) > 0
 }
 
-func aggregate(events chan EthEvent) {
+// done pass the logs to Done
+func (ag *Aggregator) done(logs ...types.Log) {
+	if ag.Done == nil {
+		return
+	}
+	for _, l := range logs {
+		ag.Done(l)
+	}
+}
 
-	evts := []EthEvent{}
+// Flush emit all the pending txs
+func (ag *Aggregator) Flush() {
+	ag.m.Lock()
+	done := ag.take(func(tx *txActions) bool { return true })
+	ag.m.Unlock()
+	ag.flush(done)
+}
 
-	time.AfterFunc(time.Duration(5)*time.Second, func() {
-		close(events)
-	})
+// FlushExpired emit the txs that got no log for longer than the window
+func (ag *Aggregator) FlushExpired(window time.Duration) {
+	ag.m.Lock()
+	done := ag.take(func(tx *txActions) bool { return time.Since(tx.updated) >= window })
+	ag.m.Unlock()
+	ag.flush(done)
+}
 
+// Run flush the expired txs until ctx is done
+func (ag *Aggregator) Run(ctx context.Context, window time.Duration) {
+	ticker := time.NewTicker(window / 2)
+	defer ticker.Stop()
 	for {
-		evt, more := <-events
-		if !more {
-			var sb strings.Builder
-			sb.WriteString("---------------TX SUMMARY-------------\n")
-			sb.WriteString(fmt.Sprintf("Protocol %s\n", evts[0].Context.Name))
-			sb.WriteString(fmt.Sprintf("Tx       %s\n", fmt.Sprint("https://etherscan.io/tx/", evts[0].TransactionHash)))
-
-			for i, v := range evts {
-				sb.WriteString(fmt.Sprintf("%d. %20s     %20v -> %20v\n", i+1, v.Action, v.Recipients, v.Senders))
-			}
-			sb.WriteString("---------------//////////-------------\n")
-			log.Info(sb.String())
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			ag.FlushExpired(window)
+		}
+	}
+}
 
-			doneBuffer <- evts[0].TransactionHash
-			break
+// Len the number of pending txs
+func (ag *Aggregator) Len() int {
+	ag.m.Lock()
+	defer ag.m.Unlock()
+	return len(ag.order)
+}
+
+// take remove the txs matching the filter, in the order they arrived
+func (ag *Aggregator) take(filter func(tx *txActions) bool) (taken []*txActions) {
+	var order []txKey
+	for _, k := range ag.order {
+		tx := ag.txs[k]
+		if filter(tx) {
+			taken = append(taken, tx)
+			delete(ag.txs, k)
+			continue
 		}
-		evts = append(evts, evt)
+		order = append(order, k)
 	}
+	ag.order = order
+	return
+}
 
+func (ag *Aggregator) flush(txs []*txActions) {
+	for _, tx := range txs {
+		cs := NewChangeset(tx.entities...)
+		for _, a := range aggregateActions(tx.actions) {
+			cs.AddRel(a)
+		}
+		for _, r := range tx.relationships {
+			cs.AddRel(r)
+		}
+		if len(cs.Entities) == 0 && len(cs.Relationship) == 0 {
+			ag.done(tx.logs...)
+			continue
+		}
+		logs, hash, block := tx.logs, tx.hash, tx.block
+		cs.onPosted(func() {
+			// only what has been posted can be retracted by a reorg
+			ag.chain.trackTx(hash, block, cs)
+			ag.done(logs...)
+		})
+		ag.chain.Tag(cs)
+		cs.Key = LogPostKey(ag.chain, tx.hash, tx.indexes()...)
+		ag.emit(cs)
+	}
 }
 
-func cleaner() {
-	for {
-		txh, more := <-doneBuffer
-		if !more {
-			break
+// aggregateActions build one relationship per (actor, protocol) from the
+// actions of the logs of a tx. The relationship of a single action is the
+// action one, when there are more they are listed in the actions property of
+// a composite interaction.
+func aggregateActions(actions []logAction) (rels []*TrustRelationship) {
+	type pair struct{ actor, protocol string }
+	var order []pair
+	groups := make(map[pair][]logAction)
+	for _, la := range actions {
+		k := pair{la.action.Actor.Ids["address"], la.action.Protocol.Ids["address"]}
+		if _, found := groups[k]; !found {
+			order = append(order, k)
+		}
+		groups[k] = append(groups[k], la)
+	}
+	for _, k := range order {
+		group := groups[k]
+		if len(group) == 1 {
+			rels = append(rels, group[0].action.Relationship())
+			continue
 		}
-		txBufferM.Lock()
-		delete(txBuffer, txh)
-		txBufferM.Unlock()
+		rels = append(rels, compositeAction(group).Relationship())
 	}
-	log.Info("cleaner done")
+	return
 }
 
-func queue(e EthEvent) {
-	txBufferM.Lock()
+// compositeAction merge the actions of an actor with a protocol in a tx, the
+// type is the one of the first action that is more specific than a transfer
+func compositeAction(group []logAction) *Action {
+	first := group[0].action
+	main := first
+	for _, la := range group {
+		if la.action.Type != ActionTransfer && la.action.Type != ActionInteraction {
+			main = la.action
+			break
+		}
+	}
+	c := NewAction(main.Type, first.Actor, first.Protocol)
+	c.Event = main.Event
+	c.TxHash = first.TxHash
+	c.Timestamp = first.Timestamp
+	c.Source = first.Source
+	var subs []map[string]interface{}
+	var path []string
+	inPath := make(map[string]bool)
+	// the value is known only when it is known for every action
+	valueUSD, valueKnown := 0.0, true
+	for _, la := range group {
+		a := la.action
+		c.AssetsIn = addAmounts(c.AssetsIn, a.AssetsIn)
+		c.AssetsOut = addAmounts(c.AssetsOut, a.AssetsOut)
+		if a.ValueUSD != nil {
+			valueUSD += *a.ValueUSD
+		} else {
+			valueKnown = false
+		}
+		// the intermediate addresses of all the actions
+		p, _ := a.Properties["path"].([]string)
+		for _, address := range p {
+			if !inPath[address] {
+				inPath[address] = true
+				path = append(path, address)
+			}
+		}
+		sub := map[string]interface{}{
+			"action":   string(a.Type),
+			"event":    a.Event,
+			"logIndex": la.index,
+		}
+		if len(a.AssetsIn) > 0 {
+			sub["assetsIn"] = a.AssetsIn
+		}
+		if len(a.AssetsOut) > 0 {
+			sub["assetsOut"] = a.AssetsOut
+		}
+		if a.ValueUSD != nil {
+			sub["valueUSD"] = *a.ValueUSD
+		}
+		if len(a.Properties) > 0 {
+			sub["properties"] = a.Properties
+		}
+		subs = append(subs, sub)
+	}
+	if valueKnown {
+		c.ValueUSD = &valueUSD
+	}
+	c.Properties["actions"] = subs
+	if len(path) > 0 {
+		c.Properties["path"] = path
+	}
+	return c
+}
 
-	evtChan, found := txBuffer[e.TransactionHash]
-	if !found {
-		evtChan = make(chan EthEvent)
-		go aggregate(evtChan)
-		txBuffer[e.TransactionHash] = evtChan
+// addAmounts add the amounts to the totals, summing the ones of the same asset
+func addAmounts(totals []AssetAmount, amounts []AssetAmount) []AssetAmount {
+	for _, a := range amounts {
+		v, ok := new(big.Int).SetString(a.Amount, 10)
+		summed := false
+		for i, t := range totals {
+			if t.Asset != a.Asset || t.TokenID != a.TokenID || !ok {
+				continue
+			}
+			if tv, tok := new(big.Int).SetString(t.Amount, 10); tok {
+				tv.Add(tv, v)
+				totals[i].Amount = tv.String()
+				if t.Decimals != nil {
+					totals[i].Value = FormatAmount(tv, *t.Decimals)
+				}
+				summed = true
+				break
+			}
+		}
+		if !summed {
+			totals = append(totals, a)
+		}
 	}
-	evtChan <- e
-	txBufferM.Unlock()
+	return totals
 }
 
 // EthEvent an contract interaction
@@ -94,24 +336,26 @@ type EthEvent struct {
 	TransactionHash string    `json:"tx_hash,omitempty"`
 	Recipients      []string  `json:"recipients,omitempty"`
 	Senders         []string  `json:"senders,omitempty"`
+	// Chain the chain of the event, nil for mainnet
+	Chain *Chain `json:"-"`
 }
 
 // LogEvent print an event on stdout
 func LogEvent(evt *EthEvent) []byte {
 
 	format := "%20s: %v"
-	log.Printf(format, "block_number", fmt.Sprint("https://etherscan.io/blocks/", evt.BlockNumber))
+	log.Printf(format, "block_number", evt.Chain.Link("block", evt.BlockNumber))
 	log.Printf(format, "block_time", evt.BlockTime)
 	// log.Printf(format, "contract_address", fmt.Sprint("https://etherscan.io/address/", evt.Context.Address))
 	log.Printf(format, "contract_name", evt.Context.Name)
 	log.Printf(format, "protocol", evt.Context.Name)
-	log.Printf(format, "tx_hash", fmt.Sprint("https://etherscan.io/tx/", evt.TransactionHash))
+	log.Printf(format, "tx_hash", evt.Chain.Link("tx", evt.TransactionHash))
 	log.Printf(format, "recipients:", "")
 	for _, v := range evt.Recipients {
-		log.Printf(format, "from_address", fmt.Sprint("https://etherscan.io/address/", v))
+		log.Printf(format, "from_address", evt.Chain.Link("address", v))
 	}
 	for _, v := range evt.Senders {
-		log.Printf(format, "to_address", fmt.Sprint("https://etherscan.io/address/", v))
+		log.Printf(format, "to_address", evt.Chain.Link("address", v))
 	}
 	log.Printf(format, "action", evt.Action)
 	//log.Printf(format, "amount", evt.Amount)
@@ -0,0 +1,159 @@
+package collector
+
+import (
+	"math/big"
+	"testing"
+	"time"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/core/types"
+	"github.com/stretchr/testify/assert"
+)
+
+func testEntity(address string) *TrustEntity {
+	e := NewTrustEntity("")
+	e.Ids["address"] = address
+	return e
+}
+
+func testAction(t ActionType, actor, protocol string, in, out []AssetAmount) *Action {
+	a := NewAction(t, testEntity(actor), testEntity(protocol))
+	a.Event = "Transfer"
+	if t == ActionSwap {
+		a.Event = "Swap"
+	}
+	a.TxHash = "0x01"
+	a.Source = SourceEventLog
+	a.AssetsIn, a.AssetsOut = in, out
+	return a
+}
+
+func aggLog(block uint64, tx int64, index uint) *types.Log {
+	return &types.Log{BlockNumber: block, TxHash: common.BigToHash(big.NewInt(tx)), Index: index}
+}
+
+func TestAggregator(t *testing.T) {
+	var emitted []*TrustAPIChangeSet
+	agg := NewAggregator(&Chain{ID: big.NewInt(1), Network: "mainnet"}, func(cs *TrustAPIChangeSet) {
+		emitted = append(emitted, cs)
+	})
+	weth := []AssetAmount{{Asset: "0xweth", Amount: "100"}}
+	usdc := []AssetAmount{{Asset: "0xusdc", Amount: "250"}}
+
+	// a router swap emits several logs in the same tx
+	agg.Add(aggLog(10, 1, 0), &parsedLog{actions: []*Action{testAction(ActionTransfer, "0xuser", "0xpool", nil, weth)}, entities: []*TrustEntity{testEntity("0xuser")}})
+	agg.Add(aggLog(10, 1, 1), &parsedLog{actions: []*Action{testAction(ActionTransfer, "0xuser", "0xpool", usdc, nil)}})
+	agg.Add(aggLog(10, 1, 2), &parsedLog{actions: []*Action{testAction(ActionSwap, "0xuser", "0xpool", nil, nil)}})
+	agg.Add(aggLog(10, 1, 3), &parsedLog{actions: []*Action{testAction(ActionTransfer, "0xuser", "0xpool", nil, weth)}})
+	// another user in the same block
+	agg.Add(aggLog(10, 2, 4), &parsedLog{actions: []*Action{testAction(ActionTransfer, "0xother", "0xpool", nil, weth)}})
+	assert.Empty(t, emitted)
+	assert.Equal(t, 2, agg.Len())
+
+	// a log of a later block completes the txs
+	agg.Add(aggLog(11, 3, 0), &parsedLog{actions: []*Action{testAction(ActionTransfer, "0xuser", "0xpool", nil, weth)}})
+	assert.Len(t, emitted, 2)
+	assert.Equal(t, 1, agg.Len())
+
+	cs := emitted[0]
+	assert.Len(t, cs.Entities, 1)
+	assert.Equal(t, "mainnet", cs.Entities[0].Properties["network"])
+	if assert.Len(t, cs.Relationship, 1) {
+		r := cs.Relationship[0]
+		assert.Equal(t, "swap", r.Properties["action"])
+		assert.Equal(t, "Swap", r.Properties["event"])
+		assert.Equal(t, "mainnet", r.Properties["network"])
+		assert.Equal(t, []AssetAmount{{Asset: "0xusdc", Amount: "250"}}, r.Properties["assetsIn"])
+		assert.Equal(t, []AssetAmount{{Asset: "0xweth", Amount: "200"}}, r.Properties["assetsOut"])
+		subs := r.Properties["actions"].([]map[string]interface{})
+		assert.Len(t, subs, 4)
+		assert.Equal(t, uint(2), subs[2]["logIndex"])
+		assert.Equal(t, "swap", subs[2]["action"])
+	}
+	// a single action is posted as it is
+	if assert.Len(t, emitted[1].Relationship, 1) {
+		r := emitted[1].Relationship[0]
+		assert.Equal(t, "transfer", r.Properties["action"])
+		assert.Nil(t, r.Properties["actions"])
+	}
+
+	// a tx removed by a reorg before it is emitted is dropped
+	assert.True(t, agg.Remove(aggLog(11, 3, 0)))
+	assert.False(t, agg.Remove(aggLog(11, 3, 0)))
+	agg.Flush()
+	assert.Len(t, emitted, 2)
+
+	// the last tx is emitted after the window
+	agg.Add(aggLog(12, 4, 0), &parsedLog{actions: []*Action{testAction(ActionTransfer, "0xuser", "0xpool", nil, weth)}})
+	agg.FlushExpired(time.Hour)
+	assert.Len(t, emitted, 2)
+	agg.FlushExpired(0)
+	assert.Len(t, emitted, 3)
+}
+
+func TestAggregatorProtocols(t *testing.T) {
+	var emitted []*TrustAPIChangeSet
+	chain := &Chain{ID: big.NewInt(1011)}
+	agg := NewAggregator(chain, func(cs *TrustAPIChangeSet) {
+		emitted = append(emitted, cs)
+	})
+	pool, router := common.HexToAddress("0x00000000000000000000000000000000000a0011"), common.HexToAddress("0x00000000000000000000000000000000000a0012")
+	other := common.HexToAddress("0x00000000000000000000000000000000000b0011")
+	chain.cachePush(pool.Hex(), "0xProtocolA", TypeDefiProtocol)
+	chain.cachePush(router.Hex(), "0xProtocolA", TypeDefiProtocol)
+	chain.cachePush(other.Hex(), "0xProtocolB", TypeDefiProtocol)
+	add := func(address common.Address, index uint, protocol string) {
+		l := aggLog(20, 1, index)
+		l.Address = address
+		agg.Add(l, &parsedLog{actions: []*Action{testAction(ActionTransfer, "0xuser", protocol, nil, nil)}})
+	}
+
+	// a tx with the logs of two protocols is a changeset per protocol, keyed
+	// on the logs it is made of
+	add(other, 1, "0xprotocolb")
+	add(pool, 2, "0xprotocola")
+	add(router, 3, "0xprotocola")
+	agg.Flush()
+	tx := common.BigToHash(big.NewInt(1))
+	if assert.Len(t, emitted, 2) {
+		assert.Equal(t, LogPostKey(chain, tx, 1), emitted[0].Key)
+		assert.Equal(t, LogPostKey(chain, tx, 2, 3), emitted[1].Key)
+		assert.Len(t, emitted[1].Relationship, 1)
+	}
+	// a log that arrives late, e.g. of a pool discovered in the tx, is not
+	// taken for the changeset already posted
+	emitted = nil
+	add(router, 4, "0xprotocola")
+	agg.Flush()
+	if assert.Len(t, emitted, 1) {
+		assert.Equal(t, LogPostKey(chain, tx, 4), emitted[0].Key)
+		assert.NotEqual(t, LogPostKey(chain, tx, 2, 3), emitted[0].Key)
+	}
+}
+
+func TestAggregatorDone(t *testing.T) {
+	var emitted []*TrustAPIChangeSet
+	agg := NewAggregator(nil, func(cs *TrustAPIChangeSet) {
+		emitted = append(emitted, cs)
+	})
+	var done []uint
+	agg.Done = func(l types.Log) { done = append(done, l.Index) }
+
+	// the logs of a tx are done once its changeset has been posted
+	agg.Add(aggLog(10, 1, 0), &parsedLog{actions: []*Action{testAction(ActionTransfer, "0xuser", "0xpool", nil, nil)}})
+	agg.Add(aggLog(10, 1, 1), &parsedLog{})
+	// a tx without actions is done right away
+	agg.Add(aggLog(10, 2, 2), &parsedLog{})
+	agg.Flush()
+	assert.Equal(t, []uint{2}, done)
+	if assert.Len(t, emitted, 1) {
+		emitted[0].acknowledge()
+	}
+	assert.Equal(t, []uint{2, 0, 1}, done)
+
+	// a tx removed by a reorg before it is emitted is done
+	done = nil
+	agg.Add(aggLog(11, 3, 0), &parsedLog{actions: []*Action{testAction(ActionTransfer, "0xuser", "0xpool", nil, nil)}})
+	assert.True(t, agg.Remove(aggLog(11, 3, 0)))
+	assert.Equal(t, []uint{0}, done)
+}
@@ -0,0 +1,210 @@
+package collector
+
+import (
+	"context"
+	"fmt"
+	"math/big"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/ethereum/go-ethereum"
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/core/types"
+	"github.com/ethereum/go-ethereum/ethclient"
+	log "github.com/sirupsen/logrus"
+	"github.com/utu-crowdsale/defi-portal-scanner/config"
+)
+
+// bounds of the block ranges requested with eth_getLogs
+const (
+	logsRangeChunk    = 2000
+	minLogsRangeChunk = 1
+)
+
+// tooManyLogsErrors are the messages the nodes use to refuse a range that
+// has too many logs in it
+var tooManyLogsErrors = []string{
+	"more than 10000 results",
+	"response size exceeded",
+	"response size should not",
+	"log response size",
+	"block range is too wide",
+	"block range too large",
+	"exceed maximum block range",
+	"query timeout exceeded",
+	"limit exceeded",
+}
+
+// isTooManyLogs tells if the node refused the range because it is too big
+func isTooManyLogs(err error) bool {
+	msg := strings.ToLower(err.Error())
+	for _, m := range tooManyLogsErrors {
+		if strings.Contains(msg, m) {
+			return true
+		}
+	}
+	return false
+}
+
+// FilterLogsRange call fn, in chain order, for the logs matching the query
+// between the from and to blocks included. The range is requested in chunks,
+// a chunk is halved when the node says that it is too big and it grows back
+// after a success.
+func FilterLogsRange(ctx context.Context, client ethereum.LogFilterer, query ethereum.FilterQuery, from, to uint64, fn func(l types.Log) error) (err error) {
+	chunk := uint64(logsRangeChunk)
+	for start := from; start <= to; {
+		end := start + chunk - 1
+		if end > to {
+			end = to
+		}
+		q := query
+		q.FromBlock = new(big.Int).SetUint64(start)
+		q.ToBlock = new(big.Int).SetUint64(end)
+		logs, err := client.FilterLogs(ctx, q)
+		if err != nil {
+			if isTooManyLogs(err) && chunk > minLogsRangeChunk {
+				chunk /= 2
+				log.Debugf("too many logs from block %d to %d, shrinking the range to %d blocks", start, end, chunk)
+				continue
+			}
+			return fmt.Errorf("cannot get logs from block %d to %d: %v", start, end, err)
+		}
+		for _, l := range logs {
+			if err = fn(l); err != nil {
+				return err
+			}
+		}
+		if chunk < logsRangeChunk {
+			chunk *= 2
+		}
+		start = end + 1
+	}
+	return
+}
+
+// FilterPoolsRange call fn, in chain order, for the logs of the addresses
+// between the from and to blocks included, and for the logs of the pools
+// that the factories among them create in the range. The pools are queried
+// from their creation after the logs of the addresses, complete is called
+// once the logs of a pass have been delivered.
+func FilterPoolsRange(ctx context.Context, client ethereum.LogFilterer, chain *Chain, addresses []common.Address, from, to uint64, fn func(l types.Log) error, complete func()) (err error) {
+	for len(addresses) > 0 {
+		var pools []common.Address
+		var poolsFrom uint64
+		// the addresses are queried for the events they follow
+		shards := shard(ethereum.FilterQuery{Addresses: addresses}, 0, chain)
+		err = FilterShardsRange(ctx, client, shards, from, to, func(l types.Log) error {
+			if pool, err := chain.DiscoverPool(&l); err != nil {
+				log.Warn("error discovering pool: ", err)
+			} else if pool != nil && chain.addPool(*pool) {
+				if len(pools) == 0 || l.BlockNumber < poolsFrom {
+					poolsFrom = l.BlockNumber
+				}
+				pools = append(pools, common.HexToAddress(pool.Address))
+			}
+			return fn(l)
+		})
+		if err != nil {
+			return
+		}
+		complete()
+		if len(pools) > 0 {
+			log.Infof("backfilling %d pools discovered from block %d", len(pools), poolsFrom)
+		}
+		addresses, from = pools, poolsFrom
+	}
+	return
+}
+
+// Backfill run the logs of the protocols between two blocks through the same
+// processing of the live collector, so that the history of a protocol is
+// posted to the trust api. It backfills the chain with the network name, or
+// the first configured chain if network is empty. If protocol is not empty
+// only the protocol with that name is backfilled, if to is 0 it backfills up
+// to the chain head.
+func Backfill(cfg config.Schema, network string, from, to uint64, protocol string) (err error) {
+	chainCfg, found := cfg.Chain(network)
+	if !found {
+		return fmt.Errorf("unknown network '%s'", network)
+	}
+	client, err := ethclient.Dial(chainCfg.NodeURL())
+	if err != nil {
+		return
+	}
+	defer client.Close()
+	ctx := context.Background()
+	chainID, err := client.ChainID(ctx)
+	if err != nil {
+		return
+	}
+	chain := &Chain{ID: chainID, Network: chainCfg.Network, Explorer: chainCfg.ExplorerURL}
+	protocols, err := ReadProtocols(chainCfg.DefiSourcesFile)
+	if err != nil {
+		return fmt.Errorf("cannot retrieve the defi protocols from %s: %v", chainCfg.DefiSourcesFile, err)
+	}
+	// all the protocols are registered, so that their addresses are known
+	// but only the selected one is queried
+	var filters []common.Address
+	for _, p := range protocols.DefiProtocols {
+		pf, err := registerProtocol(p, filepath.Dir(chainCfg.DefiSourcesFile), chain)
+		if err != nil {
+			return err
+		}
+		if protocol == "" || strings.EqualFold(protocol, p.Name) {
+			filters = append(filters, pf...)
+		}
+	}
+	// and the pools discovered by the live collector
+	pools, err := chain.loadPools()
+	if err != nil {
+		return
+	}
+	for _, p := range pools {
+		if protocol == "" || strings.EqualFold(protocol, p.Protocol) {
+			filters = append(filters, common.HexToAddress(p.Address))
+		}
+	}
+	if len(filters) == 0 {
+		return fmt.Errorf("no addresses to backfill for protocol '%s'", protocol)
+	}
+	if to == 0 {
+		header, err := client.HeaderByNumber(ctx, nil)
+		if err != nil {
+			return err
+		}
+		to = header.Number.Uint64()
+	}
+	if from > to {
+		return fmt.Errorf("invalid range: from block %d is after to block %d", from, to)
+	}
+	log.Infof("backfilling %d addresses on %s from block %d to %d", len(filters), chain.Network, from, to)
+
+	var processed, skipped int
+	started, reported := time.Now(), time.Now()
+	agg := NewAggregator(chain, func(cs *TrustAPIChangeSet) {
+		csQueue <- cs
+	})
+	// the last txs are complete also if the range fails
+	defer agg.Flush()
+	err = FilterPoolsRange(ctx, client, chain, filters, from, to, func(l types.Log) error {
+		if err := processLog(&l, client, agg); err != nil {
+			log.Debug("error parsing log: ", err)
+			skipped++
+			return nil
+		}
+		processed++
+		// report the progress
+		if time.Since(reported) > 10*time.Second {
+			reported = time.Now()
+			done := float64(l.BlockNumber-from+1) / float64(to-from+1) * 100
+			log.Infof("backfill at block %d (%.1f%%): %d logs processed, %d skipped", l.BlockNumber, done, processed, skipped)
+		}
+		return nil
+	}, agg.Flush)
+	if err != nil {
+		return
+	}
+	log.Infof("backfill completed in %s: %d logs processed, %d skipped", time.Since(started).Round(time.Second), processed, skipped)
+	return
+}
@@ -0,0 +1,139 @@
+package collector
+
+import (
+	"context"
+	"errors"
+	"math/big"
+	"testing"
+
+	"github.com/ethereum/go-ethereum"
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/core/types"
+	"github.com/stretchr/testify/assert"
+)
+
+// limitedNode refuses the ranges of more than limit blocks
+type limitedNode struct {
+	limit  uint64
+	calls  int
+	ranges [][2]uint64
+}
+
+func (n *limitedNode) FilterLogs(ctx context.Context, q ethereum.FilterQuery) (logs []types.Log, err error) {
+	n.calls++
+	from, to := q.FromBlock.Uint64(), q.ToBlock.Uint64()
+	if to-from+1 > n.limit {
+		return nil, errors.New("query returned more than 10000 results")
+	}
+	n.ranges = append(n.ranges, [2]uint64{from, to})
+	for b := from; b <= to; b++ {
+		logs = append(logs, types.Log{BlockNumber: b})
+	}
+	return
+}
+
+func (n *limitedNode) SubscribeFilterLogs(ctx context.Context, q ethereum.FilterQuery, ch chan<- types.Log) (ethereum.Subscription, error) {
+	return nil, errors.New("not supported")
+}
+
+func TestFilterLogsRangeShrinksChunks(t *testing.T) {
+	node := &limitedNode{limit: 500}
+	var blocks []uint64
+	err := FilterLogsRange(context.Background(), node, ethereum.FilterQuery{}, 100, 3099, func(l types.Log) error {
+		blocks = append(blocks, l.BlockNumber)
+		return nil
+	})
+	assert.Nil(t, err)
+	// every block is seen once, in order
+	assert.Len(t, blocks, 3000)
+	for i, b := range blocks {
+		assert.Equal(t, uint64(100+i), b)
+	}
+	for _, r := range node.ranges {
+		assert.LessOrEqual(t, r[1]-r[0]+1, uint64(500))
+	}
+
+	// other errors are not retried
+	failing := &failingNode{limitedNode: &limitedNode{}}
+	err = FilterLogsRange(context.Background(), failing, ethereum.FilterQuery{}, 1, 10, func(l types.Log) error { return nil })
+	assert.NotNil(t, err)
+	assert.Equal(t, 1, failing.calls)
+}
+
+type failingNode struct {
+	*limitedNode
+}
+
+func (n *failingNode) FilterLogs(ctx context.Context, q ethereum.FilterQuery) ([]types.Log, error) {
+	n.calls++
+	return nil, errors.New("connection refused")
+}
+
+// logsNode returns its logs that match the addresses and the range of the
+// query
+type logsNode struct {
+	limitedNode
+	logs    []types.Log
+	queries []ethereum.FilterQuery
+}
+
+func (n *logsNode) FilterLogs(ctx context.Context, q ethereum.FilterQuery) (logs []types.Log, err error) {
+	n.queries = append(n.queries, q)
+	for _, l := range n.logs {
+		if l.BlockNumber < q.FromBlock.Uint64() || l.BlockNumber > q.ToBlock.Uint64() {
+			continue
+		}
+		for _, a := range q.Addresses {
+			if a == l.Address {
+				logs = append(logs, l)
+			}
+		}
+	}
+	return
+}
+
+func TestFilterPoolsRange(t *testing.T) {
+	factory := common.HexToAddress("0x1F98431c8aD98523631AE4a59f267346ea31F984")
+	p := Protocol{
+		Name:        "Uniswap V3",
+		MainAddress: "0xE592427A0AEce92De3Edee1F18E0157C05861564",
+		ABI:         "abis/uniswap_v3_pool.json",
+		Factories: []Factory{
+			{Address: factory.Hex(), Event: "PoolCreated", Argument: "pool", ABI: "abis/uniswap_v3_factory.json"},
+		},
+	}
+	chain := &Chain{ID: big.NewInt(1007)}
+	assert.Nil(t, chain.LoadABIs(p, ".."))
+	assert.Nil(t, chain.registerFactories(p, ".."))
+
+	a, err := ReadABI("../abis/uniswap_v3_factory.json")
+	assert.Nil(t, err)
+	created := a.Events["PoolCreated"]
+	pool := common.HexToAddress("0x00000000000000000000000000000000000b0a11")
+	data, err := created.Inputs.NonIndexed().Pack(big.NewInt(60), pool)
+	assert.Nil(t, err)
+	node := &logsNode{logs: []types.Log{
+		{Address: factory, Topics: []common.Hash{created.ID, common.HexToHash("0xa0"), common.HexToHash("0xa1"), common.BigToHash(big.NewInt(3000))}, Data: data, BlockNumber: 20, TxHash: common.HexToHash("0x01")},
+		{Address: pool, BlockNumber: 20, Index: 1, TxHash: common.HexToHash("0x01")},
+		{Address: pool, BlockNumber: 30, TxHash: common.HexToHash("0x02")},
+	}}
+
+	// the logs of the pool are delivered after the pass of the factory
+	var seen []types.Log
+	passes := 0
+	err = FilterPoolsRange(context.Background(), node, chain, []common.Address{factory}, 10, 40, func(l types.Log) error {
+		seen = append(seen, l)
+		return nil
+	}, func() { passes++ })
+	assert.Nil(t, err)
+	assert.Equal(t, 2, passes)
+	if assert.Len(t, seen, 3) {
+		assert.Equal(t, factory, seen[0].Address)
+		assert.Equal(t, uint64(20), seen[1].BlockNumber)
+		assert.Equal(t, uint64(30), seen[2].BlockNumber)
+	}
+	// from the block of its creation
+	last := node.queries[len(node.queries)-1]
+	assert.Equal(t, []common.Address{pool}, last.Addresses)
+	assert.Equal(t, uint64(20), last.FromBlock.Uint64())
+}
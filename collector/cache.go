@@ -2,44 +2,75 @@ package collector
 
 import (
 	"strings"
-	"sync"
+	"time"
 )
 
-var (
-	addressCache map[string]string
-	addressType  map[string]string
-	addressM     sync.RWMutex
-)
+// UnclassifiedTTL how long an address that the node could not classify stays
+// a generic address before it is classified again
+const UnclassifiedTTL = 10 * time.Minute
+
+func (c *Chain) cachePush(key, value, typ string) {
+	s := c.state()
+	s.addressM.Lock()
+	defer s.addressM.Unlock()
 
-func init() {
-	addressCache = make(map[string]string)
-	addressType = make(map[string]string)
+	k := strings.ToLower(strings.TrimSpace(key))
+	s.addressCache[k] = value
+	// the generic address type is the default
+	if typ != "" && typ != TypeAddress {
+		s.addressType[k] = typ
+	}
 }
 
-func cachePush(key, value, typ string) {
-	addressM.Lock()
-	defer addressM.Unlock()
+func (c *Chain) cacheDelete(key string) {
+	s := c.state()
+	s.addressM.Lock()
+	defer s.addressM.Unlock()
 
 	k := strings.ToLower(strings.TrimSpace(key))
-	addressCache[k] = value
-	// only cache the type defiProtocol
-	if typ == TypeDefiProtocol {
-		addressType[k] = typ
-	}
+	delete(s.addressCache, k)
+	delete(s.addressType, k)
 }
 
-func cacheGet(key string) (v string, t string, found bool) {
-	addressM.RLock()
-	defer addressM.RUnlock()
+func (c *Chain) cacheGet(key string) (v string, t string, found bool) {
+	s := c.state()
+	s.addressM.RLock()
+	defer s.addressM.RUnlock()
 
 	k := strings.ToLower(strings.TrimSpace(key))
-	v, found = addressCache[k]
+	v, found = s.addressCache[k]
 	if !found {
 		return
 	}
 	t = TypeAddress
-	if typ, hasT := addressType[k]; hasT {
+	if typ, hasT := s.addressType[k]; hasT {
 		t = typ
 	}
 	return
 }
+
+// cacheUnclassified remember that the node could not classify an address,
+// seen is true if it could not before either
+func (c *Chain) cacheUnclassified(key string) (seen bool) {
+	s := c.state()
+	s.addressM.Lock()
+	defer s.addressM.Unlock()
+
+	k := strings.ToLower(strings.TrimSpace(key))
+	_, seen = s.unclassified[k]
+	s.unclassified[k] = time.Now()
+	return
+}
+
+// getUnclassified tell if the node could not classify an address, recent is
+// true if it has been tried in the last UnclassifiedTTL
+func (c *Chain) getUnclassified(key string) (recent, seen bool) {
+	s := c.state()
+	s.addressM.RLock()
+	defer s.addressM.RUnlock()
+
+	k := strings.ToLower(strings.TrimSpace(key))
+	tried, seen := s.unclassified[k]
+	recent = seen && time.Since(tried) < UnclassifiedTTL
+	return
+}
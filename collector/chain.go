@@ -0,0 +1,189 @@
+package collector
+
+import (
+	"fmt"
+	"math/big"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/ethereum/go-ethereum/accounts/abi"
+	"github.com/ethereum/go-ethereum/common"
+)
+
+// DefaultExplorer the block explorer of mainnet
+const DefaultExplorer = "https://etherscan.io"
+
+// Mainnet the chain of the scans and of Ocean, the nil chain shares its
+// state
+var Mainnet = &Chain{ID: big.NewInt(1), Network: "mainnet"}
+
+// Chain the chain a collector follows
+type Chain struct {
+	ID       *big.Int
+	Network  string
+	Explorer string
+	// Confirmations the blocks a log waits before it is processed
+	Confirmations uint64
+}
+
+// chainState what the collector knows about the addresses of a chain: the
+// protocols, their abis, attributions, events and pools, and the blocks
+type chainState struct {
+	addressCache map[string]string
+	addressType  map[string]string
+	// unclassified when the addresses that the node could not classify
+	// were last tried
+	unclassified map[string]time.Time
+	addressM     sync.RWMutex
+
+	contractABIs map[string]*abi.ABI
+	contractABIM sync.RWMutex
+
+	attributions  map[string]string
+	attributionsM sync.RWMutex
+
+	// eventTopics the topics of the events followed for an address, all
+	// the events are followed for the addresses that are not there
+	eventTopics  map[string][]common.Hash
+	eventTopicsM sync.RWMutex
+
+	factories map[string]*factory
+	// pools the factory of the registered pools
+	pools      map[string]string
+	factoriesM sync.RWMutex
+
+	cache *ChainCache
+
+	// postedTxs the txs posted in the reorg window, when there is no store
+	postedTxs      map[common.Hash]postedTx
+	postedTxsBlock uint64
+	postedTxsM     sync.Mutex
+}
+
+var (
+	// chainStates the state of the chains, by chain id
+	chainStates  = make(map[string]*chainState)
+	chainStatesM sync.Mutex
+)
+
+// key the id of the chain, a nil chain is mainnet
+func (c *Chain) key() string {
+	if c == nil || c.ID == nil {
+		return "1"
+	}
+	return c.ID.String()
+}
+
+// state the state of the chain, the chains with the same id share it
+func (c *Chain) state() *chainState {
+	chainStatesM.Lock()
+	defer chainStatesM.Unlock()
+	s, found := chainStates[c.key()]
+	if !found {
+		s = &chainState{
+			addressCache: make(map[string]string),
+			addressType:  make(map[string]string),
+			unclassified: make(map[string]time.Time),
+			contractABIs: make(map[string]*abi.ABI),
+			attributions: make(map[string]string),
+			eventTopics:  make(map[string][]common.Hash),
+			factories:    make(map[string]*factory),
+			pools:        make(map[string]string),
+			cache:        NewChainCache(HeaderCacheSize, ReceiptCacheSize),
+			postedTxs:    make(map[common.Hash]postedTx),
+		}
+		chainStates[c.key()] = s
+	}
+	return s
+}
+
+// snapshot a copy of the protocols state of the chain
+func (c *Chain) snapshot() *chainState {
+	s := c.state()
+	s.addressM.RLock()
+	s.contractABIM.RLock()
+	s.attributionsM.RLock()
+	s.eventTopicsM.RLock()
+	s.factoriesM.RLock()
+	defer s.addressM.RUnlock()
+	defer s.contractABIM.RUnlock()
+	defer s.attributionsM.RUnlock()
+	defer s.eventTopicsM.RUnlock()
+	defer s.factoriesM.RUnlock()
+	return &chainState{
+		addressCache: copyMap(s.addressCache),
+		addressType:  copyMap(s.addressType),
+		contractABIs: copyMap(s.contractABIs),
+		attributions: copyMap(s.attributions),
+		eventTopics:  copyMap(s.eventTopics),
+		factories:    copyMap(s.factories),
+		pools:        copyMap(s.pools),
+	}
+}
+
+// restore set the protocols state of the chain back to a snapshot
+func (c *Chain) restore(snapshot *chainState) {
+	s := c.state()
+	s.addressM.Lock()
+	s.contractABIM.Lock()
+	s.attributionsM.Lock()
+	s.eventTopicsM.Lock()
+	s.factoriesM.Lock()
+	defer s.addressM.Unlock()
+	defer s.contractABIM.Unlock()
+	defer s.attributionsM.Unlock()
+	defer s.eventTopicsM.Unlock()
+	defer s.factoriesM.Unlock()
+	s.addressCache, s.addressType = snapshot.addressCache, snapshot.addressType
+	s.contractABIs = snapshot.contractABIs
+	s.attributions = snapshot.attributions
+	s.eventTopics = snapshot.eventTopics
+	s.factories, s.pools = snapshot.factories, snapshot.pools
+}
+
+// copyMap a shallow copy of a map
+func copyMap[K comparable, V any](m map[K]V) map[K]V {
+	c := make(map[K]V, len(m))
+	for k, v := range m {
+		c[k] = v
+	}
+	return c
+}
+
+// Tag add the chainId and network properties to the entities and the
+// relationships of the changeset
+func (c *Chain) Tag(cs *TrustAPIChangeSet) {
+	if c == nil || cs == nil {
+		return
+	}
+	cs.chain = c
+	for _, e := range cs.Entities {
+		if e.Properties == nil {
+			e.Properties = make(map[string]interface{})
+		}
+		c.tag(e.Properties)
+	}
+	for _, r := range cs.Relationship {
+		if r.Properties == nil {
+			r.Properties = make(map[string]interface{})
+		}
+		c.tag(r.Properties)
+	}
+}
+
+func (c *Chain) tag(props map[string]interface{}) {
+	if c.ID != nil {
+		props["chainId"] = c.ID.Uint64()
+	}
+	props["network"] = c.Network
+}
+
+// Link the explorer page of a tx, address or block
+func (c *Chain) Link(kind string, value interface{}) string {
+	explorer := DefaultExplorer
+	if c != nil && c.Explorer != "" {
+		explorer = strings.TrimSuffix(c.Explorer, "/")
+	}
+	return fmt.Sprintf("%s/%s/%v", explorer, kind, value)
+}
@@ -0,0 +1,35 @@
+package collector
+
+import (
+	"math/big"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestChainTag(t *testing.T) {
+	e := NewTrustEntity("user")
+	e.Properties = nil
+	cs := NewChangeset(e)
+	cs.AddRel(NewTrustRelationship())
+
+	chain := &Chain{ID: big.NewInt(137), Network: "polygon"}
+	chain.Tag(cs)
+	assert.Equal(t, uint64(137), cs.Entities[0].Properties["chainId"])
+	assert.Equal(t, "polygon", cs.Entities[0].Properties["network"])
+	assert.Equal(t, uint64(137), cs.Relationship[0].Properties["chainId"])
+	assert.Equal(t, "polygon", cs.Relationship[0].Properties["network"])
+
+	// a nil chain leaves the changeset as it is
+	cs = NewChangeset(NewTrustEntity("user"))
+	var none *Chain
+	none.Tag(cs)
+	assert.Empty(t, cs.Entities[0].Properties)
+}
+
+func TestChainLink(t *testing.T) {
+	var mainnet *Chain
+	assert.Equal(t, "https://etherscan.io/tx/0x01", mainnet.Link("tx", "0x01"))
+	polygon := &Chain{Explorer: "https://polygonscan.com/"}
+	assert.Equal(t, "https://polygonscan.com/block/10", polygon.Link("block", 10))
+}
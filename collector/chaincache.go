@@ -0,0 +1,122 @@
+package collector
+
+import (
+	"context"
+	"math/big"
+
+	"github.com/ethereum/go-ethereum"
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/core/types"
+	lru "github.com/hashicorp/golang-lru"
+	"golang.org/x/sync/singleflight"
+)
+
+// sizes of the chain cache
+const (
+	HeaderCacheSize  = 1024
+	ReceiptCacheSize = 4096
+)
+
+// HeaderReader the node api used to read the block headers
+type HeaderReader interface {
+	HeaderByNumber(ctx context.Context, number *big.Int) (*types.Header, error)
+	HeaderByHash(ctx context.Context, hash common.Hash) (*types.Header, error)
+}
+
+// TransactionReader the node api used to read the txs
+type TransactionReader interface {
+	TransactionByHash(ctx context.Context, hash common.Hash) (tx *types.Transaction, isPending bool, err error)
+}
+
+// ReceiptReader the node api used to read the tx receipts
+type ReceiptReader interface {
+	TransactionReceipt(ctx context.Context, txHash common.Hash) (*types.Receipt, error)
+}
+
+// ChainCache an lru cache of the block headers, the txs and their receipts,
+// so that the logs of the same block or tx fetch them once. Every chain has
+// its own.
+type ChainCache struct {
+	headers  *lru.Cache
+	receipts *lru.Cache
+	txs      *lru.Cache
+	// concurrent misses for the same key make a single request
+	group singleflight.Group
+}
+
+// NewChainCache create a cache with room for the given number of headers
+// and receipts, and as many txs as receipts, a size of 0 disables the caching
+func NewChainCache(headers, receipts int) *ChainCache {
+	c := new(ChainCache)
+	if headers > 0 {
+		c.headers, _ = lru.New(headers)
+	}
+	if receipts > 0 {
+		c.receipts, _ = lru.New(receipts)
+		c.txs, _ = lru.New(receipts)
+	}
+	return c
+}
+
+// Header get the header of a block, it is read by number, that is cheaper
+// for the node, and by hash if the block at that number has been reorganized
+func (c *ChainCache) Header(ctx context.Context, client HeaderReader, number uint64, hash common.Hash) (header *types.Header, err error) {
+	v, err := c.get(c.headers, "header:"+hash.Hex(), func() (interface{}, error) {
+		h, err := client.HeaderByNumber(ctx, new(big.Int).SetUint64(number))
+		if err == nil && h.Hash() == hash {
+			return h, nil
+		}
+		return client.HeaderByHash(ctx, hash)
+	})
+	if err != nil {
+		return
+	}
+	header = v.(*types.Header)
+	return
+}
+
+// Receipt get the receipt of a tx
+func (c *ChainCache) Receipt(ctx context.Context, client ReceiptReader, txHash common.Hash) (receipt *types.Receipt, err error) {
+	v, err := c.get(c.receipts, "receipt:"+txHash.Hex(), func() (interface{}, error) {
+		return client.TransactionReceipt(ctx, txHash)
+	})
+	if err != nil {
+		return
+	}
+	receipt = v.(*types.Receipt)
+	return
+}
+
+// Transaction get a mined tx, a pending tx is ethereum.NotFound
+func (c *ChainCache) Transaction(ctx context.Context, client TransactionReader, txHash common.Hash) (tx *types.Transaction, err error) {
+	v, err := c.get(c.txs, "tx:"+txHash.Hex(), func() (interface{}, error) {
+		tx, isPending, err := client.TransactionByHash(ctx, txHash)
+		if err == nil && isPending {
+			err = ethereum.NotFound
+		}
+		return tx, err
+	})
+	if err != nil {
+		return
+	}
+	tx = v.(*types.Transaction)
+	return
+}
+
+// get read a value from the cache or fetch it, errors are not cached
+func (c *ChainCache) get(cache *lru.Cache, key string, fetch func() (interface{}, error)) (v interface{}, err error) {
+	if cache == nil {
+		return fetch()
+	}
+	if v, found := cache.Get(key); found {
+		return v, nil
+	}
+	v, err, _ = c.group.Do(key, func() (interface{}, error) {
+		v, err := fetch()
+		if err == nil {
+			cache.Add(key, v)
+		}
+		return v, err
+	})
+	return
+}
@@ -0,0 +1,176 @@
+package collector
+
+import (
+	"context"
+	"errors"
+	"math/big"
+	"sync"
+	"testing"
+
+	"github.com/ethereum/go-ethereum"
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/core/types"
+	"github.com/stretchr/testify/assert"
+)
+
+// countingNode a node that counts the calls made to it
+type countingNode struct {
+	m     sync.Mutex
+	calls map[string]int
+}
+
+func newCountingNode() *countingNode {
+	return &countingNode{calls: make(map[string]int)}
+}
+
+func (n *countingNode) count(method string) {
+	n.m.Lock()
+	defer n.m.Unlock()
+	n.calls[method]++
+}
+
+func (n *countingNode) total() (total int) {
+	n.m.Lock()
+	defer n.m.Unlock()
+	for _, c := range n.calls {
+		total += c
+	}
+	return
+}
+
+// testHeader the header of a block of the counting node
+func testHeader(number uint64) *types.Header {
+	return &types.Header{Number: new(big.Int).SetUint64(number), Time: 1600000000 + number*13}
+}
+
+func (n *countingNode) FilterLogs(ctx context.Context, q ethereum.FilterQuery) ([]types.Log, error) {
+	n.count("eth_getLogs")
+	return nil, nil
+}
+
+func (n *countingNode) SubscribeFilterLogs(ctx context.Context, q ethereum.FilterQuery, ch chan<- types.Log) (ethereum.Subscription, error) {
+	return nil, ethereum.NotFound
+}
+
+func (n *countingNode) CallContract(ctx context.Context, call ethereum.CallMsg, blockNumber *big.Int) ([]byte, error) {
+	n.count("eth_call")
+	return nil, errors.New("execution reverted")
+}
+
+func (n *countingNode) CodeAt(ctx context.Context, account common.Address, blockNumber *big.Int) ([]byte, error) {
+	n.count("eth_getCode")
+	return nil, nil
+}
+
+func (n *countingNode) StorageAt(ctx context.Context, account common.Address, key common.Hash, blockNumber *big.Int) ([]byte, error) {
+	n.count("eth_getStorageAt")
+	return make([]byte, 32), nil
+}
+
+func (n *countingNode) HeaderByNumber(ctx context.Context, number *big.Int) (*types.Header, error) {
+	n.count("eth_getBlockByNumber")
+	return testHeader(number.Uint64()), nil
+}
+
+func (n *countingNode) HeaderByHash(ctx context.Context, hash common.Hash) (*types.Header, error) {
+	n.count("eth_getBlockByHash")
+	return nil, ethereum.NotFound
+}
+
+func (n *countingNode) TransactionByHash(ctx context.Context, hash common.Hash) (*types.Transaction, bool, error) {
+	n.count("eth_getTransactionByHash")
+	return nil, false, ethereum.NotFound
+}
+
+func (n *countingNode) TransactionReceipt(ctx context.Context, txHash common.Hash) (*types.Receipt, error) {
+	n.count("eth_getTransactionReceipt")
+	return &types.Receipt{TxHash: txHash, Status: types.ReceiptStatusSuccessful}, nil
+}
+
+// busyPoolLogs the transfer logs of a busy pool: blocks with txs with
+// several logs each
+func busyPoolLogs(blocks, txsPerBlock, logsPerTx int) (logs []types.Log) {
+	pool := common.HexToAddress("0x88e6a0c2ddd26feeb64f039a2c41296fcb3f5640")
+	transfer := common.HexToHash("0xddf252ad1be2c89b69c2b068fc378daa952ba7f163c4a11628f55a4df523b3ef")
+	for b := 1; b <= blocks; b++ {
+		header := testHeader(uint64(b))
+		for t := 0; t < txsPerBlock; t++ {
+			txHash := common.BigToHash(big.NewInt(int64(b*1000 + t)))
+			for i := 0; i < logsPerTx; i++ {
+				logs = append(logs, types.Log{
+					Address: pool,
+					Topics: []common.Hash{
+						transfer,
+						common.BigToHash(big.NewInt(int64(0xa0 + i))),
+						common.BigToHash(big.NewInt(int64(0xb0 + i))),
+					},
+					Data:        common.BigToHash(big.NewInt(int64(1000 + i))).Bytes(),
+					BlockNumber: uint64(b),
+					BlockHash:   header.Hash(),
+					TxHash:      txHash,
+					Index:       uint(t*logsPerTx + i),
+				})
+			}
+		}
+	}
+	return
+}
+
+func TestChainCache(t *testing.T) {
+	node := newCountingNode()
+	c := NewChainCache(10, 10)
+	ctx := context.Background()
+
+	h := testHeader(5)
+	for i := 0; i < 3; i++ {
+		header, err := c.Header(ctx, node, 5, h.Hash())
+		assert.Nil(t, err)
+		assert.Equal(t, h.Time, header.Time)
+		receipt, err := c.Receipt(ctx, node, common.HexToHash("0x01"))
+		assert.Nil(t, err)
+		assert.Equal(t, common.HexToHash("0x01"), receipt.TxHash)
+	}
+	assert.Equal(t, 1, node.calls["eth_getBlockByNumber"])
+	assert.Equal(t, 1, node.calls["eth_getTransactionReceipt"])
+
+	// a block replaced by a reorg is read by hash, the errors are not cached
+	_, err := c.Header(ctx, node, 5, common.HexToHash("0x02"))
+	assert.Equal(t, ethereum.NotFound, err)
+	_, err = c.Header(ctx, node, 5, common.HexToHash("0x02"))
+	assert.Equal(t, ethereum.NotFound, err)
+	assert.Equal(t, 2, node.calls["eth_getBlockByHash"])
+
+	// a disabled cache always calls the node
+	c = NewChainCache(0, 0)
+	c.Header(ctx, node, 5, h.Hash())
+	c.Header(ctx, node, 5, h.Hash())
+	assert.Equal(t, 5, node.calls["eth_getBlockByNumber"])
+}
+
+// BenchmarkParseLog report the node calls made for each log of a busy pool,
+// with and without the chain cache
+func BenchmarkParseLog(b *testing.B) {
+	logs := busyPoolLogs(10, 5, 4)
+	Mainnet.cachePush(logs[0].Address.Hex(), logs[0].Address.Hex(), TypeDefiProtocol)
+	state := Mainnet.state()
+	defer func(c *ChainCache) { state.cache = c }(state.cache)
+
+	for name, sizes := range map[string][2]int{
+		"uncached": {0, 0},
+		"cached":   {HeaderCacheSize, ReceiptCacheSize},
+	} {
+		b.Run(name, func(b *testing.B) {
+			node := newCountingNode()
+			for i := 0; i < b.N; i++ {
+				// every run starts from an empty cache
+				state.cache = NewChainCache(sizes[0], sizes[1])
+				for j := range logs {
+					if _, err := ParseLog(&logs[j], node); err != nil {
+						b.Fatal(err)
+					}
+				}
+			}
+			b.ReportMetric(float64(node.total())/float64(b.N*len(logs)), "rpc/log")
+		})
+	}
+}
@@ -0,0 +1,172 @@
+package collector
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"math/big"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/ethereum/go-ethereum/common"
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	checkpointsBucket = "checkpoints"
+)
+
+// CheckpointKey identify the checkpoint of a chain and a set of monitored
+// contracts, changing the protocols starts a new checkpoint
+func CheckpointKey(chainID *big.Int, filters []common.Address) string {
+	addresses := make([]string, len(filters))
+	for i, a := range filters {
+		addresses[i] = strings.ToLower(a.Hex())
+	}
+	sort.Strings(addresses)
+	h := sha256.Sum256([]byte(strings.Join(addresses, ",")))
+	return fmt.Sprintf("%s:%s", chainID, hex.EncodeToString(h[:8]))
+}
+
+// lastCheckpointKey the key of the checkpoint of the last set of contracts
+// monitored on a chain
+func lastCheckpointKey(key string) string {
+	return strings.SplitN(key, ":", 2)[0]
+}
+
+// Checkpoint the last block whose logs have all been posted
+type Checkpoint struct {
+	Key   string
+	Block uint64
+	// Resumed the checkpoint has been resumed from the one of a previous
+	// set of contracts
+	Resumed bool
+	store   *Store
+	// pending the logs of each block that have not been posted yet
+	pending map[uint64]int
+	// reached the last block whose logs have all been processed
+	reached uint64
+	// progress the block up to which the source has delivered every log
+	progress uint64
+	m        sync.Mutex
+}
+
+// NewCheckpoint load the checkpoint for the key from the store, the store
+// can be nil, in that case the checkpoint is not persisted. A new set of
+// contracts of a chain resumes from the checkpoint of the previous set, so
+// the contracts that were monitored miss no log and the new ones are caught
+// up from the same block.
+func NewCheckpoint(store *Store, key string) (c *Checkpoint, err error) {
+	c = &Checkpoint{Key: key, store: store, pending: make(map[uint64]int)}
+	if store == nil {
+		return
+	}
+	found, err := store.Get(checkpointsBucket, key, &c.Block)
+	if err != nil || found {
+		return
+	}
+	if last := lastCheckpointKey(key); last != key {
+		c.Resumed, err = store.Get(checkpointsBucket, last, &c.Block)
+	}
+	return
+}
+
+// Move the checkpoint to a new key, e.g. when the protocols change, it
+// starts from the current block
+func (c *Checkpoint) Move(key string) {
+	c.m.Lock()
+	defer c.m.Unlock()
+	if key == c.Key {
+		return
+	}
+	c.Key = key
+	c.persist()
+}
+
+// Save move the checkpoint forward to block, it never goes back
+func (c *Checkpoint) Save(block uint64) {
+	c.m.Lock()
+	defer c.m.Unlock()
+	c.save(block)
+}
+
+// save move the checkpoint, the caller holds the lock
+func (c *Checkpoint) save(block uint64) {
+	if block <= c.Block {
+		return
+	}
+	c.Block = block
+	c.persist()
+}
+
+// persist save the block under the key and as the last checkpoint of the
+// chain, the caller holds the lock
+func (c *Checkpoint) persist() {
+	if c.store == nil || c.Block == 0 {
+		return
+	}
+	for _, key := range []string{c.Key, lastCheckpointKey(c.Key)} {
+		if err := c.store.Put(checkpointsBucket, key, c.Block); err != nil {
+			log.Errorf("cannot save checkpoint %s at block %d: %v", key, c.Block, err)
+		}
+	}
+}
+
+// Begin count a log being processed, the checkpoint does not pass the block
+// before the log is Done
+func (c *Checkpoint) Begin(block uint64) {
+	c.m.Lock()
+	defer c.m.Unlock()
+	c.pending[block]++
+}
+
+// Done a log counted by Begin has been posted
+func (c *Checkpoint) Done(block uint64) {
+	c.m.Lock()
+	defer c.m.Unlock()
+	if c.pending[block]--; c.pending[block] <= 0 {
+		delete(c.pending, block)
+	}
+	c.advance()
+}
+
+// Progress the source has delivered every log up to block, e.g. the head of
+// a quiet chain, or the slowest of the shards whose logs are not in order.
+// It goes back when the source starts again from an earlier block.
+func (c *Checkpoint) Progress(block uint64) {
+	c.m.Lock()
+	defer c.m.Unlock()
+	c.progress = block
+	c.advance()
+}
+
+// Reach all the logs up to block have been processed, the checkpoint moves
+// there once they are posted. It never passes the progress of the source, so
+// a log that is late is not skipped.
+func (c *Checkpoint) Reach(block uint64) {
+	c.m.Lock()
+	defer c.m.Unlock()
+	if block > c.reached {
+		c.reached = block
+	}
+	c.advance()
+}
+
+// advance save the last reached block that has been delivered, before the
+// pending logs, the caller holds the lock
+func (c *Checkpoint) advance() {
+	block := c.reached
+	if block > c.progress {
+		block = c.progress
+	}
+	for n := range c.pending {
+		if n <= block {
+			if n == 0 {
+				return
+			}
+			block = n - 1
+		}
+	}
+	c.save(block)
+}
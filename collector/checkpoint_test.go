@@ -0,0 +1,108 @@
+package collector
+
+import (
+	"math/big"
+	"testing"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCheckpoint(t *testing.T) {
+	a := common.HexToAddress("0x00000000000000000000000000000000000000aa")
+	b := common.HexToAddress("0x00000000000000000000000000000000000000bb")
+	key := CheckpointKey(big.NewInt(1), []common.Address{a, b})
+	assert.Equal(t, key, CheckpointKey(big.NewInt(1), []common.Address{b, a}))
+	assert.NotEqual(t, key, CheckpointKey(big.NewInt(137), []common.Address{a, b}))
+	assert.NotEqual(t, key, CheckpointKey(big.NewInt(1), []common.Address{a}))
+
+	dir := t.TempDir()
+	s, err := OpenStore(dir)
+	assert.Nil(t, err)
+	c, err := NewCheckpoint(s, key)
+	assert.Nil(t, err)
+	assert.Equal(t, uint64(0), c.Block)
+	assert.False(t, c.Resumed)
+	c.Save(100)
+	c.Save(90)
+	assert.Equal(t, uint64(100), c.Block)
+	s.Close()
+
+	// the checkpoint survives a restart
+	s, err = OpenStore(dir)
+	assert.Nil(t, err)
+	defer s.Close()
+	c, err = NewCheckpoint(s, key)
+	assert.Nil(t, err)
+	assert.Equal(t, uint64(100), c.Block)
+	assert.False(t, c.Resumed)
+
+	// a new set of protocols of the chain resumes from the last checkpoint
+	added := CheckpointKey(big.NewInt(1), []common.Address{a})
+	c, err = NewCheckpoint(s, added)
+	assert.Nil(t, err)
+	assert.Equal(t, uint64(100), c.Block)
+	assert.True(t, c.Resumed)
+	c, err = NewCheckpoint(s, CheckpointKey(big.NewInt(137), []common.Address{a}))
+	assert.Nil(t, err)
+	assert.Equal(t, uint64(0), c.Block)
+
+	// the checkpoint moved to the new protocols keeps its block
+	c, err = NewCheckpoint(s, key)
+	assert.Nil(t, err)
+	c.Move(added)
+	c.Save(120)
+	c, err = NewCheckpoint(s, added)
+	assert.Nil(t, err)
+	assert.Equal(t, uint64(120), c.Block)
+	assert.False(t, c.Resumed)
+	c, err = NewCheckpoint(s, key)
+	assert.Nil(t, err)
+	assert.Equal(t, uint64(100), c.Block)
+}
+
+func TestCheckpointPosted(t *testing.T) {
+	c, err := NewCheckpoint(nil, CheckpointKey(big.NewInt(1), nil))
+	assert.Nil(t, err)
+
+	// the processed blocks wait for their logs to be posted
+	c.Progress(12)
+	c.Begin(10)
+	c.Begin(10)
+	c.Begin(12)
+	c.Reach(12)
+	assert.Equal(t, uint64(9), c.Block)
+	c.Done(12)
+	assert.Equal(t, uint64(9), c.Block)
+	c.Done(10)
+	c.Done(10)
+	assert.Equal(t, uint64(12), c.Block)
+
+	// a block is passed only once it is reached
+	c.Progress(15)
+	c.Begin(15)
+	c.Done(15)
+	assert.Equal(t, uint64(12), c.Block)
+	c.Reach(15)
+	assert.Equal(t, uint64(15), c.Block)
+
+	// the heads do not pass the progress of the source
+	c.Reach(30)
+	assert.Equal(t, uint64(15), c.Block)
+	c.Progress(19)
+	c.Reach(30)
+	assert.Equal(t, uint64(19), c.Block)
+
+	// on a quiet chain the progress of the source moves it
+	c.Reach(40)
+	assert.Equal(t, uint64(19), c.Block)
+	c.Progress(40)
+	assert.Equal(t, uint64(40), c.Block)
+	// a source started again from an earlier block holds it, it never goes
+	// back
+	c.Progress(35)
+	c.Reach(50)
+	assert.Equal(t, uint64(40), c.Block)
+	c.Progress(50)
+	assert.Equal(t, uint64(50), c.Block)
+}
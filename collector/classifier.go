@@ -0,0 +1,69 @@
+package collector
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"math/big"
+
+	"github.com/ethereum/go-ethereum/common"
+)
+
+// CodeReader the node api used to classify the addresses
+type CodeReader interface {
+	CodeAt(ctx context.Context, account common.Address, blockNumber *big.Int) ([]byte, error)
+	StorageAt(ctx context.Context, account common.Address, key common.Hash, blockNumber *big.Int) ([]byte, error)
+}
+
+// the storage slots of the EIP-1967 proxies
+var (
+	// bytes32(uint256(keccak256('eip1967.proxy.implementation')) - 1)
+	eip1967ImplementationSlot = common.HexToHash("0x360894a13ba1a3210667c828492db98dca3e2076cc3735a920a3ca505d382bbc")
+	// bytes32(uint256(keccak256('eip1967.proxy.beacon')) - 1)
+	eip1967BeaconSlot = common.HexToHash("0xa3f0ad74e5423aebfd80d3ef4346578335a9a72aeaee59ff6cb3582b35133d50")
+)
+
+// gnosisSafeProxyCode the start of the runtime code of the Gnosis Safe
+// proxies: the master copy is read from slot 0 and returned by masterCopy()
+var gnosisSafeProxyCode = common.FromHex("0x608060405273ffffffffffffffffffffffffffffffffffffffff600054167fa619486e")
+
+// Classify tell the type of an address from its code: an account without code
+// is an EOA, a Gnosis Safe is a SmartWallet, a contract that stores its
+// implementation in the EIP-1967 slots is a Proxy, the others are Contract
+func Classify(ctx context.Context, client CodeReader, address common.Address) (typ string, err error) {
+	code, err := client.CodeAt(ctx, address, nil)
+	if err != nil {
+		return
+	}
+	if len(code) == 0 {
+		return TypeEOA, nil
+	}
+	if bytes.HasPrefix(code, gnosisSafeProxyCode) {
+		return TypeSmartWallet, nil
+	}
+	for _, slot := range []common.Hash{eip1967ImplementationSlot, eip1967BeaconSlot} {
+		var v []byte
+		if v, err = client.StorageAt(ctx, address, slot, nil); err != nil {
+			return
+		}
+		if common.BytesToHash(v) != (common.Hash{}) {
+			return TypeProxy, nil
+		}
+	}
+	return TypeContract, nil
+}
+
+// classify the type of an address seen for the first time, without a client
+// it is a generic address, the error is set when the node cannot tell
+func classify(client CodeReader, address Address) (typ string, err error) {
+	typ = TypeAddress
+	if client == nil || !common.IsHexAddress(string(address)) {
+		return
+	}
+	t, err := Classify(context.Background(), client, common.HexToAddress(string(address)))
+	if err != nil {
+		err = fmt.Errorf("cannot classify address %s: %v", address, err)
+		return
+	}
+	return t, nil
+}
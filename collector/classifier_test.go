@@ -0,0 +1,101 @@
+package collector
+
+import (
+	"context"
+	"errors"
+	"math/big"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/stretchr/testify/assert"
+)
+
+// fakeCode answers eth_getCode and eth_getStorageAt
+type fakeCode struct {
+	code    map[common.Address][]byte
+	storage map[common.Address]map[common.Hash]common.Hash
+	calls   int
+	err     error
+}
+
+func (f *fakeCode) CodeAt(ctx context.Context, account common.Address, blockNumber *big.Int) ([]byte, error) {
+	f.calls++
+	return f.code[account], f.err
+}
+
+func (f *fakeCode) StorageAt(ctx context.Context, account common.Address, key common.Hash, blockNumber *big.Int) ([]byte, error) {
+	return f.storage[account][key].Bytes(), nil
+}
+
+func TestClassify(t *testing.T) {
+	eoa := common.HexToAddress("0x00000000000000000000000000000000000e0a01")
+	contract := common.HexToAddress("0x00000000000000000000000000000000000c0a01")
+	proxy := common.HexToAddress("0x00000000000000000000000000000000000c0a02")
+	beacon := common.HexToAddress("0x00000000000000000000000000000000000c0a03")
+	safe := common.HexToAddress("0x00000000000000000000000000000000000c0a04")
+	node := &fakeCode{
+		code: map[common.Address][]byte{
+			contract: common.FromHex("0x6080604052"),
+			proxy:    common.FromHex("0x6080604052"),
+			beacon:   common.FromHex("0x6080604052"),
+			safe:     append(common.CopyBytes(gnosisSafeProxyCode), 0x00, 0x00),
+		},
+		storage: map[common.Address]map[common.Hash]common.Hash{
+			proxy:  {eip1967ImplementationSlot: common.HexToHash("0x01")},
+			beacon: {eip1967BeaconSlot: common.HexToHash("0x02")},
+		},
+	}
+	ctx := context.Background()
+	for address, typ := range map[common.Address]string{
+		eoa:      TypeEOA,
+		contract: TypeContract,
+		proxy:    TypeProxy,
+		beacon:   TypeProxy,
+		safe:     TypeSmartWallet,
+	} {
+		got, err := Classify(ctx, node, address)
+		assert.Nil(t, err)
+		assert.Equal(t, typ, got, address.Hex())
+	}
+
+	// the type of a new address is cached
+	node.calls = 0
+	e, isNew := Mainnet.criteria(NewAddressFromString(proxy.Hex()), node)
+	assert.True(t, isNew)
+	assert.Equal(t, TypeProxy, e.Type)
+	e, isNew = Mainnet.criteria(NewAddressFromString(proxy.Hex()), node)
+	assert.False(t, isNew)
+	assert.Equal(t, TypeProxy, e.Type)
+	assert.Equal(t, 1, node.calls)
+
+	// without an answer from the node it is a generic address, new once
+	down := NewAddressFromString("0x00000000000000000000000000000000000e0a02")
+	failing := &fakeCode{err: errors.New("node down")}
+	e, isNew = Mainnet.criteria(down, failing)
+	assert.True(t, isNew)
+	assert.Equal(t, TypeAddress, e.Type)
+	e, isNew = Mainnet.criteria(down, failing)
+	assert.False(t, isNew)
+	assert.Equal(t, TypeAddress, e.Type)
+	assert.Equal(t, 1, failing.calls)
+
+	// classified again after the ttl, when the node is back
+	s := Mainnet.state()
+	s.addressM.Lock()
+	s.unclassified[strings.ToLower(string(down))] = time.Now().Add(-UnclassifiedTTL)
+	s.addressM.Unlock()
+	e, isNew = Mainnet.criteria(down, failing)
+	assert.False(t, isNew)
+	assert.Equal(t, TypeAddress, e.Type)
+	assert.Equal(t, 2, failing.calls)
+	s.addressM.Lock()
+	s.unclassified[strings.ToLower(string(down))] = time.Now().Add(-UnclassifiedTTL)
+	s.addressM.Unlock()
+	e, isNew = Mainnet.criteria(down, &fakeCode{code: map[common.Address][]byte{common.HexToAddress(string(down)): common.FromHex("0x6080604052")}})
+	assert.True(t, isNew)
+	assert.Equal(t, TypeContract, e.Type)
+	e, _ = Mainnet.criteria(Address(strings.ToLower(eoa.Hex())), nil)
+	assert.Equal(t, TypeAddress, e.Type)
+}
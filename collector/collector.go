@@ -4,7 +4,10 @@ import (
 	"context"
 	"encoding/json"
 	"fmt"
+	"math/big"
+	"path/filepath"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/ethereum/go-ethereum"
@@ -13,37 +16,69 @@ import (
 	"github.com/ethereum/go-ethereum/ethclient"
 	log "github.com/sirupsen/logrus"
 	"github.com/utu-crowdsale/defi-portal-scanner/config"
-	"github.com/utu-crowdsale/defi-portal-scanner/utils"
 )
 
 // some constants
 const (
 	ZeroAddress = "0x0000000000000000000000000000000000000000"
+	// ScanQueueSize how many scan jobs can wait for the address processor
+	ScanQueueSize = 100
 )
 
 var (
-	csQueue   chan *TrustAPIChangeSet
-	addrQueue chan Address
+	csQueue       chan *TrustAPIChangeSet
+	addrQueue     chan *ScanJob
+	processorDone chan struct{}
+)
+
+// ChangesetRetryDelay how long a changeset that failed to post waits before
+// it is posted again, the delay doubles at every failure up to
+// ChangesetRetryMaxDelay
+var (
+	ChangesetRetryDelay    = 5 * time.Second
+	ChangesetRetryMaxDelay = 5 * time.Minute
 )
 
 func init() {
 	csQueue = make(chan *TrustAPIChangeSet)
-	addrQueue = make(chan Address)
+	addrQueue = make(chan *ScanJob, ScanQueueSize)
+	processorDone = make(chan struct{})
 }
 
-func topic2Addr(l *types.Log, index int) string {
-	return common.BytesToAddress(l.Topics[index].Bytes()).Hex()
+// ChainClient the ethereum node api used by the collector, it is satisfied
+// by ethclient.Client and by the go-ethereum simulated backend
+type ChainClient interface {
+	ethereum.LogFilterer
+	ethereum.ContractCaller
+	HeaderReader
+	TransactionReader
+	ReceiptReader
+	CodeReader
 }
 
-func criteria(address Address) (entity *TrustEntity, isNew bool) {
+// criteria the entity of an address of the chain, the addresses seen for the
+// first time are classified with the client and cached, an address that the
+// node cannot classify is a generic address, new only the first time, and it
+// is classified again after the UnclassifiedTTL
+func (c *Chain) criteria(address Address, client CodeReader) (entity *TrustEntity, isNew bool) {
 	// cache lookup
-	label, typ, found := cacheGet(string(address))
+	label, typ, found := c.cacheGet(string(address))
 	if !found {
-		// here is a user, we store 0x123, address, address
-		typ = TypeAddress
+		// here is a user or a contract, we store 0x123, address, type
 		label = string(address)
-		cachePush(string(address), label, typ)
-		isNew = true
+		recent, seen := c.getUnclassified(label)
+		typ = TypeAddress
+		if !recent {
+			var err error
+			if typ, err = classify(client, address); err != nil {
+				log.Warn(err)
+				c.cacheUnclassified(label)
+			} else {
+				c.cachePush(string(address), label, typ)
+			}
+		}
+		// the generic address has been posted already
+		isNew = !seen || typ != TypeAddress
 	}
 	// create the entity to be used as criteria
 	entity = NewTrustEntity("")
@@ -52,125 +87,187 @@ func criteria(address Address) (entity *TrustEntity, isNew bool) {
 	return
 }
 
-// ParseLog take a log and return an Event
-func ParseLog(vLog *types.Log, client *ethclient.Client) (cs TrustAPIChangeSet, err error) {
+// ParseLog take a log of mainnet and return the changeset of its actions,
+// without any aggregation with the other logs of the tx
+func ParseLog(vLog *types.Log, client ChainClient) (cs TrustAPIChangeSet, err error) {
+	p, err := parseLog(vLog, client, nil)
+	if err != nil {
+		return
+	}
+	cs.Entities = p.entities
+	for _, a := range p.actions {
+		cs.AddRel(a.Relationship())
+	}
+	for _, r := range p.relationships {
+		cs.AddRel(r)
+	}
+	return
+}
+
+// parsedLog what a log is turned into
+type parsedLog struct {
+	actions []*Action
+	// relationships that are not interactions, e.g. the nft ownerships
+	relationships []*TrustRelationship
+	// entities seen for the first time
+	entities []*TrustEntity
+}
 
+// parseLog take a log of the chain and return the actions and relationships
+// in it
+func parseLog(vLog *types.Log, client ChainClient, chain *Chain) (p parsedLog, err error) {
+	if len(vLog.Topics) == 0 {
+		err = fmt.Errorf("skip tx %s event log: anonymous event", vLog.TxHash.Hex())
+		return
+	}
+	ctx := context.Background()
+	// token transfers are decoded by their standard
+	var transfer *TokenTransfer
+	if isTransferEvent(vLog.Topics[0]) {
+		if transfer, err = ParseTransfer(ctx, vLog, client); err != nil {
+			return
+		}
+	}
 	// action
-	action, found := eventNames[vLog.Topics[0].Hex()]
-	if !found {
-		err = fmt.Errorf("undefined name for action signature %s", vLog.Topics[0].Hex())
+	evt, found, err := chain.DecodeLog(vLog)
+	if err != nil && transfer != nil {
+		// the abi does not match the standard of the transfer
+		evt, found, err = nil, false, nil
+	}
+	if err != nil {
 		log.Error(err)
 		return
 	}
-
-	// recipient
-	_, isPending, err := client.TransactionByHash(context.Background(), vLog.TxHash)
-	if err != nil {
+	action := ""
+	if found {
+		action = evt.Name
+	} else if action, found = eventNames[vLog.Topics[0].Hex()]; !found {
+		err = fmt.Errorf("undefined name for action signature %s", vLog.Topics[0].Hex())
 		log.Error(err)
 		return
 	}
-	if isPending {
+
+	// the receipt and the header are cached, the logs of the same tx and
+	// block fetch them once
+	_, err = chain.state().cache.Receipt(ctx, client, vLog.TxHash)
+	if err == ethereum.NotFound {
 		err = fmt.Errorf("transaction %s is pending, skipped", vLog.TxHash)
 		log.Warn(err)
 		return
 	}
+	if err != nil {
+		log.Error(err)
+		return
+	}
 
 	// timestamp
-	block, err := client.BlockByHash(context.Background(), vLog.BlockHash)
+	header, err := chain.state().cache.Header(ctx, client, vLog.BlockNumber, vLog.BlockHash)
 	if err != nil {
 		log.Error(err)
 		return
 	}
+	timestamp := time.Unix(int64(header.Time), 0)
+
+	var assets []AssetAmount
+	if transfer != nil {
+		assets = transfer.Assets(ctx, vLog, client)
+		// who holds the nfts, whoever the interaction is attributed to
+		ownership(vLog, client, chain, transfer, timestamp, &p)
+	}
+
+	if chain.attributionOf(vLog.Address) == AttributionOriginator {
+		err = originatorActions(vLog, client, chain, action, timestamp, evt, transfer, assets, &p)
+		return
+	}
 
 	// now parse the types
-	var rel *TrustRelationship
-	switch action {
-	case "Transfer":
+	switch {
+	case transfer != nil:
 		// process entities
 		contractAddress := vLog.Address.Hex()
-		senderAddress := topic2Addr(vLog, 1)
-		recipientAddress := topic2Addr(vLog, 2)
+		senderAddress := transfer.From
+		recipientAddress := transfer.To
 
 		// skip 0x0 address
-		if senderAddress == ZeroAddress || recipientAddress == ZeroAddress {
-			err = fmt.Errorf("skip tx %s event log: zero-address detected", vLog.TxHash.Hex())
+		if senderAddress == strings.ToLower(ZeroAddress) || recipientAddress == strings.ToLower(ZeroAddress) {
+			if len(p.relationships) == 0 {
+				err = fmt.Errorf("skip tx %s event log: zero-address detected", vLog.TxHash.Hex())
+			}
 			return
 		}
 
 		// case sender is a defi-ptocol
-		c, _ := criteria(Address(contractAddress)) // since contractAddress comes from ethereum common libraries.Hex(), we can assume it's safe and directly cast to Address type
-		s, sIsNew := criteria(NewAddressFromString(senderAddress))
-		r, rIsNew := criteria(NewAddressFromString(recipientAddress))
+		c, _ := chain.criteria(Address(contractAddress), client) // since contractAddress comes from ethereum common libraries.Hex(), we can assume it's safe and directly cast to Address type
+		s, sIsNew := chain.criteria(NewAddressFromString(senderAddress), client)
+		r, rIsNew := chain.criteria(NewAddressFromString(recipientAddress), client)
 
-		if s.Type == r.Type {
+		// the accounts and the contracts that are not protocols are all users
+		sIsProtocol, rIsProtocol := s.Type == TypeDefiProtocol, r.Type == TypeDefiProtocol
+		if sIsProtocol == rIsProtocol {
 			// if they are both defi-portal then skip
-			if s.Type == TypeDefiProtocol {
+			if sIsProtocol {
 				err = fmt.Errorf("skip tx %s event log:  both sender and recipient are defi-protocols", vLog.TxHash.Hex())
 				return
 			}
 			// if they are both address
 			// then create 2 relationships to the contract
-			rel = NewTrustRelationship()
-			rel.Type = TypeInteraction
-			rel.Properties = map[string]interface{}{
-				"txId":      vLog.TxHash.Hex(),
-				"action":    action,
-				"timestamp": time.Unix(int64(block.Time()), 0),
-			}
-			rel.SourceCriteria = s // the sender is the source
-			rel.TargetCriteria = c
-			cs.AddRel(rel)
+			a := newLogAction(vLog, action, timestamp, evt, s, c) // the sender is the source
+			a.AssetsOut = assets
+			withTransfer(a, transfer, assets)
+			p.actions = append(p.actions, a)
 			// second one
-			rel := NewTrustRelationship()
-			rel.Type = TypeInteraction
-			rel.Properties = map[string]interface{}{
-				"txId":      vLog.TxHash.Hex(),
-				"action":    action,
-				"timestamp": time.Unix(int64(block.Time()), 0),
-			}
-			rel.SourceCriteria = r // the recipient is the source
-			rel.TargetCriteria = c
-			cs.AddRel(rel)
+			a = newLogAction(vLog, action, timestamp, evt, r, c) // the recipient is the source
+			a.AssetsIn = assets
+			withTransfer(a, transfer, assets)
+			p.actions = append(p.actions, a)
 		} else {
-			rel = NewTrustRelationship()
-			rel.Type = TypeInteraction
-			rel.Properties = map[string]interface{}{
-				"txId":      vLog.TxHash.Hex(),
-				"action":    action,
-				"timestamp": time.Unix(int64(block.Time()), 0),
-			}
-			if s.Type == TypeAddress {
+			if !sIsProtocol {
 				// if the sender is type address and recipient defi-portal
 				// then best case scenario
-				rel.SourceCriteria = s // the sender is the source
-				rel.TargetCriteria = r
-				cs.AddRel(rel)
+				a := newLogAction(vLog, action, timestamp, evt, s, r) // the sender is the source
+				a.AssetsOut = assets
+				withTransfer(a, transfer, assets)
+				p.actions = append(p.actions, a)
 			} else {
 				// if the sender is type defi-portal and sender address
 				// then swap them around
-				rel.SourceCriteria = r // the sender is the source
-				rel.TargetCriteria = s
-				cs.AddRel(rel)
+				a := newLogAction(vLog, action, timestamp, evt, r, s) // the sender is the source
+				a.AssetsIn = assets
+				withTransfer(a, transfer, assets)
+				p.actions = append(p.actions, a)
 			}
 
 		}
 
 		// now add missing stuff
 		if sIsNew {
-			// TODO copying here is ugly
-			entity := NewTrustEntity(senderAddress)
-			entity.Ids = s.Ids
-			entity.Type = s.Type
-			entity.Image = fmt.Sprintf("https://via.placeholder.com/150/FFFF00/000000/?text=%s", senderAddress)
-			cs.AddEntity(entity)
+			p.entities = append(p.entities, newAddressEntity(senderAddress, s))
 		}
 		if rIsNew {
-			// TODO copying here is ugly
-			entity := NewTrustEntity(recipientAddress)
-			entity.Ids = r.Ids
-			entity.Type = r.Type
-			entity.Image = fmt.Sprintf("https://via.placeholder.com/150/FFFF00/000000/?text=%s", recipientAddress)
-			cs.AddEntity(entity)
+			p.entities = append(p.entities, newAddressEntity(recipientAddress, r))
+		}
+
+	case evt != nil:
+		// every address in the event that is not a protocol
+		// interacted with the contract that emitted it
+		c, _ := chain.criteria(Address(vLog.Address.Hex()), client)
+		seen := make(map[string]bool)
+		for _, a := range evt.Actors {
+			if a == ZeroAddress || seen[a] || a == strings.ToLower(vLog.Address.Hex()) {
+				continue
+			}
+			seen[a] = true
+			e, isNew := chain.criteria(NewAddressFromString(a), client)
+			if e.Type == TypeDefiProtocol {
+				continue
+			}
+			p.actions = append(p.actions, newLogAction(vLog, action, timestamp, evt, e, c))
+			if isNew {
+				p.entities = append(p.entities, newAddressEntity(a, e))
+			}
+		}
+		if len(p.actions) == 0 {
+			err = fmt.Errorf("skip tx %s event log: no user address in %s", vLog.TxHash.Hex(), action)
 		}
 
 	default:
@@ -179,115 +276,348 @@ func ParseLog(vLog *types.Log, client *ethclient.Client) (cs TrustAPIChangeSet,
 	return
 }
 
+// originatorActions attribute a log to the account that sent its tx. The
+// contract called by the tx, e.g. a router, and the other addresses in the
+// log are recorded in the path property of the action.
+func originatorActions(vLog *types.Log, client ChainClient, chain *Chain, event string, timestamp time.Time, evt *DecodedEvent, transfer *TokenTransfer, assets []AssetAmount, p *parsedLog) (err error) {
+	tx, err := chain.state().cache.Transaction(context.Background(), client, vLog.TxHash)
+	if err != nil {
+		return
+	}
+	sender, err := types.Sender(types.LatestSignerForChainID(tx.ChainId()), tx)
+	if err != nil {
+		err = fmt.Errorf("cannot resolve the sender of tx %s: %v", vLog.TxHash.Hex(), err)
+		return
+	}
+	originator := strings.ToLower(sender.Hex())
+	contract := strings.ToLower(vLog.Address.Hex())
+
+	o, isNew := chain.criteria(NewAddressFromString(originator), client)
+	if o.Type == TypeDefiProtocol {
+		err = fmt.Errorf("skip tx %s event log: sent by a defi-protocol", vLog.TxHash.Hex())
+		return
+	}
+	c, _ := chain.criteria(Address(vLog.Address.Hex()), client)
+	a := newLogAction(vLog, event, timestamp, evt, o, c)
+
+	// the parties of the log
+	var parties []string
+	if transfer != nil {
+		parties = []string{transfer.From, transfer.To}
+		withTransfer(a, transfer, assets)
+		// the direction of the transfer for the originator
+		switch {
+		case transfer.From == originator, transfer.To == contract:
+			a.AssetsOut = assets
+		case transfer.To == originator, transfer.From == contract:
+			a.AssetsIn = assets
+		}
+	} else if evt != nil {
+		parties = evt.Actors
+	}
+	// the intermediate addresses, in the order they are seen
+	seen := map[string]bool{originator: true, contract: true, strings.ToLower(ZeroAddress): true}
+	var path []string
+	addToPath := func(address string) {
+		if address = strings.ToLower(address); !seen[address] {
+			seen[address] = true
+			path = append(path, address)
+		}
+	}
+	if tx.To() != nil {
+		addToPath(tx.To().Hex())
+	}
+	for _, party := range parties {
+		addToPath(party)
+	}
+	if len(path) > 0 {
+		a.Properties["path"] = path
+	}
+
+	p.actions = append(p.actions, a)
+	if isNew {
+		p.entities = append(p.entities, newAddressEntity(originator, o))
+	}
+	return
+}
+
+// newLogAction build the action for an event log, the decoded arguments of the
+// event are added to the action properties
+func newLogAction(vLog *types.Log, event string, timestamp time.Time, evt *DecodedEvent, actor, protocol *TrustEntity) *Action {
+	a := NewAction(ActionFromEvent(event), actor, protocol)
+	a.Event = event
+	a.TxHash = vLog.TxHash.Hex()
+	a.Timestamp = timestamp
+	a.Source = SourceEventLog
+	if evt != nil {
+		for k, v := range evt.Args {
+			a.Properties[k] = v
+		}
+	}
+	return a
+}
+
+// newAddressEntity build the entity for an address seen for the first time
+func newAddressEntity(address string, criteria *TrustEntity) *TrustEntity {
+	// TODO copying here is ugly
+	entity := NewTrustEntity(address)
+	entity.Ids = criteria.Ids
+	entity.Type = criteria.Type
+	entity.Image = fmt.Sprintf("https://via.placeholder.com/150/FFFF00/000000/?text=%s", address)
+	return entity
+}
+
 func changesetsProcessor(cfg config.TrustEngineSchema) {
+	defer close(processorDone)
+	postedRetention = cfg.DedupRetention
 	utuCli := NewUTUClient(cfg)
 	if cfg.DryRun {
 		log.Info("Utu client is in dry run mode, CHANGES WILL NOT BE SUBMITTED!")
 	}
-	// listen on the queue
-	for {
-		cs, more := <-csQueue
-		if !more {
-			log.Info("changeset queue is closed, exiting")
-			break
-		}
+	postChangesets(csQueue, func(cs *TrustAPIChangeSet) bool {
 		// if dryrun just print the outcome
 		if cfg.DryRun {
 			v, _ := json.MarshalIndent(cs, "", "  ")
 			fmt.Println(string(v))
-			continue
+			cs.acknowledge()
+			return true
 		}
+		// the changesets skipped as posted already are done too
+		return postChangeset(utuCli, cs) || isPosted(cs.Key)
+	})
+}
 
-		for _, e := range cs.Entities {
-			// cache addresses
-			for a, n := range e.Ids {
-				// push to the address cache
-				cachePush(a, n, e.Type)
+// postChangesets post the changesets of the queue until it is closed, a
+// changeset that fails is posted again after a backoff, from
+// ChangesetRetryDelay doubling up to ChangesetRetryMaxDelay, so it does not
+// hold the checkpoint until a restart. Once the queue is closed the
+// changesets waiting are posted one last time.
+func postChangesets(queue <-chan *TrustAPIChangeSet, post func(cs *TrustAPIChangeSet) bool) {
+	retry, quit := make(chan *TrustAPIChangeSet), make(chan struct{})
+	waiting := make(map[*TrustAPIChangeSet]*time.Timer)
+	requeue := func(cs *TrustAPIChangeSet) {
+		if cs.retryDelay == 0 {
+			cs.retryDelay = ChangesetRetryDelay
+		} else if cs.retryDelay *= 2; cs.retryDelay > ChangesetRetryMaxDelay {
+			cs.retryDelay = ChangesetRetryMaxDelay
+		}
+		log.Warnf("posting changeset %s failed, retrying in %s", cs.Key, cs.retryDelay)
+		waiting[cs] = time.AfterFunc(cs.retryDelay, func() {
+			select {
+			case retry <- cs:
+			case <-quit:
+			}
+		})
+	}
+	for {
+		select {
+		case cs, more := <-queue:
+			if !more {
+				log.Info("changeset queue is closed, exiting")
+				close(quit)
+				for cs, t := range waiting {
+					t.Stop()
+					if !post(cs) {
+						log.Errorf("changeset %s not posted", cs.Key)
+					}
+				}
+				return
+			}
+			if !post(cs) {
+				requeue(cs)
 			}
-			// execute the request
-			if err := utuCli.PostEntity(e); err != nil {
-				log.Error("error posting entity:", err)
+		case cs := <-retry:
+			delete(waiting, cs)
+			if !post(cs) {
+				requeue(cs)
 			}
 		}
+	}
+}
 
-		for _, r := range cs.Relationship {
-			// execute the request
-			if err := utuCli.PostRelationship(r); err != nil {
-				log.Error("error posting relationship:", err)
-			}
+// postChangeset post the entities and the relationships of the changeset, a
+// changeset with a key that has been posted already is skipped, and it is
+// remembered as posted only if all the requests succeed, then it is
+// acknowledged
+func postChangeset(utuCli *UTUClient, cs *TrustAPIChangeSet) (posted bool) {
+	// the changesets delivered again are posted once
+	if isPosted(cs.Key) {
+		log.Debugf("skip changeset %s, already posted", cs.Key)
+		cs.acknowledge()
+		return
+	}
+	posted = true
+	for _, e := range cs.Entities {
+		// cache addresses
+		for a, n := range e.Ids {
+			// push to the address cache
+			cs.chain.cachePush(a, n, e.Type)
+		}
+		// execute the request
+		if err := utuCli.PostEntity(e); err != nil {
+			log.Error("error posting entity:", err)
+			posted = false
 		}
 	}
+
+	for _, r := range cs.Relationship {
+		// execute the request
+		if err := utuCli.PostRelationship(r); err != nil {
+			log.Error("error posting relationship:", err)
+			posted = false
+		}
+	}
+	if posted {
+		markPosted(cs.Key)
+		cs.acknowledge()
+	}
+	return
 }
 
 // Ready setup the processing queue
-func Ready(cfg config.Schema) {
+func Ready(cfg config.Schema) (err error) {
+	// open the store
+	if store, err = OpenStore(cfg.DBFolder); err != nil {
+		err = fmt.Errorf("cannot open the store at %s: %w", cfg.DBFolder, err)
+		return
+	}
+	// the queue of the scans does not survive a restart
+	interruptJobs()
 	// start the processor
 	go changesetsProcessor(cfg.UTUTrustAPI)
-	go addressProcessor(cfg)
+	return
+}
 
+// AddressProcessorReady start the processor of the scans of the addresses,
+// after Ready
+func AddressProcessorReady(cfg config.Schema) {
+	go addressProcessor(cfg, addrQueue, func(cs *TrustAPIChangeSet) {
+		csQueue <- cs
+	})
 }
 
-// Start the service
+// Stop close the processing queue and wait for the queued changesets to be
+// submitted
+func Stop() {
+	close(csQueue)
+	<-processorDone
+	if store != nil {
+		store.Close()
+	}
+}
+
+// Start the collectors of the configured chains, one per chain, a collector
+// that stops is restarted with an increasing backoff, so a chain whose node
+// fails does not stop the others
 func Start(cfg config.Schema) (err error) {
-	log.Info("starting collector for protocols at ", cfg.DefiSourcesFile)
-	client, err := ethclient.Dial(cfg.Ethereum.WssURL)
+	var wg sync.WaitGroup
+	for _, c := range cfg.AllChains() {
+		wg.Add(1)
+		go func(c config.EthereumSchema) {
+			defer wg.Done()
+			runChain(c)
+		}(c)
+	}
+	wg.Wait()
+	return
+}
+
+// runChain collect the events of a chain, restarting the collector when it
+// stops
+func runChain(cfg config.EthereumSchema) {
+	backoff := minBackoff
+	for {
+		started := time.Now()
+		err := startChain(cfg)
+		if time.Since(started) > maxBackoff {
+			// it ran for a while, the failure is a new one
+			backoff = minBackoff
+		}
+		log.Errorf("collector for %s stopped, restarting in %s: %v", cfg.Network, backoff, err)
+		time.Sleep(backoff)
+		backoff = nextBackoff(backoff)
+	}
+}
+
+// startChain collect the events of the protocols deployed on a chain
+func startChain(cfg config.EthereumSchema) (err error) {
+	log.Infof("starting %s collector for protocols at %s", cfg.Network, cfg.DefiSourcesFile)
+	client, err := ethclient.Dial(cfg.NodeURL())
 	if err != nil {
 		return
 	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	chainID, err := client.ChainID(ctx)
+	if err != nil {
+		return
+	}
+	chain := &Chain{ID: chainID, Network: cfg.Network, Explorer: cfg.ExplorerURL, Confirmations: cfg.Confirmations}
+	source, err := NewLogSource(cfg, client, chain)
+	if err != nil {
+		return
+	}
+	registerLogSource(cfg.Network, source)
 	// prepare the entities cache
 	var addresFilters []common.Address
 
 	// read the list of monitored protocols
-	var protocols *ProtocolsFormat
-	err = utils.ReadJSON(cfg.DefiSourcesFile, &protocols)
+	protocols, err := ReadProtocols(cfg.DefiSourcesFile)
 	if err != nil {
 		log.Errorf("cannot retrieve the defi protocols from %s: %v", cfg.DefiSourcesFile, err)
 		return
 	}
 
 	for _, p := range protocols.DefiProtocols {
-		// if there are no filters skip
-		if len(p.Filters) == 0 {
-			log.Warnf("skip protocol %s: empty filters", p.Name)
-			continue
-		}
-		// build the entity
-		protocolID := strings.ToLower(p.MainAddress)
-		log.Infof("protocol %s added with %d addresses", p.Name, len(p.Filters))
-		//
-		e := NewTrustEntity(p.Name)
-		e.Type = TypeDefiProtocol
-		e.Image = p.IconURL
-		e.Ids = map[string]string{"address": protocolID}
-		e.Properties = map[string]interface{}{
-			"url":         p.URL,
-			"description": p.Description,
-			"category":    p.Category,
-		}
-		// queue it to the processor
-		csQueue <- NewChangeset(e)
-		// cache addresses
-		for a := range p.Filters {
-			// push to the address cache
-			cachePush(a, protocolID, TypeDefiProtocol)
-			// add to the list of filter for ethereum
-			addresFilters = append(addresFilters, common.HexToAddress(a)) // OK, looks like they are converted internally to a checksummed address already.
-			log.Debugf("registered protocol %s filter %s at %s", p.Name, protocolID, a)
+		filters, err := registerProtocol(p, filepath.Dir(cfg.DefiSourcesFile), chain)
+		if err != nil {
+			return err
 		}
+		addresFilters = append(addresFilters, filters...)
 	}
 
-	log.Infof("registered %d filters", len(addresFilters))
+	log.Infof("registered %d filters on %s", len(addresFilters), cfg.Network)
+	// resume from the last posted block of the chain and of the protocols
+	checkpoint, err := NewCheckpoint(store, CheckpointKey(chainID, protocols.Addresses()))
+	if err != nil {
+		return
+	}
+	if checkpoint.Resumed {
+		log.Infof("the %s protocols changed, catching up the new ones from block %d, use backfill for their history", cfg.Network, checkpoint.Block)
+	}
+	// the pools discovered before a restart
+	pools, err := chain.loadPools()
+	if err != nil {
+		return
+	}
+	if len(pools) > 0 {
+		log.Infof("following %d discovered pools on %s", len(pools), cfg.Network)
+	}
+	for _, p := range pools {
+		addresFilters = append(addresFilters, common.HexToAddress(p.Address))
+	}
 	// prepare query
 	query := ethereum.FilterQuery{
 		Addresses: addresFilters,
 	}
+	if checkpoint.Block > 0 {
+		log.Infof("resuming from checkpoint %s at block %d", checkpoint.Key, checkpoint.Block)
+		query.FromBlock = new(big.Int).SetUint64(checkpoint.Block + 1)
+	}
 	// prepare the channel for subscrition
 	logs := make(chan types.Log)
-	// make the query
-	sub, err := client.SubscribeFilterLogs(context.Background(), query, logs)
-	if err != nil {
-		log.Fatal(err)
-	}
+	// make the query, the source catches up from the checkpoint
+	// and recovers from the node disconnections, the filter grows with
+	// the discovered pools
+	filter := NewLogFilter(source, query)
+	filter.Node = client
+	// the block up to which the logs have been delivered, it moves on a
+	// quiet chain too
+	progress := make(chan uint64)
+	go filter.Run(ctx, logs, progress)
+	// the protocols file is reloaded when it changes
+	reloads := make(chan struct{}, 1)
+	go WatchProtocols(ctx, cfg.DefiSourcesFile, reloads)
 	// propare output
 	// f, err := os.OpenFile(cfg.LogOutputFile, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
 	// if err != nil {
@@ -295,125 +625,259 @@ func Start(cfg config.Schema) (err error) {
 	// }
 	// defer f.Close()
 
+	// logs wait in the buffer until they are confirmed
+	confirmations := cfg.Confirmations
+	buffer, err := NewLogBuffer(confirmations, store, chainID)
+	if err != nil {
+		return
+	}
+	heads := make(chan *types.Header)
+	if confirmations > 0 {
+		log.Infof("processing %s logs after %d confirmations", cfg.Network, confirmations)
+		go source.Heads(ctx, heads)
+	}
+	// the logs of a tx are aggregated in one interaction per user and protocol
+	agg := NewAggregator(chain, func(cs *TrustAPIChangeSet) {
+		csQueue <- cs
+	})
+	// the checkpoint moves, and a confirmed log leaves the store, once the
+	// changeset of the log has been posted
+	agg.Done = func(l types.Log) {
+		if confirmations > 0 {
+			buffer.Done(l)
+		}
+		checkpoint.Done(l.BlockNumber)
+	}
+	go agg.Run(ctx, AggregationWindow)
+	handle := func(vLog types.Log) {
+		checkpoint.Begin(vLog.BlockNumber)
+		// the pools created by the factories are followed from their creation
+		if pool, err := chain.DiscoverPool(&vLog); err != nil {
+			log.Warn("error discovering pool: ", err)
+		} else if pool != nil && chain.addPool(*pool) {
+			filter.Add(&vLog, common.HexToAddress(pool.Address))
+		}
+		if err := processLog(&vLog, client, agg); err != nil {
+			log.Warn("error parsing log: ", err)
+		}
+	}
+
 	// get them
 	for {
 		select {
-		case err := <-sub.Err():
-			log.Fatal(err)
+		case <-reloads:
+			next, err := reloadProtocols(cfg.DefiSourcesFile, chain, protocols, filter, agg.emit)
+			if err != nil {
+				log.Error("error reloading the protocols: ", err)
+				continue
+			}
+			protocols = next
+			// the checkpoint is for the protocols
+			checkpoint.Move(CheckpointKey(chainID, protocols.Addresses()))
+		case head := <-heads:
+			buffer.Release(head.Number.Uint64(), handle)
+			// the confirmed blocks are complete
+			agg.Flush()
+			// all the logs up to the confirmed block, and delivered, are
+			// processed
+			if n := head.Number.Uint64(); n > confirmations {
+				checkpoint.Reach(n - confirmations)
+			}
+		case n := <-progress:
+			checkpoint.Progress(n)
+			if confirmations == 0 {
+				// the delivered logs have been processed
+				checkpoint.Reach(n)
+			}
 		case vLog := <-logs:
 			// check if the log is for an address we know
-			_, _, found := cacheGet(vLog.Address.Hex())
+			_, _, found := chain.cacheGet(vLog.Address.Hex())
 			if !found {
 				err = fmt.Errorf("skip unknown contract address: %s ", vLog.Address.Hex())
 				continue
 			}
-			// this should return a relationship
-			changeset, err := ParseLog(&vLog, client)
-			if err != nil {
-				log.Warn("error parsing log: ", err)
+			if confirmations == 0 {
+				// the checkpoint moves with the progress of the source
+				handle(vLog)
 				continue
 			}
-			csQueue <- &changeset
-			// aggregate
-			//queue(changeset)
+			// a log removed before it is confirmed is just dropped
+			if vLog.Removed {
+				pending, err := buffer.Remove(vLog)
+				if err != nil {
+					log.Error("error removing pending log: ", err)
+					continue
+				}
+				if !pending {
+					handle(vLog)
+				}
+				continue
+			}
+			if err := buffer.Add(vLog); err != nil {
+				log.Error("error buffering log: ", err)
+			}
 		}
 	}
 }
 
-func addressProcessor(cfg config.Schema) {
-	cache := make(map[Address]bool)
-	// get the etherscan client
-	client := NewEtherscanClient(cfg.Ethereum.EtherscanAPIToken)
-	client.PageSize = 2000
-	for {
-		addr, more := <-addrQueue
-		log.Info("received request to scan address ", addr)
-		if !more {
-			log.Info("changeset queue is closed, exiting")
-			break
-		}
-		if _, found := cache[addr]; found {
-			log.Infof("skip address %s, already scanned", addr)
-			continue
-		}
-		cache[addr] = true
-		// recursion levels
-		currentLevel := 0
-		maxLevel := 1
-		// now we go through all transactions an we search for:
-		processedAddress := make(map[Address]bool)
-		scan(client, processedAddress, addr, currentLevel, maxLevel)
+// registerProtocol queue the protocol entity, caches its addresses and loads
+// its abis, it returns the addresses to filter the logs for
+func registerProtocol(p Protocol, baseDir string, chain *Chain) (filters []common.Address, err error) {
+	cs, filters, err := addProtocol(p, baseDir, chain)
+	if cs != nil {
+		csQueue <- cs
 	}
-}
-
-// Scan scan the relationships of a new address
-func Scan(address Address) (err error) {
-	go ScanTokensBalances(string(address))
-	addrQueue <- address
 	return
 }
 
-// actually process the addresses
-func scan(client *EtherscanClient, processedAddress map[Address]bool, a Address, level, maxLevel int) {
-	// don't go too deep
-	if level > maxLevel {
+// addProtocol caches the protocol addresses and loads its abis, it returns
+// the changeset of the protocol entity, nil on error, and the addresses to
+// filter the logs for
+func addProtocol(p Protocol, baseDir string, chain *Chain) (cs *TrustAPIChangeSet, filters []common.Address, err error) {
+	// if there are no filters skip
+	if len(p.Filters) == 0 {
+		log.Warnf("skip protocol %s: empty filters", p.Name)
 		return
 	}
-	// if already visited don't do it again
-	if _, doneAlready := processedAddress[a]; doneAlready {
+	// build the entity
+	protocolID := strings.ToLower(p.MainAddress)
+	log.Infof("protocol %s added with %d addresses", p.Name, len(p.Filters))
+	//
+	e := NewTrustEntity(p.Name)
+	e.Type = TypeDefiProtocol
+	e.Image = p.IconURL
+	e.Ids = map[string]string{"address": protocolID}
+	e.Properties = map[string]interface{}{
+		"url":         p.URL,
+		"description": p.Description,
+		"category":    p.Category,
+	}
+	// cache addresses
+	for a := range p.Filters {
+		// push to the address cache
+		chain.cachePush(a, protocolID, TypeDefiProtocol)
+		// add to the list of filter for ethereum
+		filters = append(filters, common.HexToAddress(a)) // OK, looks like they are converted internally to a checksummed address already.
+		log.Debugf("registered protocol %s filter %s at %s", p.Name, protocolID, a)
+	}
+	// the factories are followed too, to discover the new pools
+	for _, f := range p.Factories {
+		address := common.HexToAddress(f.Address)
+		if containsAddress(filters, address) {
+			continue
+		}
+		chain.cachePush(f.Address, protocolID, TypeDefiProtocol)
+		filters = append(filters, address)
+	}
+	// register the abis to decode the protocol events
+	if err = chain.LoadABIs(p, baseDir); err != nil {
+		err = fmt.Errorf("cannot load the abis for protocol %s: %v", p.Name, err)
 		return
 	}
-	processedAddress[a] = true
-	// retrieve the address transactions
-	txs, err := client.GetTransactions(a)
-	if err != nil {
-		log.Error("error retrieving transactions: ", err)
+	if err = chain.registerFactories(p, baseDir); err != nil {
+		err = fmt.Errorf("cannot register the factories of protocol %s: %v", p.Name, err)
 		return
 	}
-	// create the source criteria
-	sc, isNew := criteria(a)
-	// it's a contract
-	if sc.Type == TypeDefiProtocol {
+	if err = chain.registerAttribution(p); err != nil {
 		return
 	}
-	// create the changeset queue and start the processor
-	if isNew {
-		sc.Name = string(a)
-		csQueue <- NewChangeset(sc)
-	}
-	// process the relationships
-	var src, dst Address
-	var cs *TrustAPIChangeSet
-	for _, y := range txs {
-		src, dst = y.From, y.To
-		// if source is eq destination skip it
-		if src == dst {
-			continue
+	if err = chain.registerTopics(p); err != nil {
+		return
+	}
+	// to be queued to the processor
+	cs = NewChangeset(e)
+	chain.Tag(cs)
+	return
+}
+
+// processLog pass the actions of a log to the aggregator, the logs that have
+// been removed by a reorg drop or retract their tx
+func processLog(vLog *types.Log, client ChainClient, agg *Aggregator) (err error) {
+	if vLog.Removed {
+		if agg.Remove(vLog) {
+			agg.done(*vLog)
+			return
 		}
-		// the subject address is always the sender
-		if src != a {
-			src, dst = y.To, y.From
+		cs, found := agg.chain.Retract(vLog)
+		if !found {
+			agg.done(*vLog)
+			return
 		}
-		dc, isNew := criteria(dst)
-		cs = NewChangeset()
-		if isNew {
-			dc.Name = string(dst)
-			cs.AddEntity(dc)
+		log.Infof("retracting %d relationships for tx %s removed by reorg", len(cs.Relationship), vLog.TxHash.Hex())
+		l := *vLog
+		cs.onPosted(func() { agg.done(l) })
+		agg.emit(cs)
+		return
+	}
+	p, err := parseLog(vLog, client, agg.chain)
+	// a log without actions completes the txs of the previous blocks too
+	agg.Add(vLog, &p)
+	return
+}
+
+// addressProcessor scan the addresses of the jobs until the jobs channel is
+// closed, the changesets of the scans are passed to emit
+func addressProcessor(cfg config.Schema, jobs <-chan *ScanJob, emit func(cs *TrustAPIChangeSet)) {
+	// get the etherscan client
+	client := NewEtherscanClient(cfg.Ethereum.EtherscanAPIToken)
+	client.PageSize = 2000
+	client.SetRateLimit(cfg.Ethereum.EtherscanRateLimit)
+	client.Retries, client.RetryDelay = cfg.Ethereum.EtherscanRetries, cfg.Ethereum.EtherscanRetryDelay
+	// the next scans of an address get only its new transactions
+	client.Incremental = true
+	// the mainnet node classifies the addresses found by the scan
+	explorer := NewExplorer(cfg.Scan, client, mainnetNode(cfg))
+	explorer.Emit = emit
+	for {
+		job, more := <-jobs
+		if !more {
+			log.Info("changeset queue is closed, exiting")
+			break
 		}
-		//
-		rel := NewTrustRelationship()
-		rel.Type = TypeInteraction
-		rel.Properties = map[string]interface{}{
-			"txId":      y.Hash,
-			"action":    "interaction",
-			"timestamp": y.GetTime(),
+		log.Infof("received request %s to scan address %s", job.ID, job.Address)
+		job.start()
+		// now we go through the transactions of the address and of its
+		// counterparties, the scans after the first get only the new ones
+		explorer.Progress = job.progress
+		report, err := explorer.Explore(job.Address)
+		if err != nil {
+			log.Errorf("scan of %s stopped: %v", job.Address, err)
 		}
-		rel.SourceCriteria = sc // the sender is the source
-		rel.TargetCriteria = dc
-		cs.AddRel(rel)
-		// add to the processed list
-		csQueue <- cs
-		// recursively call on the destination
-		scan(client, processedAddress, dst, level+1, maxLevel)
+		job.finish(report, err)
 	}
 }
+
+// mainnetNode connect to the node of the configured chain with the mainnet
+// id, the chain of the etherscan scans, it is nil if there is none
+func mainnetNode(cfg config.Schema) CodeReader {
+	for _, c := range cfg.AllChains() {
+		n, err := ethclient.Dial(c.NodeURL())
+		if err != nil {
+			log.Warnf("cannot connect to %s: %v", c.Network, err)
+			continue
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		id, err := n.ChainID(ctx)
+		cancel()
+		if err == nil && id.String() == Mainnet.key() {
+			return n
+		}
+		n.Close()
+	}
+	log.Warn("no mainnet node configured, the scanned addresses are not classified")
+	return nil
+}
+
+// Scan queue a job to scan the relationships of an address, the job fails
+// right away if the queue is full
+func Scan(address Address) (job *ScanJob, err error) {
+	job = NewScanJob(address)
+	select {
+	case addrQueue <- job:
+		go ScanTokensBalances(string(address))
+	default:
+		err = fmt.Errorf("cannot scan %s, %d scans are queued already", address, ScanQueueSize)
+		job.finish(job.Report, err)
+	}
+	return
+}
@@ -1,9 +1,17 @@
 package collector
 
 import (
+	"context"
+	"math/big"
 	"strings"
 	"testing"
 
+	"github.com/ethereum/go-ethereum/accounts/abi"
+	"github.com/ethereum/go-ethereum/accounts/abi/bind"
+	"github.com/ethereum/go-ethereum/accounts/abi/bind/backends"
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/core"
+	"github.com/ethereum/go-ethereum/crypto"
 	"github.com/stretchr/testify/assert"
 	"github.com/utu-crowdsale/defi-portal-scanner/config"
 )
@@ -17,9 +25,12 @@ func checkEntityHasLowercaseAddress(t *testing.T, te *TrustEntity) {
 
 func TestAddressProcessorEmitsChangesetsWithLowercaseAddresses(t *testing.T) {
 	cfg := new(config.Schema)
+	changesets := make(chan *TrustAPIChangeSet)
+	checked := make(chan struct{})
 	go func(t *testing.T) {
+		defer close(checked)
 		for {
-			cs, more := <-csQueue
+			cs, more := <-changesets
 			if !more {
 				break
 			}
@@ -32,14 +43,80 @@ func TestAddressProcessorEmitsChangesetsWithLowercaseAddresses(t *testing.T) {
 			}
 		}
 	}(t)
-	go addressProcessor(*cfg)
+	jobs := make(chan *ScanJob)
+	processed := make(chan struct{})
+	go func() {
+		defer close(processed)
+		addressProcessor(*cfg, jobs, func(cs *TrustAPIChangeSet) {
+			changesets <- cs
+		})
+	}()
 
 	// If you put in a lowercase string here into the channel, yes of course it
 	// will break. However, addrQueue is only added to from Scan(), which is
 	// started by server.go:Serve(). As long as that converts any user input
 	// from a string into a Address, we are safe.
-	addrQueue <- NewAddressFromString("0x0000000000007f150bd6f54c40a34d7c3d5e9f56")
-	addrQueue <- NewAddressFromString("0x0000000000007F150Bd6f54c40A34d7C3d5e9f56")
-	// here the cache should detect that they are the same address and skip scanning
-	addrQueue <- NewAddressFromString("0xDe5CAf81E2446BA4BAf9A35E1DB1ecF247f1eF89")
+	jobs <- NewScanJob(NewAddressFromString("0x0000000000007f150bd6f54c40a34d7c3d5e9f56"))
+	// the same address is a new job, that gets only the new transactions
+	jobs <- NewScanJob(NewAddressFromString("0x0000000000007F150Bd6f54c40A34d7C3d5e9f56"))
+	jobs <- NewScanJob(NewAddressFromString("0xDe5CAf81E2446BA4BAf9A35E1DB1ecF247f1eF89"))
+	// the jobs are all processed and checked
+	close(jobs)
+	<-processed
+	close(changesets)
+	<-checked
+}
+
+func TestOriginatorAttribution(t *testing.T) {
+	key, _ := crypto.GenerateKey()
+	deployer := crypto.PubkeyToAddress(key.PublicKey)
+	sim := backends.NewSimulatedBackend(core.GenesisAlloc{
+		deployer: {Balance: big.NewInt(1e18)},
+	}, 10000000)
+	defer sim.Close()
+
+	// the contract emits a transfer between two contracts, e.g. a router
+	// and a pool, when it is deployed
+	auth, _ := bind.NewKeyedTransactorWithChainID(key, big.NewInt(1337))
+	router := common.HexToAddress("0x00000000000000000000000000000000000000c1")
+	pool := common.HexToAddress("0x00000000000000000000000000000000000000c2")
+	contract, tx, _, err := bind.DeployContract(auth, abi.ABI{}, transferEmitterCode(router, pool), sim)
+	assert.Nil(t, err)
+	sim.Commit()
+	receipt, err := sim.TransactionReceipt(context.Background(), tx.Hash())
+	assert.Nil(t, err)
+	vLog := receipt.Logs[0]
+
+	p := Protocol{
+		Name:        "Router",
+		Filters:     map[string]string{contract.Hex(): "Token"},
+		Attribution: AttributionOriginator,
+	}
+	Mainnet.cachePush(contract.Hex(), strings.ToLower(contract.Hex()), TypeDefiProtocol)
+	assert.Nil(t, Mainnet.registerAttribution(p))
+
+	parsed, err := parseLog(vLog, sim, nil)
+	assert.Nil(t, err)
+	if assert.Len(t, parsed.actions, 1) {
+		a := parsed.actions[0]
+		assert.Equal(t, strings.ToLower(deployer.Hex()), a.Actor.Ids["address"])
+		assert.Equal(t, strings.ToLower(contract.Hex()), a.Protocol.Ids["address"])
+		assert.Equal(t, []string{strings.ToLower(router.Hex()), strings.ToLower(pool.Hex())}, a.Properties["path"])
+	}
+	if assert.Len(t, parsed.entities, 1) {
+		assert.Equal(t, strings.ToLower(deployer.Hex()), parsed.entities[0].Ids["address"])
+	}
+
+	// the parties attribution uses the addresses in the log
+	p.Attribution = AttributionParties
+	assert.Nil(t, Mainnet.registerAttribution(p))
+	parsed, err = parseLog(vLog, sim, nil)
+	assert.Nil(t, err)
+	assert.Len(t, parsed.actions, 2)
+	for _, a := range parsed.actions {
+		assert.NotEqual(t, strings.ToLower(deployer.Hex()), a.Actor.Ids["address"])
+	}
+
+	p.Attribution = "somebody"
+	assert.Error(t, Mainnet.registerAttribution(p))
 }
@@ -0,0 +1,146 @@
+package collector
+
+import (
+	"encoding/json"
+	"fmt"
+	"math/big"
+	"sort"
+	"sync"
+
+	"github.com/ethereum/go-ethereum/core/types"
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	pendingLogsBucket = "pending_logs"
+)
+
+// LogBuffer holds the logs until the chain head is enough blocks past them.
+// When a store is set the pending logs are persisted, so they survive a restart.
+type LogBuffer struct {
+	confirmations uint64
+	store         *Store
+	bucket        string
+	logs          map[uint64][]types.Log
+	m             sync.Mutex
+}
+
+// NewLogBuffer create a buffer for the confirmations depth, the logs pending
+// in the store for the chain are loaded back in the buffer
+func NewLogBuffer(confirmations uint64, store *Store, chainID *big.Int) (b *LogBuffer, err error) {
+	b = &LogBuffer{
+		confirmations: confirmations,
+		store:         store,
+		bucket:        fmt.Sprintf("%s:%s", pendingLogsBucket, chainID),
+		logs:          make(map[uint64][]types.Log),
+	}
+	if store == nil {
+		return
+	}
+	err = store.All(b.bucket, func(key string, value []byte) error {
+		var l types.Log
+		if err := json.Unmarshal(value, &l); err != nil {
+			return fmt.Errorf("cannot read pending log %s: %v", key, err)
+		}
+		b.logs[l.BlockNumber] = append(b.logs[l.BlockNumber], l)
+		return nil
+	})
+	if n := b.Len(); n > 0 {
+		log.Infof("restored %d pending logs", n)
+	}
+	return
+}
+
+// pendingKey sort the logs by block and position in the block
+func pendingKey(l *types.Log) string {
+	return fmt.Sprintf("%020d:%s", l.BlockNumber, LogKey(l.TxHash, l.Index))
+}
+
+// Add add a log to the buffer
+func (b *LogBuffer) Add(l types.Log) (err error) {
+	b.m.Lock()
+	defer b.m.Unlock()
+	for _, p := range b.logs[l.BlockNumber] {
+		if p.TxHash == l.TxHash && p.Index == l.Index {
+			// already pending
+			return
+		}
+	}
+	if b.store != nil {
+		if err = b.store.Put(b.bucket, pendingKey(&l), l); err != nil {
+			return
+		}
+	}
+	b.logs[l.BlockNumber] = append(b.logs[l.BlockNumber], l)
+	return
+}
+
+// Remove drop a log that has been removed by a reorg before it has been
+// confirmed, found is false if the log is not pending
+func (b *LogBuffer) Remove(l types.Log) (found bool, err error) {
+	b.m.Lock()
+	defer b.m.Unlock()
+	pending := b.logs[l.BlockNumber]
+	for i, p := range pending {
+		if p.TxHash != l.TxHash || p.Index != l.Index {
+			continue
+		}
+		found = true
+		if b.store != nil {
+			if err = b.store.Delete(b.bucket, pendingKey(&p)); err != nil {
+				return
+			}
+		}
+		b.logs[l.BlockNumber] = append(pending[:i], pending[i+1:]...)
+		if len(b.logs[l.BlockNumber]) == 0 {
+			delete(b.logs, l.BlockNumber)
+		}
+		return
+	}
+	return
+}
+
+// Release call fn, in chain order, for the logs that are confirmed at the
+// head block. The logs stay in the store until Done, so that they are not
+// lost if the process stops before they are posted.
+func (b *LogBuffer) Release(head uint64, fn func(l types.Log)) {
+	b.m.Lock()
+	var blocks []uint64
+	for n := range b.logs {
+		if n+b.confirmations <= head {
+			blocks = append(blocks, n)
+		}
+	}
+	sort.Slice(blocks, func(i, j int) bool { return blocks[i] < blocks[j] })
+	var released []types.Log
+	for _, n := range blocks {
+		logs := b.logs[n]
+		sort.Slice(logs, func(i, j int) bool { return logs[i].Index < logs[j].Index })
+		released = append(released, logs...)
+		delete(b.logs, n)
+	}
+	b.m.Unlock()
+	for _, l := range released {
+		fn(l)
+	}
+}
+
+// Done remove from the store a released log that has been posted
+func (b *LogBuffer) Done(l types.Log) {
+	if b.store == nil {
+		return
+	}
+	if err := b.store.Delete(b.bucket, pendingKey(&l)); err != nil {
+		log.Errorf("cannot remove pending log %s: %v", LogKey(l.TxHash, l.Index), err)
+	}
+}
+
+// Len the number of pending logs
+func (b *LogBuffer) Len() (n int) {
+	b.m.Lock()
+	defer b.m.Unlock()
+	for _, logs := range b.logs {
+		n += len(logs)
+	}
+	return
+}
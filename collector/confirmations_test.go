@@ -0,0 +1,77 @@
+package collector
+
+import (
+	"math/big"
+	"testing"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/core/types"
+	"github.com/stretchr/testify/assert"
+)
+
+func testLog(block uint64, index uint) types.Log {
+	return types.Log{
+		Address:     common.HexToAddress("0x88e6a0c2ddd26feeb64f039a2c41296fcb3f5640"),
+		Topics:      []common.Hash{common.HexToHash("0xddf252ad1be2c89b69c2b068fc378daa952ba7f163c4a11628f55a4df523b3ef")},
+		Data:        []byte{},
+		BlockNumber: block,
+		TxHash:      common.BigToHash(common.Big1),
+		Index:       index,
+	}
+}
+
+func TestLogBuffer(t *testing.T) {
+	dir := t.TempDir()
+	s, err := OpenStore(dir)
+	assert.Nil(t, err)
+
+	b, err := NewLogBuffer(2, s, big.NewInt(1))
+	assert.Nil(t, err)
+	assert.Nil(t, b.Add(testLog(11, 3)))
+	assert.Nil(t, b.Add(testLog(10, 2)))
+	assert.Nil(t, b.Add(testLog(10, 1)))
+	assert.Nil(t, b.Add(testLog(10, 1)))
+	assert.Nil(t, b.Add(testLog(12, 4)))
+	assert.Equal(t, 4, b.Len())
+
+	// a removed log is dropped
+	removed := testLog(12, 4)
+	removed.Removed = true
+	found, err := b.Remove(removed)
+	assert.Nil(t, err)
+	assert.True(t, found)
+	found, err = b.Remove(removed)
+	assert.Nil(t, err)
+	assert.False(t, found)
+
+	// only the logs with enough confirmations are released, in order
+	var released []uint
+	b.Release(12, func(l types.Log) {
+		released = append(released, l.Index)
+		// fn can use the buffer
+		assert.Equal(t, 1, b.Len())
+	})
+	assert.Equal(t, []uint{1, 2}, released)
+	assert.Equal(t, 1, b.Len())
+	// only the posted log leaves the store
+	b.Done(testLog(10, 1))
+
+	// the pending logs survive a restart
+	s.Close()
+	s, err = OpenStore(dir)
+	assert.Nil(t, err)
+	defer s.Close()
+	b, err = NewLogBuffer(2, s, big.NewInt(1))
+	assert.Nil(t, err)
+	assert.Equal(t, 2, b.Len())
+	// the pending logs are per chain
+	other, err := NewLogBuffer(2, s, big.NewInt(137))
+	assert.Nil(t, err)
+	assert.Equal(t, 0, other.Len())
+	released = nil
+	b.Release(13, func(l types.Log) {
+		released = append(released, l.Index)
+	})
+	assert.Equal(t, []uint{2, 3}, released)
+	assert.Equal(t, 0, b.Len())
+}
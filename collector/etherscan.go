@@ -2,9 +2,12 @@ package collector
 
 import (
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io/ioutil"
+	"math/big"
 	"net/http"
+	"sort"
 	"strconv"
 	"strings"
 	"time"
@@ -12,11 +15,62 @@ import (
 	log "github.com/sirupsen/logrus"
 )
 
-// EtherscanReply a reply from etherscan
+// EtherscanReply a reply from etherscan, the result is the list of the
+// transactions, or the description of the error
 type EtherscanReply struct {
-	Status  string           `json:"status,omitempty"`
-	Message string           `json:"message,omitempty"`
-	Result  []EthTransaction `json:"result,omitempty"`
+	Status  string          `json:"status,omitempty"`
+	Message string          `json:"message,omitempty"`
+	Result  json.RawMessage `json:"result,omitempty"`
+}
+
+// Etherscan errors, an EtherscanError wraps one of them
+var (
+	// ErrEtherscanRateLimit the calls per second of the plan are exceeded
+	ErrEtherscanRateLimit = errors.New("etherscan rate limit reached")
+	// ErrEtherscanAPIKey the api key is missing or invalid
+	ErrEtherscanAPIKey = errors.New("invalid etherscan api key")
+	// ErrEtherscanUnavailable the server failed or timed out
+	ErrEtherscanUnavailable = errors.New("etherscan unavailable")
+	// ErrEtherscanQuery the query was rejected, e.g. for an invalid address
+	ErrEtherscanQuery = errors.New("etherscan query rejected")
+)
+
+// EtherscanError an error from etherscan for a query, errors.Is tells its
+// kind
+type EtherscanError struct {
+	Action  string
+	Address Address
+	// Message the error from the server
+	Message string
+	Err     error
+}
+
+func (e *EtherscanError) Error() string {
+	return fmt.Sprintf("%v: %s for %s: %s", e.Err, e.Action, e.Address, e.Message)
+}
+
+// Unwrap the kind of the error
+func (e *EtherscanError) Unwrap() error {
+	return e.Err
+}
+
+// Temporary tells if the query can be retried
+func (e *EtherscanError) Temporary() bool {
+	return e.Err == ErrEtherscanRateLimit || e.Err == ErrEtherscanUnavailable
+}
+
+// classifyEtherscanError the kind of the error of a reply with status 0
+func classifyEtherscanError(message string) error {
+	m := strings.ToLower(message)
+	switch {
+	case strings.Contains(m, "rate limit"):
+		return ErrEtherscanRateLimit
+	case strings.Contains(m, "api key"):
+		return ErrEtherscanAPIKey
+	case strings.Contains(m, "timeout") || strings.Contains(m, "unavailable") || strings.Contains(m, "busy"):
+		return ErrEtherscanUnavailable
+	}
+	return ErrEtherscanQuery
 }
 
 // Address is a custom type that guarantees that the Ethereum address (a string)
@@ -50,14 +104,28 @@ type NoMoreTransactionsError struct {
 	address Address
 	page    int
 	offset  int
+	// capped the records cap has been reached, there may be more after the
+	// last returned block
+	capped bool
 }
 
 func (n *NoMoreTransactionsError) Error() string {
 	return fmt.Sprintf("No more transactions for %s: page %d offset %d", n.address, n.page, n.offset)
 }
 
-// EthTransaction a transaction from etherescan
+// Etherscan account actions, the kinds of the transactions of an address
+const (
+	EtherscanTxList         = "txlist"
+	EtherscanTxListInternal = "txlistinternal"
+	EtherscanTokenTx        = "tokentx"
+	EtherscanTokenNFTTx     = "tokennfttx"
+)
+
+// EthTransaction a transaction from etherescan, a normal or internal
+// transaction or a token transfer, depending on its Kind
 type EthTransaction struct {
+	// Kind the account action the transaction comes from
+	Kind              string  `json:"-"`
 	BlockNumber       string  `json:"blockNumber,omitempty"`
 	TimeStamp         string  `json:"timeStamp,omitempty"`
 	Hash              string  `json:"hash,omitempty"`
@@ -76,6 +144,26 @@ type EthTransaction struct {
 	CumulativeGasUsed string  `json:"cumulativeGasUsed,omitempty"`
 	GasUsed           string  `json:"gasUsed,omitempty"`
 	Confirmations     string  `json:"confirmations,omitempty"`
+	// the token transfers
+	TokenName    string `json:"tokenName,omitempty"`
+	TokenSymbol  string `json:"tokenSymbol,omitempty"`
+	TokenDecimal string `json:"tokenDecimal,omitempty"`
+	TokenID      string `json:"tokenID,omitempty"`
+	LogIndex     string `json:"logIndex,omitempty"`
+	// the internal transactions
+	Type    string `json:"type,omitempty"`
+	TraceID string `json:"traceId,omitempty"`
+}
+
+// key identifies the transaction among the ones of its kind
+func (et EthTransaction) key() string {
+	return strings.Join([]string{et.Hash, et.LogIndex, et.TraceID, et.TokenID, string(et.From), string(et.To)}, ":")
+}
+
+// block the block number of the transaction
+func (et EthTransaction) block() uint64 {
+	n, _ := strconv.ParseUint(et.BlockNumber, 10, 64)
+	return n
 }
 
 // GetTime return the tx time
@@ -88,12 +176,112 @@ func (et EthTransaction) GetTime() (t time.Time) {
 	return
 }
 
+// Action translate the transaction to an action of the subject address,
+// the ether or the tokens sent or received by the subject are recorded as
+// assets
+func (et EthTransaction) Action(subject Address, actor, target *TrustEntity) *Action {
+	a := NewAction(ActionInteraction, actor, target)
+	a.TxHash = et.Hash
+	a.Timestamp = et.GetTime()
+	a.Source = SourceEtherscan
+	if et.Kind != "" && et.Kind != EtherscanTxList {
+		a.Properties["kind"] = et.Kind
+	}
+	var assets []AssetAmount
+	switch et.Kind {
+	case EtherscanTokenTx:
+		a.Type = ActionTransfer
+		amount := AssetAmount{Asset: strings.ToLower(et.ContractAddress), Symbol: et.TokenSymbol, Name: et.TokenName, Amount: et.Value}
+		if d, err := strconv.ParseUint(et.TokenDecimal, 10, 8); err == nil {
+			decimals := uint8(d)
+			amount.Decimals = &decimals
+			if v, ok := new(big.Int).SetString(et.Value, 10); ok {
+				amount.Value = FormatAmount(v, decimals)
+			}
+		}
+		assets = []AssetAmount{amount}
+	case EtherscanTokenNFTTx:
+		a.Type = ActionTransfer
+		assets = []AssetAmount{{Asset: strings.ToLower(et.ContractAddress), Symbol: et.TokenSymbol, Name: et.TokenName, TokenID: et.TokenID, Amount: "1"}}
+	default:
+		if et.Value != "" && et.Value != "0" {
+			assets = []AssetAmount{{Asset: "ETH", Symbol: "ETH", Amount: et.Value}}
+		}
+	}
+	if et.From == subject {
+		a.AssetsOut = assets
+	} else {
+		a.AssetsIn = assets
+	}
+	return a
+}
+
+// kindOrder the order of the kinds of the transactions of the same tx in the
+// timeline: the tx, its internal calls, then its token transfers
+var kindOrder = map[string]int{
+	EtherscanTxList:         0,
+	EtherscanTxListInternal: 1,
+	EtherscanTokenTx:        2,
+	EtherscanTokenNFTTx:     3,
+}
+
+// MergeTimeline merge the transactions of the different kinds of an address
+// in a single timeline ordered by block, the transactions of the same tx are
+// next to each other
+func MergeTimeline(lists ...[]EthTransaction) (timeline []EthTransaction) {
+	// the internal transactions have no index, they take the one of their tx
+	index := make(map[string]int)
+	for _, txs := range lists {
+		for _, tx := range txs {
+			if i, err := strconv.Atoi(tx.TransactionIndex); err == nil {
+				index[tx.Hash] = i
+			}
+		}
+		timeline = append(timeline, txs...)
+	}
+	sort.SliceStable(timeline, func(i, j int) bool {
+		a, b := timeline[i], timeline[j]
+		if a.block() != b.block() {
+			return a.block() < b.block()
+		}
+		if index[a.Hash] != index[b.Hash] {
+			return index[a.Hash] < index[b.Hash]
+		}
+		if a.Hash != b.Hash {
+			return a.Hash < b.Hash
+		}
+		return kindOrder[a.Kind] < kindOrder[b.Kind]
+	})
+	return
+}
+
+// DefaultEtherscanRate the calls per second of the etherscan free plan
+const DefaultEtherscanRate = 5
+
+// EtherscanRecordsCap how many records etherscan returns for a query, over
+// all its pages
+const EtherscanRecordsCap = 10000
+
+// lastSeenBucket the bucket of the last block fetched for an address
+const lastSeenBucket = "etherscan:lastseen"
+
 // EtherscanClient trust api client
 type EtherscanClient struct {
 	APIEndpoint string
 	APIToken    string
 	HTTPCli     *http.Client
 	PageSize    int
+	// RecordsCap how many records a query returns over all its pages
+	RecordsCap int
+	// Retries how many times a query that failed for a temporary error is
+	// retried, with a jittered exponential backoff from RetryDelay
+	Retries    int
+	RetryDelay time.Duration
+	// Incremental remember in the store the last block fetched for each
+	// address and kind of transactions, the next fetches start from it
+	Incremental bool
+	// limiter the calls per second, shared by the copies of the client
+	limiter *tokenBucket
 }
 
 // NewEtherscanClient create a new utu client
@@ -104,32 +292,177 @@ func NewEtherscanClient(apiToken string) *EtherscanClient {
 		HTTPCli: &http.Client{
 			Timeout: time.Second * 10,
 		},
-		PageSize: 100,
+		PageSize:   100,
+		RecordsCap: EtherscanRecordsCap,
+		Retries:    5,
+		RetryDelay: time.Second,
+		limiter:    newTokenBucket(DefaultEtherscanRate, 1),
+	}
+}
+
+// SetRateLimit set the calls per second allowed by the etherscan plan, 0
+// does not limit the calls
+func (c *EtherscanClient) SetRateLimit(callsPerSecond float64) {
+	c.limiter = nil
+	if callsPerSecond > 0 {
+		c.limiter = newTokenBucket(callsPerSecond, 1)
+	}
+}
+
+// LastSeen the last block fetched for each address and kind of transactions
+// by an incremental client, the next fetches start from it once it is saved
+type LastSeen map[string]uint64
+
+// Save remember the last blocks in the store, it must be called only once
+// the transactions fetched have been processed, or they would be skipped
+func (ls LastSeen) Save() {
+	if store == nil {
+		return
+	}
+	for key, block := range ls {
+		if err := store.Put(lastSeenBucket, key, block); err != nil {
+			log.Errorf("cannot save the last block of %s: %v", key, err)
+		}
 	}
 }
 
 // GetTransactions gets normal (not internal) Transactions from Etherscan.
 // Etherscan will only return 10000 records maximum, regardless of how many
-// pages you request/size of those pages.
-func (c EtherscanClient) GetTransactions(address Address) (txs []EthTransaction, err error) {
-	var pagedTxs []EthTransaction
-	page := 1
-	for err == nil {
-		pagedTxs, err = c.getPagedTransactions(address, page, c.PageSize)
-		txs = append(txs, pagedTxs...)
-		page++
-	}
-	_, ok := err.(*NoMoreTransactionsError)
-	if ok {
-		return txs, nil
+// pages you request/size of those pages, so the transactions are requested
+// in windows of blocks, each one starting from the last block of the previous.
+func (c EtherscanClient) GetTransactions(address Address) (txs []EthTransaction, seen LastSeen, err error) {
+	return c.getTransactions(EtherscanTxList, address)
+}
+
+// GetInternalTransactions gets the internal transactions of an address, the
+// calls and value transfers done by contracts, paged as GetTransactions
+func (c EtherscanClient) GetInternalTransactions(address Address) (txs []EthTransaction, seen LastSeen, err error) {
+	return c.getTransactions(EtherscanTxListInternal, address)
+}
+
+// GetTokenTransfers gets the ERC-20 transfers of an address, paged as
+// GetTransactions
+func (c EtherscanClient) GetTokenTransfers(address Address) (txs []EthTransaction, seen LastSeen, err error) {
+	return c.getTransactions(EtherscanTokenTx, address)
+}
+
+// GetNFTTransfers gets the ERC-721 transfers of an address, paged as
+// GetTransactions
+func (c EtherscanClient) GetNFTTransfers(address Address) (txs []EthTransaction, seen LastSeen, err error) {
+	return c.getTransactions(EtherscanTokenNFTTx, address)
+}
+
+// GetTimeline gets the transactions of all the kinds of an address merged
+// in a single timeline, the last blocks are returned only if every kind has
+// been fetched
+func (c EtherscanClient) GetTimeline(address Address) (timeline []EthTransaction, seen LastSeen, err error) {
+	var lists [][]EthTransaction
+	seen = make(LastSeen)
+	for _, get := range []func(Address) ([]EthTransaction, LastSeen, error){
+		c.GetTransactions,
+		c.GetInternalTransactions,
+		c.GetTokenTransfers,
+		c.GetNFTTransfers,
+	} {
+		txs, last, err := get(address)
+		if err != nil {
+			return nil, nil, err
+		}
+		lists = append(lists, txs)
+		for key, block := range last {
+			seen[key] = block
+		}
 	}
+	timeline = MergeTimeline(lists...)
 	return
+}
 
+// getTransactions gets all the pages of an account action, from the last
+// block saved if the client is incremental, and the new last block
+func (c EtherscanClient) getTransactions(action string, address Address) (txs []EthTransaction, seen LastSeen, err error) {
+	var from uint64
+	key := fmt.Sprintf("%s:%s", action, address)
+	if c.Incremental && store != nil {
+		if _, err = store.Get(lastSeenBucket, key, &from); err != nil {
+			return
+		}
+	}
+	if txs, err = c.getTransactionsFrom(action, address, from); err != nil {
+		return
+	}
+	seen = make(LastSeen)
+	if c.Incremental && len(txs) > 0 {
+		// the last block is fetched again, it may be incomplete
+		seen[key] = txs[len(txs)-1].block()
+	}
+	return
+}
+
+// getTransactionsFrom gets the transactions of an account action from a
+// block, in windows of at most RecordsCap records: when a window
+// is capped the next one starts from its last block, whose transactions
+// may be incomplete, and the ones already returned are skipped
+func (c EtherscanClient) getTransactionsFrom(action string, address Address, from uint64) (txs []EthTransaction, err error) {
+	seen := make(map[string]bool)
+	for start := from; ; {
+		var window, pagedTxs []EthTransaction
+		var capped bool
+		for page := 1; err == nil; page++ {
+			pagedTxs, err = c.getPagedTransactions(action, address, start, page, c.PageSize)
+			window = append(window, pagedTxs...)
+			if err == nil && len(pagedTxs) < c.PageSize {
+				// the last page
+				break
+			}
+		}
+		if end, ok := err.(*NoMoreTransactionsError); ok {
+			capped, err = end.capped, nil
+		}
+		if err != nil {
+			return
+		}
+		for _, tx := range window {
+			if k := tx.key(); !seen[k] {
+				seen[k] = true
+				txs = append(txs, tx)
+			}
+		}
+		if !capped || len(window) == 0 {
+			return
+		}
+		last := window[len(window)-1].block()
+		if last <= start {
+			// the block has more records than the cap
+			log.Warnf("%s of %s: more than %d records in block %d, some are skipped", action, address, c.RecordsCap, start)
+			last = start + 1
+		}
+		start = last
+	}
 }
 
-// getPagedTransactions execute GET query and parse possible responses
-func (c EtherscanClient) getPagedTransactions(address Address, page, offset int) (txs []EthTransaction, err error) {
+// getPagedTransactions execute GET query and parse possible responses, the
+// temporary errors are retried
+func (c EtherscanClient) getPagedTransactions(action string, address Address, startBlock uint64, page, offset int) (txs []EthTransaction, err error) {
+	delay := c.RetryDelay
+	for attempt := 0; ; attempt++ {
+		txs, err = c.getPage(action, address, startBlock, page, offset)
+		e, ok := err.(*EtherscanError)
+		if !ok || !e.Temporary() || attempt >= c.Retries {
+			return
+		}
+		wait := jitter(delay)
+		log.Warnf("retrying %s in %s: %v", action, wait, err)
+		time.Sleep(wait)
+		delay *= 2
+	}
+}
 
+// getPage execute a GET query, when the limiter allows it, the transactions
+// are sorted by block from startBlock
+func (c EtherscanClient) getPage(action string, address Address, startBlock uint64, page, offset int) (txs []EthTransaction, err error) {
+	fail := func(kind error, message string) error {
+		return &EtherscanError{Action: action, Address: address, Message: message, Err: kind}
+	}
 	req, err := http.NewRequest("GET", c.APIEndpoint, nil)
 	if err != nil {
 		return
@@ -137,38 +470,75 @@ func (c EtherscanClient) getPagedTransactions(address Address, page, offset int)
 
 	q := req.URL.Query()
 	q.Add("module", "account")
-	q.Add("action", "txlist")
+	q.Add("action", action)
 	q.Add("address", string(address))
 	q.Add("apikey", c.APIToken)
+	q.Add("startblock", fmt.Sprint(startBlock))
+	q.Add("endblock", "99999999")
+	q.Add("sort", "asc")
 	q.Add("page", fmt.Sprint(page))     // which page
 	q.Add("offset", fmt.Sprint(offset)) // how many items
 	req.URL.RawQuery = q.Encode()
 
+	c.limiter.Wait()
 	res, err := c.HTTPCli.Do(req)
 	if err != nil {
-		return
+		return nil, fail(ErrEtherscanUnavailable, err.Error())
 	}
+	defer res.Body.Close()
 	data, err := ioutil.ReadAll(res.Body)
 	if err != nil {
-		log.Error("cannot read response body from etherscan", err)
-		return
+		return nil, fail(ErrEtherscanUnavailable, err.Error())
+	}
+	switch {
+	case res.StatusCode == http.StatusTooManyRequests:
+		return nil, fail(ErrEtherscanRateLimit, res.Status)
+	case res.StatusCode == http.StatusUnauthorized || res.StatusCode == http.StatusForbidden:
+		return nil, fail(ErrEtherscanAPIKey, res.Status)
+	case res.StatusCode != http.StatusOK:
+		return nil, fail(ErrEtherscanUnavailable, res.Status)
 	}
 
 	var r EtherscanReply
-	err = json.Unmarshal(data, &r)
-	txs = r.Result
+	if err = json.Unmarshal(data, &r); err != nil {
+		// e.g. the html page of a proxy
+		return nil, fail(ErrEtherscanUnavailable, err.Error())
+	}
+	if r.Status == "0" && len(r.Result) > 0 && r.Result[0] == '"' {
+		// the result is the description of the error
+		var detail string
+		json.Unmarshal(r.Result, &detail)
+		return nil, fail(classifyEtherscanError(detail), strings.TrimSpace(r.Message+": "+detail))
+	}
+	if len(r.Result) > 0 {
+		if err = json.Unmarshal(r.Result, &txs); err != nil {
+			return nil, fail(ErrEtherscanQuery, err.Error())
+		}
+	}
+	for i := range txs {
+		txs[i].Kind = action
+	}
 
 	// if no more transactions are found, r.status will also be 0
-	if offset*page >= 10000 || r.Message == "No transactions found" && len(txs) == 0 {
+	if r.Message == "No transactions found" && len(txs) == 0 {
+		return txs, &NoMoreTransactionsError{
+			address: address,
+			page:    page,
+			offset:  offset,
+		}
+	}
+	// the next page would be past the cap
+	if offset*(page+1) > c.RecordsCap {
 		return txs, &NoMoreTransactionsError{
 			address: address,
 			page:    page,
 			offset:  offset,
+			capped:  len(txs) == offset,
 		}
 	}
 
 	if r.Status == "0" {
-		return txs, fmt.Errorf(r.Message)
+		return txs, fail(classifyEtherscanError(r.Message), r.Message)
 	}
 	return
 
@@ -1,17 +1,316 @@
 package collector
 
 import (
-	"os"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"sync"
 	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
 )
 
 func TestEtherscanClientGetPagedTransactions(t *testing.T) {
-	apiKey := os.Getenv("ETHERSCAN_API_TOKEN")
-
-	c := NewEtherscanClient(apiKey)
+	node := &chainEtherscan{cap: EtherscanRecordsCap}
+	for i := 0; i < 250; i++ {
+		node.txs = append(node.txs, EthTransaction{BlockNumber: fmt.Sprint(i / 3), Hash: fmt.Sprintf("0x%03x", i)})
+	}
+	api := httptest.NewServer(node)
+	defer api.Close()
+	c := NewEtherscanClient("key")
+	c.APIEndpoint = api.URL
+	c.Retries, c.RetryDelay = 1, time.Millisecond
+	c.SetRateLimit(0)
 	c.PageSize = 100
-	_, err := c.GetTransactions("0xddbd2b932c763ba5b1b7ae3b362eac3e8d40121a")
+	txs, _, err := c.GetTransactions("0xddbd2b932c763ba5b1b7ae3b362eac3e8d40121a")
 	if err != nil {
 		t.Error(err)
 	}
+	assert.Len(t, txs, 250)
+}
+
+// fakeEtherscan serve the account actions of an address, one page each
+func fakeEtherscan(t *testing.T, results map[string]string) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		q := r.URL.Query()
+		assert.Equal(t, "account", q.Get("module"))
+		result, found := results[q.Get("action")]
+		if !found || q.Get("page") != "1" {
+			fmt.Fprint(w, `{"status":"0","message":"No transactions found","result":[]}`)
+			return
+		}
+		fmt.Fprintf(w, `{"status":"1","message":"OK","result":%s}`, result)
+	}))
+}
+
+func TestEtherscanClientGetTimeline(t *testing.T) {
+	subject := Address("0x00000000000000000000000000000000000000aa")
+	api := fakeEtherscan(t, map[string]string{
+		EtherscanTxList: `[
+			{"blockNumber":"12","hash":"0x02","transactionIndex":"5","from":"0x00000000000000000000000000000000000000aa","to":"0x00000000000000000000000000000000000000c1","value":"0"},
+			{"blockNumber":"10","hash":"0x01","transactionIndex":"3","from":"0x00000000000000000000000000000000000000aa","to":"0x00000000000000000000000000000000000000c1","value":"1000"}
+		]`,
+		EtherscanTxListInternal: `[
+			{"blockNumber":"12","hash":"0x02","from":"0x00000000000000000000000000000000000000c1","to":"0x00000000000000000000000000000000000000aa","value":"500","type":"call","traceId":"0_1"}
+		]`,
+		EtherscanTokenTx: `[
+			{"blockNumber":"12","hash":"0x02","transactionIndex":"5","from":"0x00000000000000000000000000000000000000aa","to":"0x00000000000000000000000000000000000000c2","value":"1500000","contractAddress":"0x00000000000000000000000000000000000000d1","tokenName":"USD Coin","tokenSymbol":"USDC","tokenDecimal":"6"},
+			{"blockNumber":"11","hash":"0x03","transactionIndex":"0","from":"0x00000000000000000000000000000000000000c2","to":"0x00000000000000000000000000000000000000aa","value":"7","contractAddress":"0x00000000000000000000000000000000000000d1","tokenName":"USD Coin","tokenSymbol":"USDC","tokenDecimal":"6"}
+		]`,
+		EtherscanTokenNFTTx: `[
+			{"blockNumber":"11","hash":"0x04","transactionIndex":"1","from":"0x00000000000000000000000000000000000000c3","to":"0x00000000000000000000000000000000000000aa","contractAddress":"0x00000000000000000000000000000000000000d2","tokenName":"Punks","tokenSymbol":"PUNK","tokenID":"42"}
+		]`,
+	})
+	defer api.Close()
+	c := NewEtherscanClient("")
+	c.APIEndpoint = api.URL
+	c.SetRateLimit(0)
+
+	internal, _, err := c.GetInternalTransactions(subject)
+	assert.Nil(t, err)
+	if assert.Len(t, internal, 1) {
+		assert.Equal(t, EtherscanTxListInternal, internal[0].Kind)
+		assert.Equal(t, "0_1", internal[0].TraceID)
+	}
+
+	timeline, _, err := c.GetTimeline(subject)
+	assert.Nil(t, err)
+	var got []string
+	for _, tx := range timeline {
+		got = append(got, tx.Hash+" "+tx.Kind)
+	}
+	// by block and position, the tx before its internal calls and transfers
+	assert.Equal(t, []string{
+		"0x01 txlist",
+		"0x03 tokentx",
+		"0x04 tokennfttx",
+		"0x02 txlist",
+		"0x02 txlistinternal",
+		"0x02 tokentx",
+	}, got)
+
+	// the token amounts are in the actions
+	a := timeline[5].Action(subject, NewTrustEntity("subject"), NewTrustEntity("pool"))
+	assert.Equal(t, ActionTransfer, a.Type)
+	if assert.Len(t, a.AssetsOut, 1) {
+		assert.Equal(t, "USDC", a.AssetsOut[0].Symbol)
+		assert.Equal(t, "1.5", a.AssetsOut[0].Value)
+	}
+	a = timeline[2].Action(subject, NewTrustEntity("subject"), NewTrustEntity("seller"))
+	if assert.Len(t, a.AssetsIn, 1) {
+		assert.Equal(t, "42", a.AssetsIn[0].TokenID)
+	}
+	a = timeline[4].Action(subject, NewTrustEntity("subject"), NewTrustEntity("pool"))
+	assert.Equal(t, ActionInteraction, a.Type)
+	assert.Equal(t, []AssetAmount{{Asset: "ETH", Symbol: "ETH", Amount: "500"}}, a.AssetsIn)
+
+	// the scan posts a changeset per tx of the timeline
+	var keys []string
+	rels := make(map[string]int)
+	_, err = (&Explorer{Client: c, Emit: func(cs *TrustAPIChangeSet) {
+		// on mainnet
+		for _, r := range cs.Relationship {
+			assert.Equal(t, uint64(1), r.Properties["chainId"])
+			assert.Equal(t, "mainnet", r.Properties["network"])
+		}
+		for _, e := range cs.Entities {
+			assert.Equal(t, uint64(1), e.Properties["chainId"])
+		}
+		if cs.Key != "" {
+			keys = append(keys, cs.Key)
+			rels[cs.Key] = len(cs.Relationship)
+		}
+	}}).Explore(subject)
+	assert.Nil(t, err)
+	assert.Equal(t, []string{
+		TxPostKey("0x01", subject),
+		TxPostKey("0x03", subject),
+		TxPostKey("0x04", subject),
+		TxPostKey("0x02", subject),
+	}, keys)
+	assert.Equal(t, 3, rels[TxPostKey("0x02", subject)])
+}
+
+func TestEtherscanClientErrors(t *testing.T) {
+	var m sync.Mutex
+	requests := make(map[string]int)
+	api := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		m.Lock()
+		defer m.Unlock()
+		q := r.URL.Query()
+		address := q.Get("address")
+		requests[address]++
+		switch address {
+		case "0x01":
+			switch {
+			case requests[address] <= 2:
+				fmt.Fprint(w, `{"status":"0","message":"NOTOK","result":"Max rate limit reached"}`)
+			case q.Get("page") == "1":
+				fmt.Fprint(w, `{"status":"1","message":"OK","result":[{"blockNumber":"1","hash":"0x0a"}]}`)
+			default:
+				fmt.Fprint(w, `{"status":"0","message":"No transactions found","result":[]}`)
+			}
+		case "0x02":
+			fmt.Fprint(w, `{"status":"0","message":"NOTOK","result":"Invalid API Key"}`)
+		case "0x03":
+			w.WriteHeader(http.StatusBadGateway)
+		case "0x04":
+			fmt.Fprint(w, `{"status":"0","message":"NOTOK","result":"Error! Invalid address format"}`)
+		}
+	}))
+	defer api.Close()
+	c := NewEtherscanClient("key")
+	c.APIEndpoint = api.URL
+	c.Retries, c.RetryDelay = 3, time.Millisecond
+	c.SetRateLimit(0)
+	count := func(address string) int {
+		m.Lock()
+		defer m.Unlock()
+		return requests[address]
+	}
+
+	// the rate limited queries are retried
+	txs, _, err := c.GetTransactions("0x01")
+	assert.Nil(t, err)
+	assert.Len(t, txs, 1)
+	// a short page is the last one
+	assert.Equal(t, 3, count("0x01"))
+
+	// an invalid key is not retried
+	_, _, err = c.GetTransactions("0x02")
+	assert.True(t, errors.Is(err, ErrEtherscanAPIKey), "%v", err)
+	assert.Equal(t, 1, count("0x02"))
+
+	// a server that keeps failing is retried up to the retries
+	_, _, err = c.GetTransactions("0x03")
+	assert.True(t, errors.Is(err, ErrEtherscanUnavailable), "%v", err)
+	assert.Equal(t, 4, count("0x03"))
+
+	// a rejected query is not retried
+	_, _, err = c.GetTransactions("0x04")
+	assert.True(t, errors.Is(err, ErrEtherscanQuery), "%v", err)
+	var e *EtherscanError
+	if assert.True(t, errors.As(err, &e)) {
+		assert.Equal(t, Address("0x04"), e.Address)
+		assert.Contains(t, e.Message, "Invalid address format")
+	}
+	assert.Equal(t, 1, count("0x04"))
+}
+
+func TestEtherscanClientRateLimit(t *testing.T) {
+	api := fakeEtherscan(t, map[string]string{})
+	defer api.Close()
+	c := NewEtherscanClient("key")
+	c.APIEndpoint = api.URL
+	c.SetRateLimit(50)
+	// the copies of the client share the limiter
+	copied := *c
+	started := time.Now()
+	for i := 0; i < 3; i++ {
+		c.GetTransactions("0x01")
+		copied.GetTransactions("0x01")
+	}
+	// 6 calls at 50 per second
+	assert.GreaterOrEqual(t, time.Since(started), 100*time.Millisecond)
+}
+
+// chainEtherscan serve the txlist of an address from a list of transactions
+// sorted by block, with the records cap of etherscan
+type chainEtherscan struct {
+	m      sync.Mutex
+	txs    []EthTransaction
+	starts []string
+	// cap the records returned for a query
+	cap int
+}
+
+func (e *chainEtherscan) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	e.m.Lock()
+	defer e.m.Unlock()
+	q := r.URL.Query()
+	start, _ := strconv.ParseUint(q.Get("startblock"), 10, 64)
+	page, _ := strconv.Atoi(q.Get("page"))
+	offset, _ := strconv.Atoi(q.Get("offset"))
+	if page == 1 {
+		e.starts = append(e.starts, q.Get("startblock"))
+	}
+	if page*offset > e.cap {
+		fmt.Fprint(w, `{"status":"0","message":"NOTOK","result":"Result window is too large"}`)
+		return
+	}
+	var window []EthTransaction
+	for _, tx := range e.txs {
+		if tx.block() >= start {
+			window = append(window, tx)
+		}
+	}
+	from, to := (page-1)*offset, page*offset
+	if from >= len(window) {
+		fmt.Fprint(w, `{"status":"0","message":"No transactions found","result":[]}`)
+		return
+	}
+	if to > len(window) {
+		to = len(window)
+	}
+	result, _ := json.Marshal(window[from:to])
+	fmt.Fprintf(w, `{"status":"1","message":"OK","result":%s}`, result)
+}
+
+func TestEtherscanClientBlockWindows(t *testing.T) {
+	s, err := OpenStore(t.TempDir())
+	assert.Nil(t, err)
+	defer s.Close()
+	defer func(s *Store) { store = s }(store)
+	store = s
+
+	node := &chainEtherscan{cap: 8}
+	for i, b := range []uint64{1, 1, 2, 3, 3, 3, 3, 4, 5, 5, 6, 7, 7, 7, 8} {
+		node.txs = append(node.txs, EthTransaction{BlockNumber: fmt.Sprint(b), Hash: fmt.Sprintf("0x%02x", i)})
+	}
+	api := httptest.NewServer(node)
+	defer api.Close()
+	c := NewEtherscanClient("key")
+	c.APIEndpoint = api.URL
+	c.PageSize = 4
+	c.RecordsCap = 8
+	c.SetRateLimit(0)
+	c.Incremental = true
+
+	// the windows start from the last block of the previous one, its
+	// transactions are not repeated
+	txs, seen, err := c.GetTransactions("0x01")
+	assert.Nil(t, err)
+	if assert.Len(t, txs, len(node.txs)) {
+		for i, tx := range txs {
+			assert.Equal(t, fmt.Sprintf("0x%02x", i), tx.Hash)
+		}
+	}
+	assert.Equal(t, []string{"0", "4", "8"}, node.starts)
+	assert.Equal(t, LastSeen{EtherscanTxList + ":0x01": 8}, seen)
+
+	// the last block is not saved until the transactions are processed
+	node.m.Lock()
+	node.starts = nil
+	node.m.Unlock()
+	_, _, err = c.GetTransactions("0x01")
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"0", "4", "8"}, node.starts)
+
+	// the next fetch starts from the last block saved
+	seen.Save()
+	node.m.Lock()
+	node.txs = append(node.txs,
+		EthTransaction{BlockNumber: "8", Hash: "0x20"},
+		EthTransaction{BlockNumber: "9", Hash: "0x21"},
+	)
+	node.starts = nil
+	node.m.Unlock()
+	txs, _, err = c.GetTransactions("0x01")
+	assert.Nil(t, err)
+	assert.Len(t, txs, 3)
+	assert.Equal(t, []string{"8"}, node.starts)
 }
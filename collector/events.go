@@ -0,0 +1,126 @@
+package collector
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/ethereum/go-ethereum/accounts/abi"
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/crypto"
+)
+
+// EventTopic the topic of an event, the event is a topic hash, a signature
+// like Swap(address,uint256,uint256,uint256,uint256,address) or a name to look
+// up in the abis and in the known events
+func EventTopic(event string, abis ...*abi.ABI) (topics []common.Hash, err error) {
+	event = strings.TrimSpace(event)
+	switch {
+	case strings.HasPrefix(event, "0x") && len(event) == 2*common.HashLength+2:
+		return []common.Hash{common.HexToHash(event)}, nil
+	case strings.Contains(event, "("):
+		signature := strings.Join(strings.Fields(event), "")
+		return []common.Hash{crypto.Keccak256Hash([]byte(signature))}, nil
+	}
+	// a name matches the overloaded events too
+	for _, a := range abis {
+		for _, ev := range a.Events {
+			if ev.RawName == event && !containsHash(topics, ev.ID) {
+				topics = append(topics, ev.ID)
+			}
+		}
+	}
+	if len(topics) > 0 {
+		return
+	}
+	for topic, name := range eventNames {
+		if name == event {
+			topics = append(topics, common.HexToHash(topic))
+		}
+	}
+	if len(topics) == 0 {
+		err = fmt.Errorf("unknown event '%s'", event)
+	}
+	return
+}
+
+// containsHash tells if the hash is in the list
+func containsHash(hashes []common.Hash, hash common.Hash) bool {
+	for _, h := range hashes {
+		if h == hash {
+			return true
+		}
+	}
+	return false
+}
+
+// protocolTopics the topics of the events of the protocol, the names are
+// looked up in the abis registered for its filters on the chain, nil if the
+// protocol does not list its events
+func (c *Chain) protocolTopics(p Protocol) (topics []common.Hash, err error) {
+	if len(p.Events) == 0 {
+		return
+	}
+	var abis []*abi.ABI
+	for address := range p.Filters {
+		if a := c.contractABI(address); a != nil {
+			abis = append(abis, a)
+		}
+	}
+	for _, event := range p.Events {
+		found, err := EventTopic(event, abis...)
+		if err != nil {
+			return nil, fmt.Errorf("%v for protocol %s", err, p.Name)
+		}
+		for _, t := range found {
+			if !containsHash(topics, t) {
+				topics = append(topics, t)
+			}
+		}
+	}
+	return
+}
+
+// registerTopics set the events followed for the filters and the factories
+// of the protocol, the factories are followed for their creation event too
+func (c *Chain) registerTopics(p Protocol) (err error) {
+	topics, err := c.protocolTopics(p)
+	if err != nil {
+		return
+	}
+	for address := range p.Filters {
+		c.setTopics(address, topics)
+	}
+	for _, f := range p.Factories {
+		factoryTopics := topics
+		if topics != nil {
+			a := c.contractABI(f.Address)
+			if a == nil {
+				return fmt.Errorf("no abi for factory %s of protocol %s", f.Address, p.Name)
+			}
+			factoryTopics = append([]common.Hash{a.Events[f.Event].ID}, topics...)
+		}
+		c.setTopics(f.Address, factoryTopics)
+	}
+	return
+}
+
+// setTopics set the events followed for an address, nil for all of them
+func (c *Chain) setTopics(address string, topics []common.Hash) {
+	s := c.state()
+	s.eventTopicsM.Lock()
+	defer s.eventTopicsM.Unlock()
+	address = strings.ToLower(address)
+	if topics == nil {
+		delete(s.eventTopics, address)
+		return
+	}
+	s.eventTopics[address] = topics
+}
+
+// topicsOf the topics of the events followed for an address, nil for all
+func (c *Chain) topicsOf(address common.Address) []common.Hash {
+	s := c.state()
+	s.eventTopicsM.RLock()
+	defer s.eventTopicsM.RUnlock()
+	return s.eventTopics[strings.ToLower(address.Hex())]
+}
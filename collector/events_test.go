@@ -0,0 +1,87 @@
+package collector
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/ethereum/go-ethereum"
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/crypto"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestEventTopic(t *testing.T) {
+	a, err := ReadABI("../abis/uniswap_v3_pool.json")
+	assert.Nil(t, err)
+	swap := a.Events["Swap"].ID
+
+	// by name, from the abi
+	topics, err := EventTopic("Swap", a)
+	assert.Nil(t, err)
+	assert.Equal(t, []common.Hash{swap}, topics)
+	// by signature, spaces are ignored
+	topics, err = EventTopic("Swap(address, address, int256, int256, uint160, uint128, int24)")
+	assert.Nil(t, err)
+	assert.Equal(t, []common.Hash{swap}, topics)
+	// by topic
+	topics, err = EventTopic(swap.Hex())
+	assert.Nil(t, err)
+	assert.Equal(t, []common.Hash{swap}, topics)
+	// by name, from the known events
+	topics, err = EventTopic("Approval")
+	assert.Nil(t, err)
+	assert.Equal(t, []common.Hash{crypto.Keccak256Hash([]byte("Approval(address,address,uint256)"))}, topics)
+
+	_, err = EventTopic("Unknown", a)
+	assert.Error(t, err)
+}
+
+func TestRegisterTopics(t *testing.T) {
+	factoryAddress := "0x1F98431c8aD98523631AE4a59f267346ea31F984"
+	poolAddress := "0x88e6a0c2ddd26feeb64f039a2c41296fcb3f5640"
+	other := common.HexToAddress("0x00000000000000000000000000000000000e0e01")
+	p := Protocol{
+		Name:        "Uniswap V3",
+		MainAddress: "0xE592427A0AEce92De3Edee1F18E0157C05861564",
+		ABI:         "abis/uniswap_v3_pool.json",
+		Filters:     map[string]string{poolAddress: "Uniswap V3 WETH/USDC"},
+		Factories: []Factory{
+			{Address: factoryAddress, Event: "PoolCreated", Argument: "pool", ABI: "abis/uniswap_v3_factory.json"},
+		},
+		Events: []string{"Swap", "Mint"},
+	}
+	defer Mainnet.unregisterAddresses([]common.Address{common.HexToAddress(poolAddress), common.HexToAddress(factoryAddress)})
+	defer Mainnet.unregisterFactories(p)
+	assert.Nil(t, Mainnet.LoadABIs(p, ".."))
+	assert.Nil(t, Mainnet.registerFactories(p, ".."))
+	assert.Nil(t, Mainnet.registerTopics(p))
+
+	pool, err := ReadABI("../abis/uniswap_v3_pool.json")
+	assert.Nil(t, err)
+	factory, err := ReadABI("../abis/uniswap_v3_factory.json")
+	assert.Nil(t, err)
+	events := []common.Hash{pool.Events["Swap"].ID, pool.Events["Mint"].ID}
+	assert.Equal(t, events, Mainnet.topicsOf(common.HexToAddress(poolAddress)))
+	// the factory is followed for the pool creation too
+	assert.Equal(t, append([]common.Hash{factory.Events["PoolCreated"].ID}, events...), Mainnet.topicsOf(common.HexToAddress(factoryAddress)))
+	assert.Nil(t, Mainnet.topicsOf(other))
+
+	// the addresses that follow different events have their own query
+	shards := shard(ethereum.FilterQuery{Addresses: []common.Address{common.HexToAddress(poolAddress), other, common.HexToAddress(factoryAddress)}}, 0, nil)
+	if assert.Len(t, shards, 3) {
+		assert.Equal(t, [][]common.Hash{events}, shards[0].Topics)
+		assert.Nil(t, shards[1].Topics)
+		assert.Equal(t, []common.Address{other}, shards[1].Addresses)
+	}
+
+	// the discovered pools follow the events of the protocol
+	discovered := common.HexToAddress("0x00000000000000000000000000000000000b0a12")
+	defer Mainnet.unregisterAddresses([]common.Address{discovered})
+	assert.True(t, Mainnet.registerPool(Pool{Address: strings.ToLower(discovered.Hex()), Factory: strings.ToLower(factoryAddress), Protocol: p.Name}))
+	assert.Equal(t, events, Mainnet.topicsOf(discovered))
+
+	// an unknown event is an error
+	bad := p
+	bad.Events = []string{"Sync"}
+	assert.Error(t, Mainnet.registerTopics(bad))
+}
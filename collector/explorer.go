@@ -0,0 +1,238 @@
+package collector
+
+import (
+	"errors"
+	"sync/atomic"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/utu-crowdsale/defi-portal-scanner/config"
+)
+
+// Explorer walk the counterparties of an address breadth first, within the
+// budget of a scan
+type Explorer struct {
+	Client *EtherscanClient
+	// Node classifies the explored addresses, it can be nil
+	Node CodeReader
+	// Depth the levels of counterparties explored, 0 is the address only
+	Depth int
+	// MaxNodes the addresses explored at most, 0 for no limit
+	MaxNodes int
+	// FanOut the new counterparties explored at each level, 0 for no
+	// limit
+	FanOut int
+	// Emit is called with the changesets of the explored addresses, they
+	// are queued to the processor when it is nil
+	Emit func(cs *TrustAPIChangeSet)
+	// Progress is called after every explored address with the error of
+	// the address, it can be nil
+	Progress func(report ExploreReport, err error)
+	skip     map[Address]bool
+}
+
+// ExploreReport how much of the budget a scan used
+type ExploreReport struct {
+	Address Address `json:"address"`
+	// Nodes the addresses explored
+	Nodes    int `json:"nodes"`
+	MaxNodes int `json:"max_nodes"`
+	// Levels the levels of counterparties reached
+	Levels int `json:"levels"`
+	Depth  int `json:"depth"`
+	// Skipped the hub addresses that have not been explored
+	Skipped int `json:"skipped"`
+	// Capped the counterparties left out by the fan out
+	Capped int `json:"capped"`
+	// Truncated the counterparties left out by the max nodes
+	Truncated int `json:"truncated"`
+	// Errors the addresses that could not be explored
+	Errors int `json:"errors"`
+	// the changesets posted: the txs, the new entities and the
+	// relationships
+	Transactions  int `json:"transactions"`
+	Entities      int `json:"entities"`
+	Relationships int `json:"relationships"`
+}
+
+// NewExplorer create an explorer with the budget of the configuration
+func NewExplorer(cfg config.ScanSchema, client *EtherscanClient, node CodeReader) *Explorer {
+	e := &Explorer{
+		Client:   client,
+		Node:     node,
+		Depth:    cfg.Depth,
+		MaxNodes: cfg.MaxNodes,
+		FanOut:   cfg.FanOut,
+		skip:     make(map[Address]bool),
+	}
+	for _, a := range cfg.Skip {
+		e.skip[NewAddressFromString(a)] = true
+	}
+	return e
+}
+
+// Skip tells if an address is never explored
+func (e *Explorer) Skip(a Address) bool {
+	return e.skip[NewAddressFromString(string(a))]
+}
+
+// Explore post the relationships of an address and of its counterparties,
+// level by level; the error is set when the exploration had to stop
+func (e *Explorer) Explore(a Address) (report ExploreReport, err error) {
+	report = ExploreReport{Address: a, MaxNodes: e.MaxNodes, Depth: e.Depth}
+	defer func() {
+		log.Infof("explored %s: %d/%d nodes, %d/%d levels, %d skipped, %d capped, %d truncated, %d errors",
+			a, report.Nodes, report.MaxNodes, report.Levels, report.Depth, report.Skipped, report.Capped, report.Truncated, report.Errors)
+	}()
+	if e.Skip(a) {
+		report.Skipped++
+		return
+	}
+	visited := map[Address]bool{a: true}
+	level := []Address{a}
+	for depth := 0; depth <= e.Depth && len(level) > 0; depth++ {
+		var next []Address
+		for i, x := range level {
+			if e.MaxNodes > 0 && report.Nodes >= e.MaxNodes {
+				report.Truncated += len(level) - i + len(next)
+				return
+			}
+			report.Nodes++
+			report.Levels = depth
+			counterparties, vErr := e.visit(x, &report)
+			if e.Progress != nil {
+				e.Progress(report, vErr)
+			}
+			if vErr != nil {
+				report.Errors++
+				// every other query would fail the same way
+				if errors.Is(vErr, ErrEtherscanAPIKey) {
+					err = vErr
+					return
+				}
+				continue
+			}
+			if depth == e.Depth {
+				continue
+			}
+			for _, c := range counterparties {
+				if visited[c] {
+					continue
+				}
+				visited[c] = true
+				if e.Skip(c) {
+					report.Skipped++
+					continue
+				}
+				if e.FanOut > 0 && len(next) >= e.FanOut {
+					report.Capped++
+					continue
+				}
+				next = append(next, c)
+			}
+		}
+		level = next
+	}
+	return
+}
+
+// emit tag a changeset with the chain of the scans and pass it to Emit, or
+// queue it to the processor
+func (e *Explorer) emit(cs *TrustAPIChangeSet) {
+	Mainnet.Tag(cs)
+	if e.Emit != nil {
+		e.Emit(cs)
+		return
+	}
+	csQueue <- cs
+}
+
+// visit post the relationships of an address, one changeset per tx, and
+// return its counterparties in the order of the timeline, the changesets
+// are counted in the report. The last blocks fetched are saved once all the
+// changesets of the address have been posted, so the txs of a changeset that
+// failed are fetched again by the next scan.
+func (e *Explorer) visit(a Address, report *ExploreReport) (counterparties []Address, err error) {
+	// create the source criteria
+	sc, isNew := Mainnet.criteria(a, e.Node)
+	// it's a contract
+	if sc.Type == TypeDefiProtocol {
+		return
+	}
+	if isNew {
+		sc.Name = string(a)
+		e.emit(NewChangeset(sc))
+		report.Entities++
+	}
+	// retrieve the address transactions, internal calls and token transfers
+	txs, seen, err := e.Client.GetTimeline(a)
+	switch {
+	case errors.Is(err, ErrEtherscanAPIKey):
+		log.Error("cannot scan, check the etherscan api key: ", err)
+		return
+	case errors.Is(err, ErrEtherscanRateLimit):
+		log.Error("cannot scan, the etherscan rate limit is lower than configured: ", err)
+		return
+	case err != nil:
+		log.Error("error retrieving transactions: ", err)
+		return
+	}
+	// the changesets not posted yet, and the visit itself
+	pending := int32(1)
+	posted := func() {
+		if atomic.AddInt32(&pending, -1) == 0 {
+			seen.Save()
+		}
+	}
+	defer posted()
+	// process the relationships, one changeset per tx
+	known := make(map[Address]bool)
+	var src, dst Address
+	var cs *TrustAPIChangeSet
+	flush := func() {
+		if cs != nil && len(cs.Relationship) > 0 {
+			report.Transactions++
+			report.Entities += len(cs.Entities)
+			report.Relationships += len(cs.Relationship)
+			atomic.AddInt32(&pending, 1)
+			cs.onPosted(posted)
+			// add to the processed list
+			e.emit(cs)
+		}
+		cs = nil
+	}
+	for _, y := range txs {
+		if cs != nil && cs.Key != TxPostKey(y.Hash, a) {
+			flush()
+		}
+		if cs == nil {
+			cs = NewChangeset()
+			cs.Key = TxPostKey(y.Hash, a)
+		}
+		src, dst = y.From, y.To
+		// if source is eq destination skip it
+		if src == dst {
+			continue
+		}
+		// the subject address is always the sender
+		if src != a {
+			src, dst = y.To, y.From
+		}
+		// a transfer between other addresses or a contract creation
+		if src != a || dst == "" {
+			continue
+		}
+		dc, isNew := Mainnet.criteria(dst, e.Node)
+		if isNew {
+			dc.Name = string(dst)
+			cs.AddEntity(dc)
+		}
+		// the sender is the source
+		cs.AddRel(y.Action(a, sc, dc).Relationship())
+		if !known[dst] {
+			known[dst] = true
+			counterparties = append(counterparties, dst)
+		}
+	}
+	flush()
+	return
+}
@@ -0,0 +1,150 @@
+package collector
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/utu-crowdsale/defi-portal-scanner/config"
+)
+
+// graphEtherscan serve the txs of the addresses of a graph, the queried
+// addresses are recorded in order
+func graphEtherscan(graph map[Address][]Address) (api *httptest.Server, queried func() []Address) {
+	var m sync.Mutex
+	var addresses []Address
+	api = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		q := r.URL.Query()
+		a := Address(q.Get("address"))
+		if q.Get("action") != EtherscanTxList || q.Get("page") != "1" {
+			fmt.Fprint(w, `{"status":"0","message":"No transactions found","result":[]}`)
+			return
+		}
+		m.Lock()
+		addresses = append(addresses, a)
+		m.Unlock()
+		if len(graph[a]) == 0 {
+			fmt.Fprint(w, `{"status":"0","message":"No transactions found","result":[]}`)
+			return
+		}
+		var txs []string
+		for i, c := range graph[a] {
+			txs = append(txs, fmt.Sprintf(`{"blockNumber":"%d","hash":"%s%d","from":"%s","to":"%s","value":"1"}`, i, a, i, a, c))
+		}
+		fmt.Fprintf(w, `{"status":"1","message":"OK","result":[%s]}`, strings.Join(txs, ","))
+	}))
+	queried = func() []Address {
+		m.Lock()
+		defer m.Unlock()
+		q := addresses
+		addresses = nil
+		return q
+	}
+	return
+}
+
+func TestExplorer(t *testing.T) {
+	a := func(n int) Address { return Address(fmt.Sprintf("0x%040x", 0xe0e000+n)) }
+	root, hub := a(0), a(99)
+	graph := map[Address][]Address{
+		root:  {a(1), a(2), hub, a(3)},
+		a(1):  {a(11), a(12), root},
+		a(2):  {a(21), a(1)},
+		a(3):  {a(31)},
+		hub:   {a(91), a(92)},
+		a(11): {a(111)},
+	}
+	api, queried := graphEtherscan(graph)
+	defer api.Close()
+	client := NewEtherscanClient("")
+	client.APIEndpoint = api.URL
+	client.SetRateLimit(0)
+	explorer := NewExplorer(config.ScanSchema{Depth: 2, Skip: []string{strings.ToUpper(string(hub))}}, client, nil)
+	explorer.Emit = func(cs *TrustAPIChangeSet) {}
+
+	// level by level, the hub is not explored
+	report, err := explorer.Explore(root)
+	assert.Nil(t, err)
+	assert.Equal(t, []Address{root, a(1), a(2), a(3), a(11), a(12), a(21), a(31)}, queried())
+	// a changeset for each tx and for the root, every address is a new entity
+	assert.Equal(t, ExploreReport{Address: root, Nodes: 8, Levels: 2, Depth: 2, Skipped: 1, Transactions: 11, Entities: 10, Relationships: 11}, report)
+
+	// the fan out caps the counterparties of every address
+	explorer.FanOut = 1
+	report, err = explorer.Explore(root)
+	assert.Nil(t, err)
+	assert.Equal(t, []Address{root, a(1), a(11)}, queried())
+	assert.Equal(t, 1, report.Skipped)
+	assert.Equal(t, 2+1, report.Capped)
+
+	// the fan out caps the counterparties of every level, not of an address
+	explorer.FanOut = 2
+	report, err = explorer.Explore(root)
+	assert.Nil(t, err)
+	assert.Equal(t, []Address{root, a(1), a(2), a(11), a(12)}, queried())
+	// a(3) of the first level, a(21) of the second
+	assert.Equal(t, 1+1, report.Capped)
+
+	// the max nodes stops the walk
+	explorer.FanOut = 0
+	explorer.MaxNodes = 3
+	report, err = explorer.Explore(root)
+	assert.Nil(t, err)
+	assert.Equal(t, []Address{root, a(1), a(2)}, queried())
+	assert.Equal(t, 3, report.Nodes)
+	assert.Equal(t, 1, report.Levels)
+	// a(3) of the first level, a(11), a(12) and a(21) of the second
+	assert.Equal(t, 4, report.Truncated)
+
+	// a hub is not explored even when scanned
+	report, err = explorer.Explore(hub)
+	assert.Nil(t, err)
+	assert.Empty(t, queried())
+	assert.Equal(t, 1, report.Skipped)
+}
+
+func TestExplorerLastSeen(t *testing.T) {
+	s, err := OpenStore(t.TempDir())
+	assert.Nil(t, err)
+	defer s.Close()
+	defer func(s *Store) { store = s }(store)
+	store = s
+
+	root := Address(fmt.Sprintf("0x%040x", 0xe1e000))
+	api, _ := graphEtherscan(map[Address][]Address{
+		root: {Address(fmt.Sprintf("0x%040x", 0xe1e001)), Address(fmt.Sprintf("0x%040x", 0xe1e002))},
+	})
+	defer api.Close()
+	client := NewEtherscanClient("")
+	client.APIEndpoint = api.URL
+	client.SetRateLimit(0)
+	client.Incremental = true
+	var queued []*TrustAPIChangeSet
+	explorer := NewExplorer(config.ScanSchema{}, client, nil)
+	explorer.Emit = func(cs *TrustAPIChangeSet) {
+		queued = append(queued, cs)
+	}
+
+	lastSeen := func() (block uint64, found bool) {
+		found, err := store.Get(lastSeenBucket, EtherscanTxList+":"+string(root), &block)
+		assert.Nil(t, err)
+		return
+	}
+	_, err = explorer.Explore(root)
+	assert.Nil(t, err)
+	if !assert.Len(t, queued, 3) {
+		return
+	}
+	// nothing is saved until all the txs of the address are posted
+	queued[1].acknowledge()
+	_, found := lastSeen()
+	assert.False(t, found)
+	queued[2].acknowledge()
+	block, found := lastSeen()
+	assert.True(t, found)
+	assert.Equal(t, uint64(1), block)
+}
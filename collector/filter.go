@@ -0,0 +1,220 @@
+package collector
+
+import (
+	"context"
+	"math/big"
+	"sync"
+
+	"github.com/ethereum/go-ethereum"
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/core/types"
+	log "github.com/sirupsen/logrus"
+)
+
+// LogFilter the running log query of a chain, addresses can be added while
+// it runs: the source is started again with the new query from the block of
+// the log that added them, and the logs that were already delivered are
+// skipped, so no log is lost or delivered twice
+type LogFilter struct {
+	source LogSource
+	query  ethereum.FilterQuery
+	// addresses in the query
+	addresses map[common.Address]bool
+	// added the addresses added since the source was started
+	added map[common.Address]bool
+	// from the block to start the next source from
+	from *big.Int
+	// Node the node the head is read from when the source restarts before
+	// delivering a log and the query has no FromBlock, it can be nil
+	Node    HeaderReader
+	changed chan struct{}
+	m       sync.Mutex
+}
+
+// NewLogFilter create a filter for the query, if the query has a FromBlock
+// the logs from that block are delivered first
+func NewLogFilter(source LogSource, query ethereum.FilterQuery) *LogFilter {
+	f := &LogFilter{
+		source:    source,
+		query:     query,
+		addresses: make(map[common.Address]bool),
+		added:     make(map[common.Address]bool),
+		changed:   make(chan struct{}, 1),
+	}
+	for _, a := range query.Addresses {
+		f.addresses[a] = true
+	}
+	return f
+}
+
+// Addresses the addresses of the filter
+func (f *LogFilter) Addresses() (addresses []common.Address) {
+	f.m.Lock()
+	defer f.m.Unlock()
+	return append(addresses, f.query.Addresses...)
+}
+
+// Add add addresses to the filter, their logs are delivered from the block of
+// the log l, or from the last delivered log if l is nil. It returns the number
+// of addresses that were not in the filter.
+func (f *LogFilter) Add(l *types.Log, addresses ...common.Address) (added int) {
+	f.m.Lock()
+	defer f.m.Unlock()
+	for _, a := range addresses {
+		if f.addresses[a] {
+			continue
+		}
+		f.addresses[a] = true
+		f.added[a] = true
+		f.query.Addresses = append(f.query.Addresses, a)
+		added++
+	}
+	if added == 0 {
+		return
+	}
+	if l != nil && (f.from == nil || f.from.Uint64() > l.BlockNumber) {
+		f.from = new(big.Int).SetUint64(l.BlockNumber)
+	}
+	select {
+	case f.changed <- struct{}{}:
+	default:
+	}
+	return
+}
+
+// Remove remove addresses from the filter, it returns the number of
+// addresses that were in the filter
+func (f *LogFilter) Remove(addresses ...common.Address) (removed int) {
+	f.m.Lock()
+	defer f.m.Unlock()
+	for _, a := range addresses {
+		if !f.addresses[a] {
+			continue
+		}
+		delete(f.addresses, a)
+		delete(f.added, a)
+		removed++
+	}
+	if removed == 0 {
+		return
+	}
+	var kept []common.Address
+	for _, a := range f.query.Addresses {
+		if f.addresses[a] {
+			kept = append(kept, a)
+		}
+	}
+	f.query.Addresses = kept
+	select {
+	case f.changed <- struct{}{}:
+	default:
+	}
+	return
+}
+
+// Refresh start the source again with the same addresses, e.g. when the
+// events followed for them changed
+func (f *LogFilter) Refresh() {
+	select {
+	case f.changed <- struct{}{}:
+	default:
+	}
+}
+
+// next the query for the next source and the addresses added since the
+// previous one, from the last delivered log, or from the resume block when
+// no log has been delivered yet
+func (f *LogFilter) next(last logCursor, resume *big.Int) (query ethereum.FilterQuery, added map[common.Address]bool) {
+	f.m.Lock()
+	defer f.m.Unlock()
+	query = f.query
+	query.Addresses = append([]common.Address(nil), f.query.Addresses...)
+	switch {
+	case last.set:
+		query.FromBlock = new(big.Int).SetUint64(last.block)
+	case resume != nil:
+		query.FromBlock = new(big.Int).Set(resume)
+	}
+	if query.FromBlock != nil && f.from != nil && f.from.Cmp(query.FromBlock) < 0 {
+		query.FromBlock = f.from
+	}
+	added, f.added, f.from = f.added, make(map[common.Address]bool), nil
+	return
+}
+
+// resume the block a source restarted before delivering a log starts from:
+// the FromBlock of the first query, e.g. the checkpoint, or the head of the
+// node before the restart, so the logs in between are not lost
+func (f *LogFilter) resume(ctx context.Context, from *big.Int) *big.Int {
+	if from != nil || f.Node == nil {
+		return from
+	}
+	head, err := f.Node.HeaderByNumber(ctx, nil)
+	if err != nil {
+		log.Warn("cannot read the head to restart the log filter from: ", err)
+		return nil
+	}
+	return head.Number
+}
+
+// Run deliver the logs of the filter on out until ctx is done, and the
+// progress of the source on progress, which can be nil. When the source
+// restarts, the progress goes back to the block before the new query.
+func (f *LogFilter) Run(ctx context.Context, out chan<- types.Log, progress chan<- uint64) {
+	// last the last delivered log
+	var last logCursor
+	query, added := f.next(last, nil)
+	// resume where the first source started, until a log is delivered
+	resume := query.FromBlock
+	for {
+		sctx, cancel := context.WithCancel(ctx)
+		// every source has its own channel, so a log of the previous one
+		// cannot be delivered after it is stopped
+		logs, done := make(chan types.Log), make(chan uint64)
+		go f.source.Logs(sctx, query, logs, done)
+		// skip the logs up to the last delivered one
+		// but the ones of the added addresses
+		skip := last
+	forward:
+		for {
+			select {
+			case <-ctx.Done():
+				cancel()
+				return
+			case <-f.changed:
+				if !last.set {
+					resume = f.resume(ctx, resume)
+				}
+				cancel()
+				query, added = f.next(last, resume)
+				log.Infof("log filter restarted from block %v with %d addresses", query.FromBlock, len(query.Addresses))
+				if query.FromBlock != nil && query.FromBlock.Sign() > 0 && !sendProgress(ctx, progress, query.FromBlock.Uint64()-1) {
+					return
+				}
+				break forward
+			case n := <-done:
+				if !sendProgress(ctx, progress, n) {
+					cancel()
+					return
+				}
+			case l := <-logs:
+				if skip.set && !l.Removed {
+					if !skip.after(&l) && !added[l.Address] {
+						continue
+					}
+					if skip.after(&l) {
+						// past the logs already delivered
+						skip, added = logCursor{}, nil
+					}
+				}
+				select {
+				case out <- l:
+				case <-ctx.Done():
+					cancel()
+					return
+				}
+				last.move(&l)
+			}
+		}
+	}
+}
@@ -0,0 +1,146 @@
+package collector
+
+import (
+	"context"
+	"fmt"
+	"math/big"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/ethereum/go-ethereum"
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/core/types"
+	"github.com/stretchr/testify/assert"
+)
+
+// chainSource a log source that delivers the logs of a chain matching the
+// query, then waits for ctx to be done
+type chainSource struct {
+	logs    []types.Log
+	m       sync.Mutex
+	queries []ethereum.FilterQuery
+}
+
+func (s *chainSource) Logs(ctx context.Context, query ethereum.FilterQuery, out chan<- types.Log, progress chan<- uint64) {
+	s.m.Lock()
+	s.queries = append(s.queries, query)
+	s.m.Unlock()
+	for _, l := range s.logs {
+		if query.FromBlock != nil && l.BlockNumber < query.FromBlock.Uint64() {
+			continue
+		}
+		if !containsAddress(query.Addresses, l.Address) {
+			continue
+		}
+		select {
+		case out <- l:
+		case <-ctx.Done():
+			return
+		}
+	}
+	<-ctx.Done()
+}
+
+func (s *chainSource) Heads(ctx context.Context, out chan<- *types.Header) {}
+
+func TestLogFilter(t *testing.T) {
+	a, f, p := common.HexToAddress("0x0a"), common.HexToAddress("0x0f"), common.HexToAddress("0x01")
+	l := func(address common.Address, block uint64, index uint) types.Log {
+		return types.Log{Address: address, BlockNumber: block, Index: index, TxHash: common.BigToHash(common.Big1)}
+	}
+	source := &chainSource{logs: []types.Log{
+		l(a, 1, 0),
+		l(f, 2, 0), // creates p
+		l(a, 2, 1),
+		l(p, 2, 2),
+		l(p, 3, 0),
+		l(a, 3, 1),
+	}}
+	filter := NewLogFilter(source, ethereum.FilterQuery{Addresses: []common.Address{a, f}})
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	out := make(chan types.Log)
+	go filter.Run(ctx, out, nil)
+
+	delivered := make(map[string]int)
+	for len(delivered) < len(source.logs) {
+		select {
+		case got := <-out:
+			delivered[fmt.Sprintf("%s:%d:%d", got.Address.Hex(), got.BlockNumber, got.Index)]++
+			if got.Address == f {
+				assert.Equal(t, 1, filter.Add(&got, p))
+				// adding it again does nothing
+				assert.Equal(t, 0, filter.Add(&got, p))
+			}
+		case <-time.After(2 * time.Second):
+			t.Fatalf("%d logs delivered, want %d", len(delivered), len(source.logs))
+		}
+	}
+	// no log is delivered twice
+	select {
+	case got := <-out:
+		t.Fatalf("log delivered twice: %+v", got)
+	case <-time.After(100 * time.Millisecond):
+	}
+	for k, n := range delivered {
+		assert.Equal(t, 1, n, k)
+	}
+	// the source is started again from the block that created the pool
+	source.m.Lock()
+	defer source.m.Unlock()
+	if assert.Len(t, source.queries, 2) {
+		assert.Equal(t, uint64(2), source.queries[1].FromBlock.Uint64())
+		assert.Equal(t, []common.Address{a, f, p}, source.queries[1].Addresses)
+	}
+	assert.Equal(t, []common.Address{a, f, p}, filter.Addresses())
+}
+
+// headNode a node at a fixed head
+type headNode struct {
+	head uint64
+}
+
+func (n *headNode) HeaderByNumber(ctx context.Context, number *big.Int) (*types.Header, error) {
+	return &types.Header{Number: new(big.Int).SetUint64(n.head)}, nil
+}
+
+func (n *headNode) HeaderByHash(ctx context.Context, hash common.Hash) (*types.Header, error) {
+	return nil, ethereum.NotFound
+}
+
+func TestLogFilterRestartBeforeDelivering(t *testing.T) {
+	a := common.HexToAddress("0x0a")
+	restarted := func(query ethereum.FilterQuery) ethereum.FilterQuery {
+		source := &chainSource{}
+		filter := NewLogFilter(source, query)
+		filter.Node = &headNode{head: 42}
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+		go filter.Run(ctx, make(chan types.Log), nil)
+		started := func(n int) func() bool {
+			return func() bool {
+				source.m.Lock()
+				defer source.m.Unlock()
+				return len(source.queries) == n
+			}
+		}
+		assert.Eventually(t, started(1), time.Second, time.Millisecond)
+		filter.Refresh()
+		assert.Eventually(t, started(2), time.Second, time.Millisecond)
+		source.m.Lock()
+		defer source.m.Unlock()
+		return source.queries[1]
+	}
+
+	// from the head before the restart, not from the head after it
+	query := restarted(ethereum.FilterQuery{Addresses: []common.Address{a}})
+	if assert.NotNil(t, query.FromBlock) {
+		assert.Equal(t, uint64(42), query.FromBlock.Uint64())
+	}
+	// from the checkpoint
+	query = restarted(ethereum.FilterQuery{Addresses: []common.Address{a}, FromBlock: big.NewInt(10)})
+	if assert.NotNil(t, query.FromBlock) {
+		assert.Equal(t, uint64(10), query.FromBlock.Uint64())
+	}
+}
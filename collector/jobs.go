@@ -0,0 +1,226 @@
+package collector
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// scansBucket the bucket of the scan jobs, by id
+const scansBucket = "scans"
+
+// addressScansBucket the bucket of the ids of the scan jobs, by address and
+// id, so the jobs of an address are a key range
+const addressScansBucket = "scans:address"
+
+// addressScanKey the key of a job in the jobs of its address
+func addressScanKey(address Address, id string) string {
+	return fmt.Sprintf("%s:%s", address, id)
+}
+
+// ErrJobInterrupted the job was queued or running when the collector stopped
+var ErrJobInterrupted = errors.New("interrupted by restart")
+
+// JobState the state of a scan job
+type JobState string
+
+// the states of a scan job
+const (
+	JobQueued  JobState = "queued"
+	JobRunning JobState = "running"
+	JobDone    JobState = "done"
+	JobFailed  JobState = "failed"
+)
+
+// MaxJobErrors how many errors a job keeps, the later ones are only counted
+// in the report
+const MaxJobErrors = 20
+
+// ScanJob the scan of a subscribed address
+type ScanJob struct {
+	ID       string        `json:"id"`
+	Address  Address       `json:"address"`
+	State    JobState      `json:"state"`
+	Created  time.Time     `json:"created"`
+	Started  *time.Time    `json:"started,omitempty"`
+	Finished *time.Time    `json:"finished,omitempty"`
+	Report   ExploreReport `json:"report"`
+	Errors   []string      `json:"errors,omitempty"`
+}
+
+var (
+	// jobs the jobs of this run, the history is in the store
+	jobs   = make(map[string]*ScanJob)
+	lastID int64
+	jobsM  sync.Mutex
+)
+
+// NewScanJob create a queued job for the address
+func NewScanJob(address Address) *ScanJob {
+	jobsM.Lock()
+	defer jobsM.Unlock()
+	now := time.Now()
+	// the ids are sorted by creation
+	id := now.UnixNano()
+	if id <= lastID {
+		id = lastID + 1
+	}
+	lastID = id
+	j := &ScanJob{
+		ID:      fmt.Sprintf("%016x", id),
+		Address: address,
+		State:   JobQueued,
+		Created: now,
+		Report:  ExploreReport{Address: address},
+	}
+	jobs[j.ID] = j
+	saveJob(j)
+	if store != nil {
+		if err := store.Put(addressScansBucket, addressScanKey(address, j.ID), j.ID); err != nil {
+			log.Errorf("cannot index scan job %s: %v", j.ID, err)
+		}
+	}
+	return j
+}
+
+// start move the job to running
+func (j *ScanJob) start() {
+	jobsM.Lock()
+	defer jobsM.Unlock()
+	now := time.Now()
+	j.State, j.Started = JobRunning, &now
+	saveJob(j)
+}
+
+// progress update the counts of a running job
+func (j *ScanJob) progress(report ExploreReport, err error) {
+	jobsM.Lock()
+	defer jobsM.Unlock()
+	j.Report = report
+	if err != nil && len(j.Errors) < MaxJobErrors {
+		j.Errors = append(j.Errors, err.Error())
+	}
+}
+
+// finish move the job to done, or to failed when err is set
+func (j *ScanJob) finish(report ExploreReport, err error) {
+	jobsM.Lock()
+	defer jobsM.Unlock()
+	now := time.Now()
+	j.State, j.Finished, j.Report = JobDone, &now, report
+	if err != nil {
+		j.State = JobFailed
+		j.Errors = append(j.Errors, err.Error())
+	}
+	saveJob(j)
+	// the finished jobs are read from the store
+	if store != nil {
+		delete(jobs, j.ID)
+	}
+}
+
+// saveJob write the job in the store, the caller holds jobsM
+func saveJob(j *ScanJob) {
+	if store == nil {
+		return
+	}
+	if err := store.Put(scansBucket, j.ID, j); err != nil {
+		log.Errorf("cannot save scan job %s: %v", j.ID, err)
+	}
+}
+
+// GetScanJob the job with the id, from this run or from the history
+func GetScanJob(id string) (job ScanJob, found bool) {
+	jobsM.Lock()
+	defer jobsM.Unlock()
+	if j, ok := jobs[id]; ok {
+		return *j, true
+	}
+	if store == nil {
+		return
+	}
+	found, err := store.Get(scansBucket, id, &job)
+	if err != nil {
+		log.Errorf("cannot read scan job %s: %v", id, err)
+	}
+	return
+}
+
+// AddressScans the jobs of an address, sorted by creation
+func AddressScans(address Address) (scans []ScanJob) {
+	jobsM.Lock()
+	defer jobsM.Unlock()
+	seen := make(map[string]bool)
+	for _, j := range jobs {
+		if j.Address == address {
+			scans = append(scans, *j)
+			seen[j.ID] = true
+		}
+	}
+	if store != nil {
+		// the keys of the address sort before the character that follows
+		// the separator
+		start, end := addressScanKey(address, ""), string(address)+";"
+		err := store.Range(addressScansBucket, start, end, func(key string, value []byte) error {
+			var id string
+			if err := json.Unmarshal(value, &id); err != nil {
+				return err
+			}
+			if seen[id] {
+				return nil
+			}
+			var j ScanJob
+			found, err := store.Get(scansBucket, id, &j)
+			if err != nil {
+				return err
+			}
+			if found {
+				scans = append(scans, j)
+			}
+			return nil
+		})
+		if err != nil {
+			log.Errorf("cannot read the scans of %s: %v", address, err)
+		}
+	}
+	sort.Slice(scans, func(i, k int) bool { return scans[i].ID < scans[k].ID })
+	return
+}
+
+// interruptJobs fail the jobs left queued or running by the last run, their
+// queue was in the memory of the collector
+func interruptJobs() {
+	if store == nil {
+		return
+	}
+	jobsM.Lock()
+	defer jobsM.Unlock()
+	var interrupted []ScanJob
+	err := store.All(scansBucket, func(key string, value []byte) error {
+		var j ScanJob
+		if err := json.Unmarshal(value, &j); err != nil {
+			return err
+		}
+		if j.State == JobQueued || j.State == JobRunning {
+			interrupted = append(interrupted, j)
+		}
+		return nil
+	})
+	if err != nil {
+		log.Errorf("cannot read the scan jobs: %v", err)
+	}
+	now := time.Now()
+	for _, j := range interrupted {
+		j.State, j.Finished = JobFailed, &now
+		j.Errors = append(j.Errors, ErrJobInterrupted.Error())
+		saveJob(&j)
+	}
+	if len(interrupted) > 0 {
+		log.Warnf("%d scan jobs interrupted by the restart have failed", len(interrupted))
+	}
+}
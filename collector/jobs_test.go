@@ -0,0 +1,86 @@
+package collector
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestScanJobs(t *testing.T) {
+	s, err := OpenStore(t.TempDir())
+	assert.Nil(t, err)
+	defer s.Close()
+	defer func(s *Store) { store = s }(store)
+	store = s
+
+	a, b := Address("0x00000000000000000000000000000000000005c1"), Address("0x00000000000000000000000000000000000005c2")
+	first := NewScanJob(a)
+	other := NewScanJob(b)
+	second := NewScanJob(a)
+	assert.True(t, first.ID < other.ID && other.ID < second.ID)
+	job, found := GetScanJob(first.ID)
+	assert.True(t, found)
+	assert.Equal(t, JobQueued, job.State)
+
+	// the counts of a running job are updated by the explorer
+	first.start()
+	first.progress(ExploreReport{Address: a, Nodes: 1, Transactions: 3, Entities: 2, Relationships: 4}, nil)
+	first.progress(ExploreReport{Address: a, Nodes: 2, Transactions: 3, Entities: 2, Relationships: 4, Errors: 1}, errors.New("etherscan unavailable"))
+	job, _ = GetScanJob(first.ID)
+	assert.Equal(t, JobRunning, job.State)
+	assert.NotNil(t, job.Started)
+	assert.Equal(t, 3, job.Report.Transactions)
+	assert.Equal(t, []string{"etherscan unavailable"}, job.Errors)
+
+	// the finished jobs are in the history
+	first.finish(job.Report, nil)
+	second.finish(second.Report, ErrEtherscanAPIKey)
+	job, found = GetScanJob(first.ID)
+	assert.True(t, found)
+	assert.Equal(t, JobDone, job.State)
+	assert.NotNil(t, job.Finished)
+	assert.Equal(t, 4, job.Report.Relationships)
+	scans := AddressScans(a)
+	if assert.Len(t, scans, 2) {
+		assert.Equal(t, first.ID, scans[0].ID)
+		assert.Equal(t, JobFailed, scans[1].State)
+		assert.Equal(t, []string{ErrEtherscanAPIKey.Error()}, scans[1].Errors)
+	}
+	// a job in this run and in the history is listed once
+	scans = AddressScans(b)
+	if assert.Len(t, scans, 1) {
+		assert.Equal(t, JobQueued, scans[0].State)
+	}
+	_, found = GetScanJob("missing")
+	assert.False(t, found)
+
+	// the jobs left queued or running by a restart fail
+	running := NewScanJob(b)
+	running.start()
+	jobsM.Lock()
+	jobs = make(map[string]*ScanJob)
+	jobsM.Unlock()
+	interruptJobs()
+	scans = AddressScans(b)
+	if assert.Len(t, scans, 2) {
+		for _, j := range scans {
+			assert.Equal(t, JobFailed, j.State)
+			assert.NotNil(t, j.Finished)
+			assert.Equal(t, []string{ErrJobInterrupted.Error()}, j.Errors)
+		}
+	}
+	job, _ = GetScanJob(first.ID)
+	assert.Equal(t, JobDone, job.State)
+}
+
+func TestScanQueueFull(t *testing.T) {
+	defer func(q chan *ScanJob) { addrQueue = q }(addrQueue)
+	addrQueue = make(chan *ScanJob, 1)
+	addrQueue <- NewScanJob(Address("0x00000000000000000000000000000000000005c3"))
+
+	job, err := Scan(Address("0x00000000000000000000000000000000000005c4"))
+	assert.Error(t, err)
+	assert.Equal(t, JobFailed, job.State)
+	assert.Len(t, job.Errors, 1)
+}
@@ -0,0 +1,179 @@
+package collector
+
+import (
+	"context"
+	"fmt"
+	"math/big"
+	"time"
+
+	"github.com/ethereum/go-ethereum"
+	"github.com/ethereum/go-ethereum/core/types"
+	"github.com/ethereum/go-ethereum/ethclient"
+	log "github.com/sirupsen/logrus"
+	"github.com/utu-crowdsale/defi-portal-scanner/config"
+)
+
+// Log sources
+const (
+	LogSourceSubscription = "subscription"
+	LogSourcePolling      = "polling"
+)
+
+// LogSource produces the logs of the monitored contracts and the chain heads
+type LogSource interface {
+	// Logs deliver the logs matching the query on out until ctx is done, if
+	// the query has a FromBlock the logs from that block are delivered first.
+	// The block up to which every log has been delivered is sent on progress
+	// after its logs, progress can be nil.
+	Logs(ctx context.Context, query ethereum.FilterQuery, out chan<- types.Log, progress chan<- uint64)
+	// Heads deliver the new chain heads on out until ctx is done
+	Heads(ctx context.Context, out chan<- *types.Header)
+}
+
+// NewLogSource create the log source configured for the node of the chain,
+// the addresses are followed in shards of cfg.ShardSize addresses
+func NewLogSource(cfg config.EthereumSchema, client *ethclient.Client, chain *Chain) (LogSource, error) {
+	sharded := &ShardedSource{Client: client, Chain: chain, Size: cfg.ShardSize}
+	switch cfg.LogSource {
+	case "", LogSourceSubscription:
+		sharded.Source = func(health *SourceHealth) LogSource {
+			return &SubscriptionSource{Client: client, Health: health}
+		}
+	case LogSourcePolling:
+		sharded.Source = func(health *SourceHealth) LogSource {
+			return &PollingSource{Client: client, Interval: cfg.PollInterval, Health: health}
+		}
+		// the shards poll at the same pace
+		sharded.Window = (&PollingSource{Interval: cfg.PollInterval}).interval()
+	default:
+		return nil, fmt.Errorf("unknown log source '%s'", cfg.LogSource)
+	}
+	return sharded, nil
+}
+
+// sendProgress send the block on progress, a nil progress is skipped, it
+// returns false if ctx is done
+func sendProgress(ctx context.Context, progress chan<- uint64, block uint64) bool {
+	if progress == nil {
+		return true
+	}
+	select {
+	case progress <- block:
+		return true
+	case <-ctx.Done():
+		return false
+	}
+}
+
+// SubscriptionSource gets the logs and the heads with websocket subscriptions
+type SubscriptionSource struct {
+	Client LogSubscriber
+	// Health the health of the source, optional
+	Health *SourceHealth
+}
+
+// Logs implements LogSource, the progress follows the new heads
+func (s *SubscriptionSource) Logs(ctx context.Context, query ethereum.FilterQuery, out chan<- types.Log, progress chan<- uint64) {
+	subscribeLogs(ctx, s.Client, query, out, progress, s.Health)
+}
+
+// Heads implements LogSource
+func (s *SubscriptionSource) Heads(ctx context.Context, out chan<- *types.Header) {
+	SubscribeHeads(ctx, s.Client, out)
+}
+
+// LogPoller the node api used to poll for logs
+type LogPoller interface {
+	ethereum.LogFilterer
+	BlockNumber(ctx context.Context) (uint64, error)
+}
+
+// PollingSource gets the logs and the heads calling eth_blockNumber and
+// eth_getLogs at every interval, it works with plain http endpoints. Polling
+// never sees the logs removed by a reorg, use confirmations with it.
+type PollingSource struct {
+	Client   LogPoller
+	Interval time.Duration
+	// Health the health of the source, optional
+	Health *SourceHealth
+}
+
+func (s *PollingSource) interval() time.Duration {
+	if s.Interval <= 0 {
+		return 15 * time.Second
+	}
+	return s.Interval
+}
+
+// Logs implements LogSource, the progress is the head of the last poll
+func (s *PollingSource) Logs(ctx context.Context, query ethereum.FilterQuery, out chan<- types.Log, progress chan<- uint64) {
+	var cursor logCursor
+	if query.FromBlock != nil && query.FromBlock.Sign() > 0 {
+		cursor = logCursor{block: query.FromBlock.Uint64() - 1, index: ^uint(0), set: true}
+	}
+	query.FromBlock, query.ToBlock = nil, nil
+	s.Health.connecting()
+	for {
+		head, err := s.Client.BlockNumber(ctx)
+		if err == nil && !cursor.set {
+			// start from the head
+			cursor = logCursor{block: head, index: ^uint(0), set: true}
+		}
+		if err == nil && head > cursor.block {
+			// the cursor block is requested again if it was not completed
+			from := cursor.block
+			if cursor.index == ^uint(0) {
+				from++
+			}
+			err = FilterLogsRange(ctx, s.Client, query, from, head, func(l types.Log) error {
+				if !cursor.after(&l) {
+					return nil
+				}
+				select {
+				case out <- l:
+				case <-ctx.Done():
+					return ctx.Err()
+				}
+				cursor.move(&l)
+				return nil
+			})
+			if err == nil {
+				cursor = logCursor{block: head, index: ^uint(0), set: true}
+			}
+		}
+		if err == nil && !sendProgress(ctx, progress, cursor.block) {
+			return
+		}
+		if err != nil && ctx.Err() == nil {
+			s.Health.down(err)
+			log.Warn("error polling logs: ", err)
+		} else if err == nil {
+			s.Health.live()
+		}
+		if !sleep(ctx, s.interval()) {
+			return
+		}
+	}
+}
+
+// Heads implements LogSource
+func (s *PollingSource) Heads(ctx context.Context, out chan<- *types.Header) {
+	var last uint64
+	for {
+		head, err := s.Client.BlockNumber(ctx)
+		if err != nil && ctx.Err() == nil {
+			log.Warn("error polling the chain head: ", err)
+		}
+		if err == nil && head > last {
+			last = head
+			select {
+			case out <- &types.Header{Number: new(big.Int).SetUint64(head)}:
+			case <-ctx.Done():
+				return
+			}
+		}
+		if !sleep(ctx, s.interval()) {
+			return
+		}
+	}
+}
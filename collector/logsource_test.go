@@ -0,0 +1,192 @@
+package collector
+
+import (
+	"context"
+	"encoding/json"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/ethereum/go-ethereum"
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/common/hexutil"
+	"github.com/ethereum/go-ethereum/core/types"
+	"github.com/ethereum/go-ethereum/ethclient"
+	"github.com/stretchr/testify/assert"
+)
+
+// httpNode a json-rpc node over plain http, it only knows about
+// eth_blockNumber and eth_getLogs
+type httpNode struct {
+	m    sync.Mutex
+	head uint64
+	logs []types.Log
+}
+
+func (n *httpNode) emit(l types.Log) {
+	n.m.Lock()
+	defer n.m.Unlock()
+	n.logs = append(n.logs, l)
+	if l.BlockNumber > n.head {
+		n.head = l.BlockNumber
+	}
+}
+
+func (n *httpNode) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		ID     json.RawMessage   `json:"id"`
+		Method string            `json:"method"`
+		Params []json.RawMessage `json:"params"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	n.m.Lock()
+	defer n.m.Unlock()
+	var result interface{}
+	switch req.Method {
+	case "eth_blockNumber":
+		result = hexutil.Uint64(n.head)
+	case "eth_getLogs":
+		var q struct {
+			FromBlock string `json:"fromBlock"`
+			ToBlock   string `json:"toBlock"`
+		}
+		json.Unmarshal(req.Params[0], &q)
+		from, _ := hexutil.DecodeUint64(q.FromBlock)
+		to, _ := hexutil.DecodeUint64(q.ToBlock)
+		logs := []types.Log{}
+		for _, l := range n.logs {
+			if l.BlockNumber >= from && l.BlockNumber <= to {
+				logs = append(logs, l)
+			}
+		}
+		result = logs
+	default:
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"jsonrpc": "2.0",
+			"id":      req.ID,
+			"error":   map[string]interface{}{"code": -32601, "message": "method not found"},
+		})
+		return
+	}
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"jsonrpc": "2.0",
+		"id":      req.ID,
+		"result":  result,
+	})
+}
+
+func testRPCLog(block uint64, index uint) types.Log {
+	return types.Log{
+		Address:     common.HexToAddress("0x1f98431c8ad98523631ae4a59f267346ea31f984"),
+		Topics:      []common.Hash{common.HexToHash("0x01")},
+		Data:        []byte{},
+		BlockNumber: block,
+		BlockHash:   common.HexToHash(strconv.FormatUint(block, 16)),
+		TxHash:      common.HexToHash("0xaa" + strconv.FormatUint(block, 16)),
+		Index:       index,
+	}
+}
+
+func TestPollingSource(t *testing.T) {
+	node := &httpNode{head: 10}
+	node.emit(testRPCLog(9, 0))
+	server := httptest.NewServer(node)
+	defer server.Close()
+
+	client, err := ethclient.Dial(server.URL)
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer client.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	source := &PollingSource{Client: client, Interval: 10 * time.Millisecond}
+	query := ethereum.FilterQuery{Addresses: []common.Address{testRPCLog(0, 0).Address}}
+	logs := make(chan types.Log)
+	go source.Logs(ctx, query, logs, nil)
+	heads := make(chan *types.Header)
+	go source.Heads(ctx, heads)
+
+	receive := func() (l types.Log) {
+		select {
+		case l = <-logs:
+		case <-time.After(5 * time.Second):
+			t.Fatal("log not received")
+		}
+		return
+	}
+	select {
+	case h := <-heads:
+		assert.Equal(t, uint64(10), h.Number.Uint64())
+	case <-time.After(5 * time.Second):
+		t.Fatal("head not received")
+	}
+	// let the source start from the head, the logs before it are not delivered
+	time.Sleep(100 * time.Millisecond)
+	node.emit(testRPCLog(11, 0))
+	node.emit(testRPCLog(11, 1))
+	node.emit(testRPCLog(12, 0))
+	for _, want := range [][2]uint64{{11, 0}, {11, 1}, {12, 0}} {
+		l := receive()
+		assert.Equal(t, want[0], l.BlockNumber)
+		assert.Equal(t, uint(want[1]), l.Index)
+	}
+	select {
+	case h := <-heads:
+		assert.True(t, h.Number.Uint64() > 10)
+	case <-time.After(5 * time.Second):
+		t.Fatal("head not received")
+	}
+	// nothing is delivered twice
+	select {
+	case l := <-logs:
+		t.Fatalf("unexpected log %d:%d", l.BlockNumber, l.Index)
+	case <-time.After(100 * time.Millisecond):
+	}
+}
+
+func TestPollingSourceCatchesUpFromBlock(t *testing.T) {
+	node := &httpNode{head: 5}
+	node.emit(testRPCLog(2, 0))
+	node.emit(testRPCLog(4, 0))
+	server := httptest.NewServer(node)
+	defer server.Close()
+
+	client, err := ethclient.Dial(server.URL)
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer client.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	source := &PollingSource{Client: client, Interval: 10 * time.Millisecond}
+	query := ethereum.FilterQuery{
+		Addresses: []common.Address{testRPCLog(0, 0).Address},
+		FromBlock: big.NewInt(3),
+	}
+	logs, progress := make(chan types.Log), make(chan uint64)
+	go source.Logs(ctx, query, logs, progress)
+
+	select {
+	case l := <-logs:
+		assert.Equal(t, uint64(4), l.BlockNumber)
+	case <-time.After(5 * time.Second):
+		t.Fatal("log not received")
+	}
+	// the progress is the head of the poll, after its logs
+	select {
+	case n := <-progress:
+		assert.Equal(t, uint64(5), n)
+	case <-time.After(5 * time.Second):
+		t.Fatal("progress not received")
+	}
+}
@@ -30,18 +30,10 @@ func OceanPoolEventSubscribe(ethConfig config.EthereumSchema, oceanPools []confi
 	log.Infof("Subscribing to events from %v Ocean Pools", len(oceanPoolsFilterList))
 	query := ethereum.FilterQuery{Addresses: oceanPoolsFilterList}
 	logs := make(chan types.Log)
-	sub, err := client.SubscribeFilterLogs(context.Background(), query, logs)
-	if err != nil {
-		log.Fatal(err)
-	}
+	go SubscribeLogs(context.Background(), client, query, logs)
 
-	for {
-		select {
-		case err := <-sub.Err():
-			log.Fatal(err)
-		case vLog := <-logs:
-			changeset, _ := ParseLog(&vLog, client)
-			log.Info(changeset)
-		}
+	for vLog := range logs {
+		changeset, _ := ParseLog(&vLog, client)
+		log.Info(changeset)
 	}
 }
@@ -0,0 +1,273 @@
+package collector
+
+import (
+	"encoding/json"
+	"fmt"
+	"math/big"
+	"path/filepath"
+	"strings"
+
+	"github.com/ethereum/go-ethereum/accounts/abi"
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/core/types"
+	log "github.com/sirupsen/logrus"
+)
+
+// Factory a contract that deploys the pools of a protocol, the pools it
+// creates are added to the protocol filters when its creation event is seen
+type Factory struct {
+	Address string `json:"address,omitempty"`
+	// Event the name of the creation event, e.g. PoolCreated or PairCreated
+	Event string `json:"event,omitempty"`
+	// Argument the event argument with the address of the new pool, e.g. pool
+	Argument string `json:"argument,omitempty"`
+	// ABI the path of the factory ABI, by default the protocol ABIs are used
+	ABI string `json:"abi,omitempty"`
+}
+
+// Pool a pool discovered from the event of a factory
+type Pool struct {
+	Address  string `json:"address"`
+	Factory  string `json:"factory"`
+	Protocol string `json:"protocol"`
+	Block    uint64 `json:"block"`
+	TxHash   string `json:"txHash"`
+}
+
+// factory a registered factory and what its pools inherit from the protocol
+type factory struct {
+	Factory
+	protocol    string
+	protocolID  string
+	attribution string
+	// poolABI the abi of the pools, the protocol default abi
+	poolABI *abi.ABI
+	// topics the events followed for the pools, nil for all
+	topics []common.Hash
+}
+
+// containsAddress tells if the address is in the list
+func containsAddress(addresses []common.Address, address common.Address) bool {
+	for _, a := range addresses {
+		if a == address {
+			return true
+		}
+	}
+	return false
+}
+
+// poolsBucket the bucket of the pools discovered on a chain
+func poolsBucket(chainID *big.Int) string {
+	return fmt.Sprintf("pools:%s", chainID)
+}
+
+// registerFactories register the factories of the protocol on the chain,
+// their abi must have the creation event with an address argument for the
+// pool
+func (c *Chain) registerFactories(p Protocol, baseDir string) (err error) {
+	if len(p.Factories) == 0 {
+		return
+	}
+	resolve := func(file string) string {
+		if !filepath.IsAbs(file) {
+			file = filepath.Join(baseDir, file)
+		}
+		return file
+	}
+	var poolABI *abi.ABI
+	if p.ABI != "" {
+		if poolABI, err = ReadABI(resolve(p.ABI)); err != nil {
+			return
+		}
+	}
+	topics, err := c.protocolTopics(p)
+	if err != nil {
+		return
+	}
+	s := c.state()
+	s.factoriesM.Lock()
+	defer s.factoriesM.Unlock()
+	for _, f := range p.Factories {
+		if !common.IsHexAddress(f.Address) {
+			return fmt.Errorf("invalid factory address '%s' for protocol %s", f.Address, p.Name)
+		}
+		address := strings.ToLower(f.Address)
+		if f.ABI != "" {
+			a, err := ReadABI(resolve(f.ABI))
+			if err != nil {
+				return err
+			}
+			c.registerABI(address, a)
+		}
+		// the creation event must be decoded
+		a := c.contractABI(address)
+		if a == nil {
+			return fmt.Errorf("no abi for factory %s of protocol %s", f.Address, p.Name)
+		}
+		ev, found := a.Events[f.Event]
+		if !found {
+			return fmt.Errorf("event '%s' not found in the abi of factory %s", f.Event, f.Address)
+		}
+		var isAddress bool
+		for _, in := range ev.Inputs {
+			if in.Name == f.Argument {
+				isAddress = in.Type.T == abi.AddressTy
+			}
+		}
+		if !isAddress {
+			return fmt.Errorf("event %s of factory %s has no address argument '%s'", f.Event, f.Address, f.Argument)
+		}
+		s.factories[address] = &factory{
+			Factory:     f,
+			protocol:    p.Name,
+			protocolID:  strings.ToLower(p.MainAddress),
+			attribution: p.Attribution,
+			poolABI:     poolABI,
+			topics:      topics,
+		}
+	}
+	return
+}
+
+// DiscoverPool return the pool created by a log of a factory, pool is nil if
+// the log is not the creation event of a factory registered on the chain
+func (c *Chain) DiscoverPool(l *types.Log) (pool *Pool, err error) {
+	if l.Removed || len(l.Topics) == 0 {
+		return
+	}
+	s := c.state()
+	s.factoriesM.RLock()
+	f := s.factories[strings.ToLower(l.Address.Hex())]
+	s.factoriesM.RUnlock()
+	if f == nil {
+		return
+	}
+	evt, found, err := c.DecodeLog(l)
+	if err != nil || !found || evt.Name != f.Event {
+		return
+	}
+	address, ok := evt.arg(argName(f.Argument))
+	if !ok {
+		err = fmt.Errorf("no pool address in %s of factory %s in tx %s", f.Event, f.Address, l.TxHash.Hex())
+		return
+	}
+	pool = &Pool{
+		Address:  address,
+		Factory:  strings.ToLower(f.Address),
+		Protocol: f.protocol,
+		Block:    l.BlockNumber,
+		TxHash:   l.TxHash.Hex(),
+	}
+	return
+}
+
+// registerPool cache the pool as an address of its protocol, and register the
+// abi and the attribution of the protocol for it. It returns false if the
+// factory is not registered anymore or the address is already known.
+func (c *Chain) registerPool(pool Pool) bool {
+	s := c.state()
+	s.factoriesM.Lock()
+	f := s.factories[pool.Factory]
+	if f == nil {
+		s.factoriesM.Unlock()
+		return false
+	}
+	if _, typ, found := c.cacheGet(pool.Address); found && typ == TypeDefiProtocol {
+		s.factoriesM.Unlock()
+		return false
+	}
+	s.pools[strings.ToLower(pool.Address)] = pool.Factory
+	s.factoriesM.Unlock()
+	c.cachePush(pool.Address, f.protocolID, TypeDefiProtocol)
+	c.inherit(pool.Address, f)
+	return true
+}
+
+// inherit register for a pool the abi, the attribution and the events of the
+// protocol of its factory
+func (c *Chain) inherit(pool string, f *factory) {
+	if f.poolABI != nil {
+		c.registerABI(pool, f.poolABI)
+	} else {
+		c.unregisterABI(pool)
+	}
+	c.setAttribution(pool, f.attribution)
+	c.setTopics(pool, f.topics)
+}
+
+// refreshPools register again for the pools what they inherit from the
+// protocol of their factory, e.g. after the protocol changed its abi
+func (c *Chain) refreshPools() {
+	s := c.state()
+	s.factoriesM.RLock()
+	inherited := make(map[string]*factory, len(s.pools))
+	for pool, address := range s.pools {
+		if f := s.factories[address]; f != nil {
+			inherited[pool] = f
+		}
+	}
+	s.factoriesM.RUnlock()
+	for pool, f := range inherited {
+		c.inherit(pool, f)
+	}
+}
+
+// unregisterFactories forget the factories of a protocol
+func (c *Chain) unregisterFactories(p Protocol) {
+	s := c.state()
+	s.factoriesM.Lock()
+	defer s.factoriesM.Unlock()
+	for _, f := range p.Factories {
+		delete(s.factories, strings.ToLower(f.Address))
+	}
+}
+
+// orphanPools forget the pools whose factory is not registered anymore, and
+// return them
+func (c *Chain) orphanPools() (orphans []common.Address) {
+	s := c.state()
+	s.factoriesM.Lock()
+	defer s.factoriesM.Unlock()
+	for pool, f := range s.pools {
+		if _, found := s.factories[f]; !found {
+			orphans = append(orphans, common.HexToAddress(pool))
+			delete(s.pools, pool)
+		}
+	}
+	return
+}
+
+// addPool register a discovered pool and save it, so that it is followed
+// after a restart
+func (c *Chain) addPool(pool Pool) bool {
+	if !c.registerPool(pool) {
+		return false
+	}
+	log.Infof("discovered pool %s of protocol %s at block %d", pool.Address, pool.Protocol, pool.Block)
+	if store == nil {
+		return true
+	}
+	if err := store.Put(poolsBucket(c.ID), pool.Address, pool); err != nil {
+		log.Errorf("cannot save pool %s: %v", pool.Address, err)
+	}
+	return true
+}
+
+// loadPools register the pools discovered on a chain by the factories that
+// are still registered, and return their addresses
+func (c *Chain) loadPools() (pools []Pool, err error) {
+	if store == nil {
+		return
+	}
+	err = store.All(poolsBucket(c.ID), func(key string, value []byte) error {
+		var pool Pool
+		if err := json.Unmarshal(value, &pool); err != nil {
+			return err
+		}
+		if c.registerPool(pool) {
+			pools = append(pools, pool)
+		}
+		return nil
+	})
+	return
+}
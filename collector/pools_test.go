@@ -0,0 +1,110 @@
+package collector
+
+import (
+	"math/big"
+	"strings"
+	"testing"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/core/types"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDiscoverPool(t *testing.T) {
+	factoryAddress := "0x1F98431c8aD98523631AE4a59f267346ea31F984"
+	p := Protocol{
+		Name:        "Uniswap V3",
+		MainAddress: "0xE592427A0AEce92De3Edee1F18E0157C05861564",
+		ABI:         "abis/uniswap_v3_pool.json",
+		Filters:     map[string]string{"0x88e6a0c2ddd26feeb64f039a2c41296fcb3f5640": "Uniswap V3 WETH/USDC"},
+		Attribution: AttributionOriginator,
+		Factories: []Factory{
+			{Address: factoryAddress, Event: "PoolCreated", Argument: "pool", ABI: "abis/uniswap_v3_factory.json"},
+		},
+	}
+	chain := &Chain{ID: big.NewInt(1)}
+	assert.Nil(t, chain.LoadABIs(p, ".."))
+	assert.Nil(t, chain.registerFactories(p, ".."))
+
+	// the creation event must be in the abi, with an address argument
+	bad := p
+	bad.Factories = []Factory{{Address: factoryAddress, Event: "PairCreated", Argument: "pair", ABI: "abis/uniswap_v3_factory.json"}}
+	assert.Error(t, chain.registerFactories(bad, ".."))
+	bad.Factories = []Factory{{Address: factoryAddress, Event: "PoolCreated", Argument: "fee", ABI: "abis/uniswap_v3_factory.json"}}
+	assert.Error(t, chain.registerFactories(bad, ".."))
+
+	a, err := ReadABI("../abis/uniswap_v3_factory.json")
+	assert.Nil(t, err)
+	created := a.Events["PoolCreated"]
+	pool := common.HexToAddress("0x00000000000000000000000000000000000b0a11")
+	data, err := created.Inputs.NonIndexed().Pack(big.NewInt(60), pool)
+	assert.Nil(t, err)
+	l := &types.Log{
+		Address: common.HexToAddress(factoryAddress),
+		Topics: []common.Hash{
+			created.ID,
+			common.HexToHash("0xa0"),
+			common.HexToHash("0xa1"),
+			common.BigToHash(big.NewInt(3000)),
+		},
+		Data:        data,
+		BlockNumber: 12369739,
+		TxHash:      common.HexToHash("0x01"),
+	}
+	discovered, err := chain.DiscoverPool(l)
+	assert.Nil(t, err)
+	if !assert.NotNil(t, discovered) {
+		return
+	}
+	assert.Equal(t, strings.ToLower(pool.Hex()), discovered.Address)
+	assert.Equal(t, "Uniswap V3", discovered.Protocol)
+	assert.Equal(t, uint64(12369739), discovered.Block)
+
+	// the logs of other contracts are not pools
+	other := *l
+	other.Address = common.HexToAddress("0x88e6a0c2ddd26feeb64f039a2c41296fcb3f5640")
+	discovered2, err := chain.DiscoverPool(&other)
+	assert.Nil(t, err)
+	assert.Nil(t, discovered2)
+
+	// the pool is saved and loaded after a restart
+	s, err := OpenStore(t.TempDir())
+	assert.Nil(t, err)
+	defer s.Close()
+	defer func(s *Store) { store = s }(store)
+	store = s
+	chain.cacheDelete(discovered.Address)
+	assert.True(t, chain.addPool(*discovered))
+	assert.False(t, chain.addPool(*discovered))
+
+	label, typ, found := chain.cacheGet(discovered.Address)
+	assert.True(t, found)
+	assert.Equal(t, TypeDefiProtocol, typ)
+	assert.Equal(t, strings.ToLower(p.MainAddress), label)
+	assert.Equal(t, AttributionOriginator, chain.attributionOf(pool))
+	_, found = chain.lookupEvent(pool, a.Events["PoolCreated"].ID)
+	assert.False(t, found)
+	swap, _ := ReadABI("../abis/uniswap_v3_pool.json")
+	_, found = chain.lookupEvent(pool, swap.Events["Swap"].ID)
+	assert.True(t, found)
+
+	// forget it as a restart would
+	chain.cacheDelete(discovered.Address)
+	pools, err := chain.loadPools()
+	assert.Nil(t, err)
+	if assert.Len(t, pools, 1) {
+		assert.Equal(t, *discovered, pools[0])
+	}
+	_, typ, _ = chain.cacheGet(discovered.Address)
+	assert.Equal(t, TypeDefiProtocol, typ)
+	// the factories and the pools of other chains are separate
+	polygon := &Chain{ID: big.NewInt(137)}
+	pools, err = polygon.loadPools()
+	assert.Nil(t, err)
+	assert.Empty(t, pools)
+	discovered, err = polygon.DiscoverPool(l)
+	assert.Nil(t, err)
+	assert.Nil(t, discovered)
+	_, _, found = polygon.cacheGet(strings.ToLower(pool.Hex()))
+	assert.False(t, found)
+}
@@ -0,0 +1,125 @@
+package collector
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/ethereum/go-ethereum/common"
+	lru "github.com/hashicorp/golang-lru"
+	log "github.com/sirupsen/logrus"
+)
+
+// postedBucket the bucket of the keys of the posted changesets
+const postedBucket = "posted"
+
+// PostedCacheSize how many posted keys are remembered in memory, in front
+// of the store
+const PostedCacheSize = 10000
+
+var (
+	// postedRetention how long a posted key is remembered, 0 forever
+	postedRetention time.Duration
+	postedCache     *lru.Cache
+	postedM         sync.Mutex
+)
+
+func init() {
+	postedCache, _ = lru.New(PostedCacheSize)
+}
+
+// LogPostKey the idempotency key of the changeset of some logs of a tx:
+// chainId:txHash:logIndex, with the sorted indexes of the logs separated by
+// commas, a nil chain is mainnet. The logs of a tx that arrive late make a
+// changeset of their own.
+func LogPostKey(chain *Chain, txHash common.Hash, indexes ...uint) string {
+	sorted := append([]uint(nil), indexes...)
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i] < sorted[j] })
+	var parts []string
+	for i, index := range sorted {
+		if i > 0 && index == sorted[i-1] {
+			// a log delivered twice
+			continue
+		}
+		parts = append(parts, strconv.FormatUint(uint64(index), 10))
+	}
+	return fmt.Sprintf("%s:%s:%s", chain.key(), txHash.Hex(), strings.Join(parts, ","))
+}
+
+// TxPostKey the idempotency key of the changeset of a tx of a scanned
+// address: txHash:address
+func TxPostKey(txHash string, address Address) string {
+	return fmt.Sprintf("%s:%s", strings.ToLower(txHash), strings.ToLower(string(address)))
+}
+
+// isPosted tells if the changeset with the key has been posted already, a
+// changeset without a key is never posted
+func isPosted(key string) bool {
+	if key == "" {
+		return false
+	}
+	postedM.Lock()
+	defer postedM.Unlock()
+	if at, found := postedCache.Get(key); found {
+		if retained(at.(time.Time)) {
+			return true
+		}
+		postedCache.Remove(key)
+	}
+	if store == nil {
+		return false
+	}
+	var at time.Time
+	found, err := store.Get(postedBucket, key, &at)
+	if err != nil {
+		log.Errorf("cannot read posted key %s: %v", key, err)
+	}
+	// the store expires the keys by the second
+	if !found || !retained(at) {
+		return false
+	}
+	postedCache.Add(key, at)
+	return true
+}
+
+// retained tells if a key posted at is still in the retention
+func retained(at time.Time) bool {
+	return postedRetention == 0 || time.Since(at) < postedRetention
+}
+
+// markPosted remember that the changeset with the key has been posted, for
+// the retention
+func markPosted(key string) {
+	if key == "" {
+		return
+	}
+	postedM.Lock()
+	defer postedM.Unlock()
+	at := time.Now()
+	postedCache.Add(key, at)
+	if store == nil {
+		return
+	}
+	if err := store.PutTTL(postedBucket, key, at, postedRetention); err != nil {
+		log.Errorf("cannot save posted key %s: %v", key, err)
+	}
+}
+
+// forgetPosted forget the posted keys, so that their changesets can be
+// posted again, e.g. when a reorg removes their tx
+func forgetPosted(keys ...string) {
+	postedM.Lock()
+	defer postedM.Unlock()
+	for _, key := range keys {
+		postedCache.Remove(key)
+		if store == nil {
+			continue
+		}
+		if err := store.Delete(postedBucket, key); err != nil {
+			log.Errorf("cannot forget posted key %s: %v", key, err)
+		}
+	}
+}
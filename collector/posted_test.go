@@ -0,0 +1,161 @@
+package collector
+
+import (
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/core/types"
+	"github.com/stretchr/testify/assert"
+	"github.com/utu-crowdsale/defi-portal-scanner/config"
+)
+
+func TestPostKeys(t *testing.T) {
+	tx := common.HexToHash("0xabc")
+	assert.Equal(t, "137:"+tx.Hex()+":4", LogPostKey(&Chain{ID: big.NewInt(137)}, tx, 4))
+	assert.Equal(t, "1:"+tx.Hex()+":0", LogPostKey(nil, tx, 0))
+	// the indexes are sorted and the repeated ones dropped
+	assert.Equal(t, "1:"+tx.Hex()+":2,3,9", LogPostKey(nil, tx, 9, 2, 3, 9))
+	assert.Equal(t, "0xabc:0x00000000000000000000000000000000000000aa", TxPostKey("0xABC", Address("0x00000000000000000000000000000000000000AA")))
+}
+
+func TestPostChangeset(t *testing.T) {
+	s, err := OpenStore(t.TempDir())
+	assert.Nil(t, err)
+	defer s.Close()
+	defer func(s *Store) { store = s }(store)
+	store = s
+	defer postedCache.Purge()
+
+	var m sync.Mutex
+	requests, fail := 0, false
+	api := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		m.Lock()
+		defer m.Unlock()
+		requests++
+		if fail {
+			w.WriteHeader(http.StatusBadGateway)
+		}
+	}))
+	defer api.Close()
+	utuCli := NewUTUClient(config.TrustEngineSchema{URL: api.URL})
+	count := func() int {
+		m.Lock()
+		defer m.Unlock()
+		n := requests
+		requests = 0
+		return n
+	}
+	acks := 0
+	changeset := func(key string) *TrustAPIChangeSet {
+		cs := NewChangeset()
+		cs.AddRel(NewTrustRelationship())
+		cs.Key = key
+		cs.onPosted(func() { acks++ })
+		return cs
+	}
+
+	// a changeset is posted once
+	assert.True(t, postChangeset(utuCli, changeset("1:0x01:0")))
+	assert.Equal(t, 1, count())
+	assert.False(t, postChangeset(utuCli, changeset("1:0x01:0")))
+	assert.Equal(t, 0, count())
+	// the changesets without a key are always posted
+	assert.True(t, postChangeset(utuCli, changeset("")))
+	assert.True(t, postChangeset(utuCli, changeset("")))
+	assert.Equal(t, 2, count())
+
+	// the posted keys survive a restart
+	postedCache.Purge()
+	assert.False(t, postChangeset(utuCli, changeset("1:0x01:0")))
+	assert.Equal(t, 0, count())
+
+	// the changesets posted or skipped are acknowledged
+	assert.Equal(t, 5, acks)
+
+	// a failed changeset is posted again, it is acknowledged once posted
+	fail = true
+	assert.False(t, postChangeset(utuCli, changeset("1:0x02:0")))
+	assert.Equal(t, 5, acks)
+	fail = false
+	assert.True(t, postChangeset(utuCli, changeset("1:0x02:0")))
+	assert.Equal(t, 2, count())
+	assert.Equal(t, 6, acks)
+
+	// the keys expire after the retention
+	postedRetention = time.Millisecond
+	defer func() { postedRetention = 0 }()
+	time.Sleep(5 * time.Millisecond)
+	postedCache.Purge()
+	markPosted("1:0x03:0")
+	time.Sleep(5 * time.Millisecond)
+	assert.False(t, isPosted("1:0x03:0"))
+}
+
+func TestPostChangesetsRetry(t *testing.T) {
+	defer func(d, max time.Duration) { ChangesetRetryDelay, ChangesetRetryMaxDelay = d, max }(ChangesetRetryDelay, ChangesetRetryMaxDelay)
+	ChangesetRetryDelay, ChangesetRetryMaxDelay = time.Millisecond, 4*time.Millisecond
+
+	var m sync.Mutex
+	attempts := make(map[string]int)
+	queue, done := make(chan *TrustAPIChangeSet), make(chan struct{})
+	go func() {
+		defer close(done)
+		postChangesets(queue, func(cs *TrustAPIChangeSet) bool {
+			m.Lock()
+			defer m.Unlock()
+			attempts[cs.Key]++
+			// "failing" never succeeds, "flaky" succeeds at the fourth
+			// attempt
+			return cs.Key == "flaky" && attempts[cs.Key] == 4
+		})
+	}()
+	count := func(key string) int {
+		m.Lock()
+		defer m.Unlock()
+		return attempts[key]
+	}
+	flaky := &TrustAPIChangeSet{Key: "flaky"}
+	queue <- flaky
+	queue <- &TrustAPIChangeSet{Key: "failing"}
+
+	// a failed changeset is posted again, with an increasing backoff
+	assert.Eventually(t, func() bool { return count("flaky") == 4 }, time.Second, time.Millisecond)
+	assert.Equal(t, 4*time.Millisecond, flaky.retryDelay)
+	time.Sleep(20 * time.Millisecond)
+	assert.Equal(t, 4, count("flaky"))
+	assert.Greater(t, count("failing"), 4)
+
+	// the changesets still failing are posted once more when the queue closes
+	close(queue)
+	<-done
+	failed := count("failing")
+	time.Sleep(10 * time.Millisecond)
+	assert.Equal(t, failed, count("failing"))
+}
+
+func TestRetractForgetsPosted(t *testing.T) {
+	defer postedCache.Purge()
+	tx := common.HexToHash("0xfeed")
+	chain := &Chain{ID: big.NewInt(1)}
+	agg := NewAggregator(chain, func(cs *TrustAPIChangeSet) {
+		markPosted(cs.Key)
+		cs.acknowledge()
+	})
+	l := &types.Log{TxHash: tx, BlockNumber: 7, Index: 3}
+	agg.Add(l, &parsedLog{relationships: []*TrustRelationship{NewTrustRelationship()}})
+	agg.Flush()
+	key := LogPostKey(chain, tx, 3)
+	assert.True(t, isPosted(key))
+
+	// the tx removed by a reorg can be posted again
+	removed := *l
+	removed.Removed = true
+	_, found := chain.Retract(&removed)
+	assert.True(t, found)
+	assert.False(t, isPosted(key))
+}
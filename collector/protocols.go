@@ -1,7 +1,12 @@
 package collector
 
 import (
+	"fmt"
+	"strings"
+
+	"github.com/ethereum/go-ethereum/common"
 	"github.com/iancoleman/strcase"
+	"github.com/utu-crowdsale/defi-portal-scanner/utils"
 )
 
 // ProtocolsFormat is the format of the protocols.json
@@ -9,6 +14,22 @@ type ProtocolsFormat struct {
 	DefiProtocols []Protocol `json:"defi_protocols,omitempty"`
 }
 
+// ReadProtocols read the protocols file
+func ReadProtocols(file string) (protocols *ProtocolsFormat, err error) {
+	err = utils.ReadJSON(file, &protocols)
+	return
+}
+
+// Addresses the filter addresses of all the protocols
+func (pf *ProtocolsFormat) Addresses() (addresses []common.Address) {
+	for _, p := range pf.DefiProtocols {
+		for a := range p.Filters {
+			addresses = append(addresses, common.HexToAddress(a))
+		}
+	}
+	return
+}
+
 // Protocol is a Defi Protocol/Project e.g. Uniswap, Balancer, Sushiswap, whose
 // pools (in the Filters field) we listen to for Events, so we can update UTU Trust
 // API
@@ -20,6 +41,66 @@ type Protocol struct {
 	Filters     map[string]string `json:"filters,omitempty"`
 	Category    string            `json:"category,omitempty"`
 	MainAddress string            `json:"main_address,omitempty"`
+	// ABI is the path of the ABI file used to decode the events of every filter
+	ABI string `json:"abi,omitempty"`
+	// ABIs maps a filter address to the path of its ABI file, it takes
+	// precedence over ABI, an empty path leaves the address without ABI
+	ABIs map[string]string `json:"abis,omitempty"`
+	// Attribution who the interactions with the protocol are attributed to,
+	// AttributionParties (default) or AttributionOriginator
+	Attribution string `json:"attribution,omitempty"`
+	// Factories the contracts that deploy the protocol pools, the pools are
+	// followed as soon as they are created
+	Factories []Factory `json:"factories,omitempty"`
+	// Events the events followed for the protocol, by name, signature or
+	// topic, all of them if empty
+	Events []string `json:"events,omitempty"`
+}
+
+// Attributions of the protocol interactions
+const (
+	// AttributionParties the addresses in the events, e.g. from and to of a Transfer
+	AttributionParties = "parties"
+	// AttributionOriginator the account that sent the tx, the other addresses
+	// are recorded in the path of the interaction
+	AttributionOriginator = "originator"
+)
+
+// registerAttribution set the attribution of the protocol filters
+func (c *Chain) registerAttribution(p Protocol) (err error) {
+	switch p.Attribution {
+	case "", AttributionParties, AttributionOriginator:
+	default:
+		return fmt.Errorf("unknown attribution '%s' for protocol %s", p.Attribution, p.Name)
+	}
+	for a := range p.Filters {
+		c.setAttribution(a, p.Attribution)
+	}
+	return
+}
+
+// setAttribution set the attribution of a contract, empty for the default
+func (c *Chain) setAttribution(address, attribution string) {
+	s := c.state()
+	s.attributionsM.Lock()
+	defer s.attributionsM.Unlock()
+	address = strings.ToLower(address)
+	if attribution == "" {
+		delete(s.attributions, address)
+		return
+	}
+	s.attributions[address] = attribution
+}
+
+// attributionOf the attribution of the logs of a contract
+func (c *Chain) attributionOf(address common.Address) string {
+	s := c.state()
+	s.attributionsM.RLock()
+	defer s.attributionsM.RUnlock()
+	if a := s.attributions[strings.ToLower(address.Hex())]; a != "" {
+		return a
+	}
+	return AttributionParties
 }
 
 // ReverseFilters reverse the filters key and value
@@ -0,0 +1,59 @@
+package collector
+
+import (
+	"math/rand"
+	"sync"
+	"time"
+)
+
+// tokenBucket a limiter that allows rate calls per second, with bursts of up
+// to burst calls
+type tokenBucket struct {
+	rate   float64
+	burst  float64
+	tokens float64
+	last   time.Time
+	m      sync.Mutex
+}
+
+// newTokenBucket create a full bucket
+func newTokenBucket(rate float64, burst int) *tokenBucket {
+	if burst < 1 {
+		burst = 1
+	}
+	return &tokenBucket{rate: rate, burst: float64(burst), tokens: float64(burst), last: time.Now()}
+}
+
+// Wait block until a call is allowed, a nil bucket never blocks
+func (b *tokenBucket) Wait() {
+	if b == nil {
+		return
+	}
+	for {
+		b.m.Lock()
+		now := time.Now()
+		b.tokens += now.Sub(b.last).Seconds() * b.rate
+		if b.tokens > b.burst {
+			b.tokens = b.burst
+		}
+		b.last = now
+		if b.tokens >= 1 {
+			b.tokens--
+			b.m.Unlock()
+			return
+		}
+		wait := time.Duration((1 - b.tokens) / b.rate * float64(time.Second))
+		b.m.Unlock()
+		time.Sleep(wait)
+	}
+}
+
+// jitter a random duration between d/2 and d, so that the retries of
+// concurrent callers do not hit the server together
+func jitter(d time.Duration) time.Duration {
+	if d <= 1 {
+		return d
+	}
+	half := d / 2
+	return half + time.Duration(rand.Int63n(int64(d-half)))
+}
@@ -0,0 +1,235 @@
+package collector
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/fsnotify/fsnotify"
+	log "github.com/sirupsen/logrus"
+)
+
+// ReloadDelay how long to wait after a change of the protocols file before
+// reading it, editors write a file in more than one step
+var ReloadDelay = 500 * time.Millisecond
+
+// DiffProtocols compare two versions of the protocols file by protocol name,
+// changed are the protocols that are new or different, removed the ones that
+// are not there anymore
+func DiffProtocols(old, new *ProtocolsFormat) (changed, removed []Protocol) {
+	before := make(map[string]Protocol)
+	if old != nil {
+		for _, p := range old.DefiProtocols {
+			before[p.Name] = p
+		}
+	}
+	after := make(map[string]bool)
+	if new != nil {
+		for _, p := range new.DefiProtocols {
+			after[p.Name] = true
+			if b, found := before[p.Name]; !found || !reflect.DeepEqual(b, p) {
+				changed = append(changed, p)
+			}
+		}
+	}
+	if old != nil {
+		for _, p := range old.DefiProtocols {
+			if !after[p.Name] {
+				removed = append(removed, p)
+			}
+		}
+	}
+	return
+}
+
+// protocolAddresses the addresses followed for a protocol: its filters and
+// its factories, a protocol without filters is not followed
+func protocolAddresses(p Protocol) (addresses []common.Address) {
+	if len(p.Filters) == 0 {
+		return
+	}
+	for a := range p.Filters {
+		addresses = append(addresses, common.HexToAddress(a))
+	}
+	for _, f := range p.Factories {
+		if a := common.HexToAddress(f.Address); !containsAddress(addresses, a) {
+			addresses = append(addresses, a)
+		}
+	}
+	return
+}
+
+// unregisterAddresses forget the protocol addresses: the cache, the abis, the
+// attributions and the events on the chain, so that their logs are not
+// processed anymore
+func (c *Chain) unregisterAddresses(addresses []common.Address) {
+	for _, a := range addresses {
+		address := strings.ToLower(a.Hex())
+		c.cacheDelete(address)
+		c.unregisterABI(address)
+		c.setAttribution(address, "")
+		c.setTopics(address, nil)
+	}
+}
+
+// unregisterABIs forget the abis registered for the addresses of a protocol,
+// so that an abi that is dropped or replaced does not decode their logs
+func (c *Chain) unregisterABIs(p Protocol) {
+	for _, a := range protocolAddresses(p) {
+		c.unregisterABI(a.Hex())
+	}
+	for address := range p.ABIs {
+		c.unregisterABI(address)
+	}
+}
+
+// reloadProtocols apply the changes of the protocols file to a running
+// collector: the new and updated protocols are registered, that posts their
+// entities, the abis of the updated ones are replaced, also for the pools of
+// their factories, the addresses that are gone are forgotten, with the pools
+// discovered by the factories of the removed protocols, and the log filter is
+// updated, also when only the followed events changed. The entities are
+// passed to emit. It returns the protocols now followed.
+func reloadProtocols(file string, chain *Chain, current *ProtocolsFormat, filter *LogFilter, emit func(cs *TrustAPIChangeSet)) (next *ProtocolsFormat, err error) {
+	next, err = ReadProtocols(file)
+	if err != nil {
+		err = fmt.Errorf("cannot read the defi protocols from %s: %v", file, err)
+		return current, err
+	}
+	changed, removed := DiffProtocols(current, next)
+	var addresses []common.Address
+	for _, p := range next.DefiProtocols {
+		addresses = append(addresses, protocolAddresses(p)...)
+	}
+	if len(changed) == 0 && len(removed) == 0 {
+		return
+	}
+	log.Infof("reloading %s: %d protocols new or updated, %d removed", file, len(changed), len(removed))
+	// a reload that fails leaves the chain as it was
+	snapshot := chain.snapshot()
+	// the factories are registered again, the ones of the unchanged
+	// protocols as they were, the others with their protocol
+	for _, p := range current.DefiProtocols {
+		chain.unregisterFactories(p)
+	}
+	isChanged := make(map[string]bool)
+	for _, p := range changed {
+		isChanged[p.Name] = true
+	}
+	// the abis of the updated protocols are registered again
+	for _, p := range current.DefiProtocols {
+		if isChanged[p.Name] {
+			chain.unregisterABIs(p)
+		}
+	}
+	for _, p := range next.DefiProtocols {
+		if !isChanged[p.Name] && len(p.Filters) > 0 {
+			if err = chain.registerFactories(p, filepath.Dir(file)); err != nil {
+				break
+			}
+		}
+	}
+	var added []common.Address
+	var entities []*TrustAPIChangeSet
+	for _, p := range changed {
+		if err != nil {
+			break
+		}
+		var cs *TrustAPIChangeSet
+		var filters []common.Address
+		cs, filters, err = addProtocol(p, filepath.Dir(file), chain)
+		if cs != nil {
+			entities = append(entities, cs)
+		}
+		added = append(added, filters...)
+	}
+	if err != nil {
+		chain.restore(snapshot)
+		// the next reload tries again
+		return current, err
+	}
+	for _, cs := range entities {
+		emit(cs)
+	}
+	// the addresses that are not followed anymore, with the pools of the
+	// factories that are gone
+	var gone []common.Address
+	for _, p := range current.DefiProtocols {
+		for _, a := range protocolAddresses(p) {
+			if !containsAddress(addresses, a) {
+				gone = append(gone, a)
+			}
+		}
+	}
+	gone = append(gone, chain.orphanPools()...)
+	chain.unregisterAddresses(gone)
+	// the pools follow the abi and the events of their protocol
+	chain.refreshPools()
+	filter.Remove(gone...)
+	if filter.Add(nil, added...) == 0 {
+		// the events of the addresses may have changed
+		filter.Refresh()
+	}
+	return
+}
+
+// WatchProtocols send on reload when the protocols file changes or the
+// process receives SIGHUP, until ctx is done
+func WatchProtocols(ctx context.Context, file string, reload chan<- struct{}) {
+	notify := func() {
+		select {
+		case reload <- struct{}{}:
+		default:
+		}
+	}
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	defer signal.Stop(hup)
+	// the folder is watched, editors replace the file instead of writing it
+	var events chan fsnotify.Event
+	var errs chan error
+	watcher, err := fsnotify.NewWatcher()
+	if err == nil {
+		defer watcher.Close()
+		err = watcher.Add(filepath.Dir(file))
+		events, errs = watcher.Events, watcher.Errors
+	}
+	if err != nil {
+		log.Warnf("cannot watch %s, reload it with SIGHUP: %v", file, err)
+	}
+	var delay <-chan time.Time
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-hup:
+			log.Infof("SIGHUP received, reloading %s", file)
+			notify()
+		case e, ok := <-events:
+			if !ok {
+				events = nil
+				continue
+			}
+			if filepath.Clean(e.Name) != filepath.Clean(file) || e.Op&(fsnotify.Write|fsnotify.Create|fsnotify.Rename) == 0 {
+				continue
+			}
+			delay = time.After(ReloadDelay)
+		case err, ok := <-errs:
+			if !ok {
+				errs = nil
+				continue
+			}
+			log.Warnf("error watching %s: %v", file, err)
+		case <-delay:
+			delay = nil
+			notify()
+		}
+	}
+}
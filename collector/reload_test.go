@@ -0,0 +1,190 @@
+package collector
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"math/big"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/ethereum/go-ethereum"
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/stretchr/testify/assert"
+)
+
+func writeProtocols(t *testing.T, file string, protocols ...Protocol) {
+	data, err := json.Marshal(ProtocolsFormat{DefiProtocols: protocols})
+	assert.Nil(t, err)
+	assert.Nil(t, ioutil.WriteFile(file, data, 0644))
+}
+
+func TestDiffProtocols(t *testing.T) {
+	a := Protocol{Name: "A", Filters: map[string]string{"0x01": "a"}}
+	b := Protocol{Name: "B", Filters: map[string]string{"0x02": "b"}}
+	c := Protocol{Name: "C", Filters: map[string]string{"0x03": "c"}}
+	a2 := Protocol{Name: "A", Filters: map[string]string{"0x01": "a", "0x04": "a"}}
+
+	changed, removed := DiffProtocols(&ProtocolsFormat{DefiProtocols: []Protocol{a, b}}, &ProtocolsFormat{DefiProtocols: []Protocol{a2, c}})
+	assert.Equal(t, []Protocol{a2, c}, changed)
+	assert.Equal(t, []Protocol{b}, removed)
+	changed, removed = DiffProtocols(&ProtocolsFormat{DefiProtocols: []Protocol{a, b}}, &ProtocolsFormat{DefiProtocols: []Protocol{b, a}})
+	assert.Empty(t, changed)
+	assert.Empty(t, removed)
+}
+
+func TestReloadProtocols(t *testing.T) {
+	var emitted []*TrustAPIChangeSet
+	emit := func(cs *TrustAPIChangeSet) {
+		emitted = append(emitted, cs)
+	}
+
+	a1 := common.HexToAddress("0x00000000000000000000000000000000000a0001")
+	a2 := common.HexToAddress("0x00000000000000000000000000000000000a0002")
+	a3 := common.HexToAddress("0x00000000000000000000000000000000000a0003")
+	b1 := common.HexToAddress("0x00000000000000000000000000000000000b0001")
+	c1 := common.HexToAddress("0x00000000000000000000000000000000000c0001")
+	file := filepath.Join(t.TempDir(), "protocols.json")
+	writeProtocols(t, file,
+		Protocol{Name: "A", MainAddress: a1.Hex(), Filters: map[string]string{a1.Hex(): "a1", a2.Hex(): "a2"}},
+		Protocol{Name: "B", MainAddress: b1.Hex(), Filters: map[string]string{b1.Hex(): "b1"}},
+	)
+	current, err := ReadProtocols(file)
+	assert.Nil(t, err)
+	var filters []common.Address
+	for _, p := range current.DefiProtocols {
+		_, pf, err := addProtocol(p, filepath.Dir(file), nil)
+		assert.Nil(t, err)
+		filters = append(filters, pf...)
+	}
+	filter := NewLogFilter(&chainSource{}, ethereum.FilterQuery{Addresses: filters})
+	// B is followed on another chain too
+	polygon := &Chain{ID: big.NewInt(137)}
+	_, _, err = addProtocol(current.DefiProtocols[1], filepath.Dir(file), polygon)
+	assert.Nil(t, err)
+
+	// a2 is removed from A, B is removed and C is added
+	writeProtocols(t, file,
+		Protocol{Name: "A", MainAddress: a1.Hex(), Filters: map[string]string{a1.Hex(): "a1", a3.Hex(): "a3"}},
+		Protocol{Name: "C", MainAddress: c1.Hex(), Filters: map[string]string{c1.Hex(): "c1"}},
+	)
+	next, err := reloadProtocols(file, nil, current, filter, emit)
+	assert.Nil(t, err)
+	assert.Len(t, next.DefiProtocols, 2)
+	assert.ElementsMatch(t, []common.Address{a1, a3, c1}, filter.Addresses())
+	for _, a := range []common.Address{a2, b1} {
+		_, _, found := Mainnet.cacheGet(a.Hex())
+		assert.False(t, found, a.Hex())
+	}
+	for _, a := range []common.Address{a1, a3, c1} {
+		_, typ, _ := Mainnet.cacheGet(a.Hex())
+		assert.Equal(t, TypeDefiProtocol, typ, a.Hex())
+	}
+	// the reload does not change the other chains
+	_, typ, _ := polygon.cacheGet(b1.Hex())
+	assert.Equal(t, TypeDefiProtocol, typ)
+	_, _, found := polygon.cacheGet(c1.Hex())
+	assert.False(t, found)
+	// the entities of the new and updated protocols are posted
+	assert.Len(t, emitted, 2)
+
+	// nothing changed
+	next, err = reloadProtocols(file, nil, next, filter, emit)
+	assert.Nil(t, err)
+	assert.Len(t, emitted, 2)
+
+	// a protocol that cannot be registered leaves the chain as it was
+	d1 := common.HexToAddress("0x00000000000000000000000000000000000d0001")
+	writeProtocols(t, file,
+		Protocol{Name: "A", MainAddress: a1.Hex(), Filters: map[string]string{a1.Hex(): "a1"}},
+		Protocol{Name: "C", MainAddress: c1.Hex(), Filters: map[string]string{c1.Hex(): "c1"}},
+		Protocol{Name: "D", MainAddress: d1.Hex(), Filters: map[string]string{d1.Hex(): "d1"}, Attribution: "unknown"},
+	)
+	kept, err := reloadProtocols(file, nil, next, filter, emit)
+	assert.Error(t, err)
+	assert.Equal(t, next, kept)
+	_, _, found = Mainnet.cacheGet(d1.Hex())
+	assert.False(t, found)
+	_, typ, _ = Mainnet.cacheGet(a3.Hex())
+	assert.Equal(t, TypeDefiProtocol, typ)
+	assert.Len(t, emitted, 2)
+	assert.ElementsMatch(t, []common.Address{a1, a3, c1}, filter.Addresses())
+
+	// a broken file keeps the current protocols
+	assert.Nil(t, ioutil.WriteFile(file, []byte("{"), 0644))
+	kept, err = reloadProtocols(file, nil, next, filter, emit)
+	assert.Error(t, err)
+	assert.Equal(t, next, kept)
+}
+
+func TestWatchProtocols(t *testing.T) {
+	defer func(d time.Duration) { ReloadDelay = d }(ReloadDelay)
+	ReloadDelay = 10 * time.Millisecond
+	file := filepath.Join(t.TempDir(), "protocols.json")
+	writeProtocols(t, file)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	reloads := make(chan struct{}, 1)
+	go WatchProtocols(ctx, file, reloads)
+	time.Sleep(100 * time.Millisecond)
+
+	// other files in the folder are ignored
+	assert.Nil(t, ioutil.WriteFile(filepath.Join(filepath.Dir(file), "other.json"), []byte("{}"), 0644))
+	writeProtocols(t, file, Protocol{Name: "A"})
+	select {
+	case <-reloads:
+	case <-time.After(2 * time.Second):
+		t.Fatal("the change of the protocols file has not been notified")
+	}
+	select {
+	case <-reloads:
+		t.Fatal("one change notified twice")
+	case <-time.After(100 * time.Millisecond):
+	}
+}
+
+func TestReloadProtocolsABIs(t *testing.T) {
+	poolABI, err := filepath.Abs("../abis/uniswap_v3_pool.json")
+	assert.Nil(t, err)
+	factoryABI, err := filepath.Abs("../abis/uniswap_v3_factory.json")
+	assert.Nil(t, err)
+	swap, err := ReadABI(poolABI)
+	assert.Nil(t, err)
+
+	a1 := common.HexToAddress("0x00000000000000000000000000000000000e0001")
+	f1 := common.HexToAddress("0x00000000000000000000000000000000000e00f1")
+	pool := common.HexToAddress("0x00000000000000000000000000000000000e0b01")
+	p := Protocol{
+		Name: "E", MainAddress: a1.Hex(), ABI: poolABI,
+		Filters:   map[string]string{a1.Hex(): "a1"},
+		Factories: []Factory{{Address: f1.Hex(), Event: "PoolCreated", Argument: "pool", ABI: factoryABI}},
+	}
+	file := filepath.Join(t.TempDir(), "protocols.json")
+	writeProtocols(t, file, p)
+	current, err := ReadProtocols(file)
+	assert.Nil(t, err)
+	chain := &Chain{ID: big.NewInt(1017)}
+	_, filters, err := addProtocol(current.DefiProtocols[0], filepath.Dir(file), chain)
+	assert.Nil(t, err)
+	assert.True(t, chain.addPool(Pool{Address: pool.Hex(), Factory: strings.ToLower(f1.Hex()), Protocol: "E"}))
+	filter := NewLogFilter(&chainSource{}, ethereum.FilterQuery{Addresses: filters})
+	for _, a := range []common.Address{a1, pool} {
+		_, found := chain.lookupEvent(a, swap.Events["Swap"].ID)
+		assert.True(t, found, a.Hex())
+	}
+
+	// the protocol drops its abi, the filters and the pools lose it
+	p.ABI = ""
+	writeProtocols(t, file, p)
+	_, err = reloadProtocols(file, chain, current, filter, func(cs *TrustAPIChangeSet) {})
+	assert.Nil(t, err)
+	for _, a := range []common.Address{a1, pool} {
+		_, found := chain.lookupEvent(a, swap.Events["Swap"].ID)
+		assert.False(t, found, a.Hex())
+	}
+	// the factory keeps its own
+	assert.NotNil(t, chain.contractABI(f1.Hex()))
+}
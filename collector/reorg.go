@@ -0,0 +1,187 @@
+package collector
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/core/types"
+	log "github.com/sirupsen/logrus"
+)
+
+// ReorgWindow how many blocks the posted txs are remembered for, a reorg
+// deeper than this cannot be retracted
+const ReorgWindow = 128
+
+// postedTx the changesets posted for a tx
+type postedTx struct {
+	Block uint64               `json:"block"`
+	Rels  []*TrustRelationship `json:"rels"`
+	// Keys the idempotency keys of the changesets of the tx
+	Keys []string `json:"keys"`
+}
+
+// postedTxsBucket the bucket of the txs posted on a chain, by block, so the
+// txs older than the reorg window are a key range
+func postedTxsBucket(chain *Chain) string {
+	return fmt.Sprintf("posted_txs:%s", chain.key())
+}
+
+// postedBlocksBucket the bucket of the blocks of the txs posted on a chain,
+// by tx hash
+func postedBlocksBucket(chain *Chain) string {
+	return fmt.Sprintf("posted_blocks:%s", chain.key())
+}
+
+// postedTxKey the key of a posted tx, the block is zero padded so that the
+// keys sort by block
+func postedTxKey(block uint64, txHash common.Hash) string {
+	return fmt.Sprintf("%020d:%s", block, txHash.Hex())
+}
+
+// LogKey the key that identifies a log in the chain
+func LogKey(txHash common.Hash, index uint) string {
+	return fmt.Sprintf("%s:%d", txHash.Hex(), index)
+}
+
+// reorgWindow how many blocks the posted txs of the chain are remembered
+// for, the confirmations depth when it is deeper than the ReorgWindow
+func (c *Chain) reorgWindow() uint64 {
+	if c != nil && c.Confirmations > ReorgWindow {
+		return c.Confirmations
+	}
+	return ReorgWindow
+}
+
+// trackTx remember the relationships of a changeset of a tx that has been
+// posted, so that they can be retracted if the tx is removed by a reorg, also
+// after a restart when there is a store
+func (c *Chain) trackTx(txHash common.Hash, block uint64, cs *TrustAPIChangeSet) {
+	s := c.state()
+	s.postedTxsM.Lock()
+	defer s.postedTxsM.Unlock()
+	p, found := c.postedTx(txHash)
+	// a changeset skipped because it was posted already is tracked once
+	for _, k := range p.Keys {
+		if cs.Key != "" && k == cs.Key {
+			return
+		}
+	}
+	if found && p.Block != block {
+		c.forgetTx(txHash, p.Block)
+	}
+	p.Block = block
+	p.Rels = append(p.Rels, cs.Relationship...)
+	if cs.Key != "" {
+		p.Keys = append(p.Keys, cs.Key)
+	}
+	if store == nil {
+		s.postedTxs[txHash] = p
+	} else if err := store.Put(postedTxsBucket(c), postedTxKey(block, txHash), p); err != nil {
+		log.Errorf("cannot save posted tx %s: %v", txHash.Hex(), err)
+	} else if err := store.Put(postedBlocksBucket(c), txHash.Hex(), block); err != nil {
+		log.Errorf("cannot save posted tx %s: %v", txHash.Hex(), err)
+	}
+	// forget the txs that are too old to be reorganized
+	if block <= s.postedTxsBlock {
+		return
+	}
+	s.postedTxsBlock = block
+	window := c.reorgWindow()
+	if s.postedTxsBlock < window {
+		return
+	}
+	oldest := s.postedTxsBlock - window
+	if store == nil {
+		for k, p := range s.postedTxs {
+			if p.Block < oldest {
+				delete(s.postedTxs, k)
+			}
+		}
+		return
+	}
+	// the keys of the blocks before the oldest sort before its bare number
+	var old []string
+	err := store.Range(postedTxsBucket(c), fmt.Sprintf("%020d", 0), fmt.Sprintf("%020d", oldest), func(key string, _ []byte) error {
+		old = append(old, key)
+		return nil
+	})
+	if err != nil {
+		log.Errorf("cannot read the posted txs: %v", err)
+	}
+	for _, k := range old {
+		parts := strings.SplitN(k, ":", 2)
+		block, _ := strconv.ParseUint(parts[0], 10, 64)
+		c.forgetTx(common.HexToHash(parts[1]), block)
+	}
+}
+
+// postedTx the changesets posted for a tx, the caller holds postedTxsM
+func (c *Chain) postedTx(txHash common.Hash) (p postedTx, found bool) {
+	if store == nil {
+		p, found = c.state().postedTxs[txHash]
+		return
+	}
+	var block uint64
+	found, err := store.Get(postedBlocksBucket(c), txHash.Hex(), &block)
+	if err == nil && found {
+		found, err = store.Get(postedTxsBucket(c), postedTxKey(block, txHash), &p)
+	}
+	if err != nil {
+		log.Errorf("cannot read posted tx %s: %v", txHash.Hex(), err)
+	}
+	return
+}
+
+// forgetTx forget a posted tx, the caller holds postedTxsM
+func (c *Chain) forgetTx(txHash common.Hash, block uint64) {
+	delete(c.state().postedTxs, txHash)
+	if store == nil {
+		return
+	}
+	if err := store.Delete(postedTxsBucket(c), postedTxKey(block, txHash)); err != nil {
+		log.Errorf("cannot forget posted tx %s: %v", txHash.Hex(), err)
+	}
+	if err := store.Delete(postedBlocksBucket(c), txHash.Hex()); err != nil {
+		log.Errorf("cannot forget posted tx %s: %v", txHash.Hex(), err)
+	}
+}
+
+// Retract build the changeset that marks as retracted the relationships
+// created from the tx of a log that has been removed by a reorg. A reorg
+// removes all the logs of the tx, only the first one retracts it, found is
+// false if nothing has been posted for the tx. The tx is posted again if it
+// is included in another block.
+func (c *Chain) Retract(l *types.Log) (cs *TrustAPIChangeSet, found bool) {
+	s := c.state()
+	s.postedTxsM.Lock()
+	p, found := c.postedTx(l.TxHash)
+	if found {
+		c.forgetTx(l.TxHash, p.Block)
+	}
+	s.postedTxsM.Unlock()
+	if !found {
+		return
+	}
+	forgetPosted(p.Keys...)
+	cs = NewChangeset()
+	for _, r := range p.Rels {
+		cs.AddRel(retracted(r))
+	}
+	return
+}
+
+// retracted copy a relationship marking it as retracted
+func retracted(r *TrustRelationship) *TrustRelationship {
+	rel := NewTrustRelationship()
+	rel.Type = r.Type
+	rel.SourceCriteria = r.SourceCriteria
+	rel.TargetCriteria = r.TargetCriteria
+	for k, v := range r.Properties {
+		rel.Properties[k] = v
+	}
+	rel.Properties["retracted"] = true
+	rel.Properties["retractedReason"] = "reorg"
+	return rel
+}
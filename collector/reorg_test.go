@@ -0,0 +1,169 @@
+package collector
+
+import (
+	"context"
+	"math/big"
+	"testing"
+
+	"github.com/ethereum/go-ethereum"
+	"github.com/ethereum/go-ethereum/accounts/abi"
+	"github.com/ethereum/go-ethereum/accounts/abi/bind"
+	"github.com/ethereum/go-ethereum/accounts/abi/bind/backends"
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/core"
+	"github.com/ethereum/go-ethereum/core/types"
+	"github.com/ethereum/go-ethereum/crypto"
+	"github.com/stretchr/testify/assert"
+)
+
+// transferEmitterCode is the init code of a contract that emits a Transfer
+// event of 42 tokens from -> to when it is deployed
+func transferEmitterCode(from, to common.Address) (code []byte) {
+	code = append(code, 0x60, 0x2a, 0x60, 0x00, 0x52) // MSTORE(0, 42)
+	code = append(code, 0x73)                         // PUSH20 to
+	code = append(code, to.Bytes()...)
+	code = append(code, 0x73) // PUSH20 from
+	code = append(code, from.Bytes()...)
+	code = append(code, 0x7f) // PUSH32 Transfer(address,address,uint256)
+	code = append(code, common.HexToHash("0xddf252ad1be2c89b69c2b068fc378daa952ba7f163c4a11628f55a4df523b3ef").Bytes()...)
+	code = append(code, 0x60, 0x20, 0x60, 0x00) // PUSH1 32 PUSH1 0
+	code = append(code, 0xa3, 0x00)             // LOG3 STOP
+	return
+}
+
+func TestProcessLogRetractsReorgedLogs(t *testing.T) {
+	key, _ := crypto.GenerateKey()
+	deployer := crypto.PubkeyToAddress(key.PublicKey)
+	sim := backends.NewSimulatedBackend(core.GenesisAlloc{
+		deployer: {Balance: big.NewInt(1e18)},
+	}, 10000000)
+	defer sim.Close()
+
+	logs := make(chan types.Log, 10)
+	sub, err := sim.SubscribeFilterLogs(context.Background(), ethereum.FilterQuery{}, logs)
+	assert.Nil(t, err)
+	defer sub.Unsubscribe()
+
+	parent := sim.Blockchain().CurrentBlock()
+	auth, _ := bind.NewKeyedTransactorWithChainID(key, big.NewInt(1337))
+	from := common.HexToAddress("0x00000000000000000000000000000000000000a1")
+	to := common.HexToAddress("0x00000000000000000000000000000000000000b2")
+	contract, _, _, err := bind.DeployContract(auth, abi.ABI{}, transferEmitterCode(from, to), sim)
+	assert.Nil(t, err)
+	chain := &Chain{ID: big.NewInt(1337), Network: "simulated"}
+	chain.cachePush(contract.Hex(), contract.Hex(), TypeDefiProtocol)
+	sim.Commit()
+
+	// the log is included
+	var emitted []*TrustAPIChangeSet
+	agg := NewAggregator(chain, func(cs *TrustAPIChangeSet) {
+		emitted = append(emitted, cs)
+		cs.acknowledge()
+	})
+	vLog := <-logs
+	assert.False(t, vLog.Removed)
+	err = processLog(&vLog, sim, agg)
+	assert.Nil(t, err)
+	agg.Flush()
+	assert.Len(t, emitted, 1)
+	cs := emitted[0]
+	assert.Len(t, cs.Relationship, 2)
+	for _, r := range cs.Relationship {
+		assert.Equal(t, uint64(1337), r.Properties["chainId"])
+		assert.Equal(t, "simulated", r.Properties["network"])
+	}
+
+	// fork from before the deployment and make the fork the longest chain
+	err = sim.Fork(context.Background(), parent.Hash())
+	assert.Nil(t, err)
+	sim.Commit()
+	sim.Commit()
+
+	// the log is removed
+	vLog = <-logs
+	assert.True(t, vLog.Removed)
+	err = processLog(&vLog, sim, agg)
+	assert.Nil(t, err)
+	assert.Len(t, emitted, 2)
+	retraction := emitted[1]
+	assert.Len(t, retraction.Relationship, 2)
+	for i, r := range retraction.Relationship {
+		assert.Equal(t, true, r.Properties["retracted"])
+		assert.Equal(t, cs.Relationship[i].Properties["txId"], r.Properties["txId"])
+		assert.Equal(t, cs.Relationship[i].SourceCriteria, r.SourceCriteria)
+		assert.Equal(t, "simulated", r.Properties["network"])
+		_, isMarked := cs.Relationship[i].Properties["retracted"]
+		assert.False(t, isMarked)
+	}
+
+	// a tx is retracted only once
+	err = processLog(&vLog, sim, agg)
+	assert.Nil(t, err)
+	assert.Len(t, emitted, 2)
+}
+
+func TestRetractAfterRestart(t *testing.T) {
+	s, err := OpenStore(t.TempDir())
+	assert.Nil(t, err)
+	defer s.Close()
+	defer func(s *Store) { store = s }(store)
+	store = s
+	defer postedCache.Purge()
+
+	chain := &Chain{ID: big.NewInt(1338), Confirmations: 200}
+	old, tx := common.HexToHash("0x01"), common.HexToHash("0x02")
+	rel := NewTrustRelationship()
+	rel.Properties["txId"] = tx.Hex()
+	chain.trackTx(old, 10, &TrustAPIChangeSet{Relationship: []*TrustRelationship{NewTrustRelationship()}, Key: "1338:old"})
+	chain.trackTx(tx, 20, &TrustAPIChangeSet{Relationship: []*TrustRelationship{rel}, Key: "1338:tx"})
+	markPosted("1338:tx")
+
+	// the index is in the store, not in the memory of the collector
+	chainStatesM.Lock()
+	delete(chainStates, chain.key())
+	chainStatesM.Unlock()
+	postedCache.Purge()
+	cs, found := chain.Retract(&types.Log{TxHash: tx, Removed: true})
+	assert.True(t, found)
+	if assert.Len(t, cs.Relationship, 1) {
+		assert.Equal(t, tx.Hex(), cs.Relationship[0].Properties["txId"])
+		assert.Equal(t, true, cs.Relationship[0].Properties["retracted"])
+	}
+	assert.False(t, isPosted("1338:tx"))
+	_, found = chain.Retract(&types.Log{TxHash: tx, Removed: true})
+	assert.False(t, found)
+
+	// the txs are kept for the confirmations depth, deeper than the window
+	chain.trackTx(common.HexToHash("0x03"), 10+200, &TrustAPIChangeSet{})
+	_, found = chain.postedTx(old)
+	assert.True(t, found)
+	chain.trackTx(common.HexToHash("0x04"), 10+201, &TrustAPIChangeSet{})
+	_, found = chain.postedTx(old)
+	assert.False(t, found)
+}
+
+func TestRetractOnlyPosted(t *testing.T) {
+	defer postedCache.Purge()
+	tx := common.HexToHash("0xbeef")
+	chain := &Chain{ID: big.NewInt(1339)}
+	var emitted *TrustAPIChangeSet
+	agg := NewAggregator(chain, func(cs *TrustAPIChangeSet) {
+		emitted = cs
+	})
+	l := &types.Log{TxHash: tx, BlockNumber: 7, Index: 3}
+	agg.Add(l, &parsedLog{relationships: []*TrustRelationship{NewTrustRelationship()}})
+	agg.Flush()
+
+	// a changeset that has not been posted is not retracted
+	removed := *l
+	removed.Removed = true
+	_, found := chain.Retract(&removed)
+	assert.False(t, found)
+
+	// a changeset acknowledged twice is retracted once
+	emitted.acknowledge()
+	chain.trackTx(tx, 7, &TrustAPIChangeSet{Relationship: []*TrustRelationship{NewTrustRelationship()}, Key: emitted.Key})
+	cs, found := chain.Retract(&removed)
+	assert.True(t, found)
+	assert.Len(t, cs.Relationship, 1)
+}
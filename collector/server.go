@@ -29,17 +29,33 @@ func Serve(cfg config.Schema) (err error) {
 		return c.JSON(http.StatusOK, map[string]interface{}{
 			"status":  "ok",
 			"version": config.Settings.RuntimeVersion,
+			"sources": SourcesHealth(),
 		})
 	})
 
 	e.POST("/subscribe/:address", func(c echo.Context) (err error) {
 		address := NewAddressFromString(c.Param("address"))
-		err = Scan(address)
+		job, err := Scan(address)
 		if err != nil {
 			log.Error(err)
-			return c.JSON(http.StatusTeapot, map[string]string{})
+			return c.JSON(http.StatusServiceUnavailable, job)
 		}
-		return c.JSON(http.StatusOK, map[string]string{})
+		return c.JSON(http.StatusOK, job)
+	})
+	// the scan jobs
+	e.GET("/scan/:id", func(c echo.Context) (err error) {
+		job, found := GetScanJob(c.Param("id"))
+		if !found {
+			return c.JSON(http.StatusNotFound, map[string]string{})
+		}
+		return c.JSON(http.StatusOK, job)
+	})
+	e.GET("/address/:address/scans", func(c echo.Context) (err error) {
+		scans := AddressScans(NewAddressFromString(c.Param("address")))
+		if scans == nil {
+			scans = []ScanJob{}
+		}
+		return c.JSON(http.StatusOK, scans)
 	})
 	err = e.Start(cfg.Server.ListenAddress)
 	if err != nil {
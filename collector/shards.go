@@ -0,0 +1,445 @@
+package collector
+
+import (
+	"context"
+	"fmt"
+	"math/big"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/ethereum/go-ethereum"
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/core/types"
+	log "github.com/sirupsen/logrus"
+)
+
+// States of a log source
+const (
+	SourceConnecting = "connecting"
+	SourceLive       = "live"
+	SourceDown       = "down"
+)
+
+// SourceStatus the health of the source of a shard
+type SourceStatus struct {
+	Shard      int       `json:"shard"`
+	Addresses  int       `json:"addresses"`
+	Events     int       `json:"events,omitempty"`
+	State      string    `json:"state"`
+	Since      time.Time `json:"since"`
+	Reconnects int       `json:"reconnects"`
+	LastError  string    `json:"lastError,omitempty"`
+	LastLog    time.Time `json:"lastLog,omitempty"`
+	Logs       uint64    `json:"logs"`
+}
+
+// SourceHealth the health of a log source, updated by the source, a nil
+// health is not tracked
+type SourceHealth struct {
+	status SourceStatus
+	m      sync.Mutex
+}
+
+func (h *SourceHealth) set(state string, err error) {
+	if h == nil {
+		return
+	}
+	h.m.Lock()
+	defer h.m.Unlock()
+	if err != nil {
+		h.status.LastError = err.Error()
+	}
+	if h.status.State == state {
+		return
+	}
+	if state == SourceConnecting && h.status.State != "" {
+		h.status.Reconnects++
+	}
+	h.status.State, h.status.Since = state, time.Now()
+}
+
+// connecting the source is connecting, or connecting again
+func (h *SourceHealth) connecting() { h.set(SourceConnecting, nil) }
+
+// live the source is delivering the logs
+func (h *SourceHealth) live() { h.set(SourceLive, nil) }
+
+// down the source failed
+func (h *SourceHealth) down(err error) { h.set(SourceDown, err) }
+
+// logged a log has been delivered
+func (h *SourceHealth) logged() {
+	if h == nil {
+		return
+	}
+	h.m.Lock()
+	defer h.m.Unlock()
+	h.status.Logs++
+	h.status.LastLog = time.Now()
+}
+
+// Status the current health
+func (h *SourceHealth) Status() SourceStatus {
+	h.m.Lock()
+	defer h.m.Unlock()
+	return h.status
+}
+
+// ShardWindow how long a log waits for the logs of the same block from the
+// other shards, before it is delivered anyway
+var ShardWindow = 2 * time.Second
+
+// ShardedSource split the addresses of the query in shards of Size addresses,
+// each followed by its own source, with its own health and reconnections, and
+// merge their logs in chain order. The logs from the FromBlock of the query
+// up to the head are fetched for all the shards together, so they are in
+// order, then a live log waits up to Window for the logs of the same block
+// from the other shards.
+type ShardedSource struct {
+	// Client fetch the logs to catch up
+	Client LogPoller
+	// Chain the chain of the addresses, the shards follow their events
+	Chain *Chain
+	// Source create the source of a shard, the source updates its health
+	Source func(health *SourceHealth) LogSource
+	// Size the addresses of a shard, 0 is a single shard
+	Size int
+	// Window how long a log waits for the other shards, ShardWindow if 0
+	Window time.Duration
+	health []*SourceHealth
+	m      sync.Mutex
+}
+
+// shard split the query in a query for the addresses of the chain that follow
+// the same events, filtered by their topics, and split them in groups of size
+func shard(query ethereum.FilterQuery, size int, chain *Chain) (shards []ethereum.FilterQuery) {
+	var groups [][]common.Address
+	var topics [][]common.Hash
+	if len(query.Topics) > 0 {
+		// the topics of the query are for every address
+		groups, topics = [][]common.Address{query.Addresses}, [][]common.Hash{nil}
+	} else {
+		group := make(map[string]int)
+		for _, a := range query.Addresses {
+			t := chain.topicsOf(a)
+			key := fmt.Sprint(t)
+			i, found := group[key]
+			if !found {
+				i = len(groups)
+				group[key] = i
+				groups, topics = append(groups, nil), append(topics, t)
+			}
+			groups[i] = append(groups[i], a)
+		}
+	}
+	if len(groups) == 0 {
+		return []ethereum.FilterQuery{query}
+	}
+	for i, addresses := range groups {
+		for start := 0; start < len(addresses); {
+			end := len(addresses)
+			if size > 0 && start+size < end {
+				end = start + size
+			}
+			q := query
+			q.Addresses = addresses[start:end]
+			if topics[i] != nil {
+				q.Topics = [][]common.Hash{topics[i]}
+			}
+			shards = append(shards, q)
+			start = end
+		}
+	}
+	return
+}
+
+// Health the health of the shards
+func (s *ShardedSource) Health() (status []SourceStatus) {
+	s.m.Lock()
+	defer s.m.Unlock()
+	for _, h := range s.health {
+		status = append(status, h.Status())
+	}
+	return
+}
+
+// Logs implements LogSource, the progress is the one of the slowest shard
+func (s *ShardedSource) Logs(ctx context.Context, query ethereum.FilterQuery, out chan<- types.Log, progress chan<- uint64) {
+	shards := shard(query, s.Size, s.Chain)
+	health := make([]*SourceHealth, len(shards))
+	for i, q := range shards {
+		health[i] = &SourceHealth{status: SourceStatus{Shard: i, Addresses: len(q.Addresses)}}
+		if len(q.Topics) > 0 {
+			health[i].status.Events = len(q.Topics[0])
+		}
+	}
+	s.m.Lock()
+	s.health = health
+	s.m.Unlock()
+	if len(shards) == 1 {
+		// nothing to merge
+		logs, done := make(chan types.Log), make(chan uint64)
+		go s.Source(health[0]).Logs(ctx, shards[0], logs, done)
+		for {
+			select {
+			case l := <-logs:
+				select {
+				case out <- l:
+					health[0].logged()
+				case <-ctx.Done():
+					return
+				}
+			case n := <-done:
+				if !sendProgress(ctx, progress, n) {
+					return
+				}
+			case <-ctx.Done():
+				return
+			}
+		}
+	}
+	log.Infof("following %d addresses in %d shards", len(query.Addresses), len(shards))
+	// start the block up to which every shard has delivered its logs
+	var start uint64
+	if query.FromBlock != nil {
+		if query.FromBlock.Sign() > 0 {
+			start = query.FromBlock.Uint64() - 1
+		}
+		head, err := s.catchUp(ctx, shards, out)
+		if err != nil {
+			// the shards catch up on their own
+			log.Warn("error catching up the log shards: ", err)
+		} else {
+			for i := range shards {
+				shards[i].FromBlock = new(big.Int).SetUint64(head + 1)
+			}
+			start = head
+			if !sendProgress(ctx, progress, head) {
+				return
+			}
+		}
+	}
+	merged := make(chan shardLog)
+	for i, q := range shards {
+		logs, done := make(chan types.Log), make(chan uint64)
+		go s.Source(health[i]).Logs(ctx, q, logs, done)
+		go func(i int) {
+			for {
+				var next shardLog
+				select {
+				case l := <-logs:
+					next = shardLog{shard: i, log: l, received: time.Now()}
+				case n := <-done:
+					next = shardLog{shard: i, log: types.Log{BlockNumber: n}, progress: true}
+				case <-ctx.Done():
+					return
+				}
+				select {
+				case merged <- next:
+				case <-ctx.Done():
+					return
+				}
+			}
+		}(i)
+	}
+	s.merge(ctx, len(shards), start, merged, out, progress, health)
+}
+
+// catchUp deliver the logs of the shards from their FromBlock up to the head,
+// in chain order
+func (s *ShardedSource) catchUp(ctx context.Context, shards []ethereum.FilterQuery, out chan<- types.Log) (head uint64, err error) {
+	if head, err = s.Client.BlockNumber(ctx); err != nil {
+		return
+	}
+	err = FilterShardsRange(ctx, s.Client, shards, shards[0].FromBlock.Uint64(), head, func(l types.Log) error {
+		select {
+		case out <- l:
+			return nil
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	})
+	return
+}
+
+// FilterShardsRange call fn for the logs of the queries in the block range, in
+// chain order, the range is requested in chunks as in FilterLogsRange
+func FilterShardsRange(ctx context.Context, client ethereum.LogFilterer, shards []ethereum.FilterQuery, from, to uint64, fn func(l types.Log) error) (err error) {
+	if len(shards) == 1 {
+		return FilterLogsRange(ctx, client, shards[0], from, to, fn)
+	}
+	for start := from; start <= to; start += logsRangeChunk {
+		end := start + logsRangeChunk - 1
+		if end > to {
+			end = to
+		}
+		var logs []types.Log
+		for _, q := range shards {
+			err = FilterLogsRange(ctx, client, q, start, end, func(l types.Log) error {
+				logs = append(logs, l)
+				return nil
+			})
+			if err != nil {
+				return
+			}
+		}
+		sort.Slice(logs, func(i, j int) bool {
+			return logs[i].BlockNumber < logs[j].BlockNumber || logs[i].BlockNumber == logs[j].BlockNumber && logs[i].Index < logs[j].Index
+		})
+		for _, l := range logs {
+			if err = fn(l); err != nil {
+				return
+			}
+		}
+	}
+	return
+}
+
+// Heads implements LogSource
+func (s *ShardedSource) Heads(ctx context.Context, out chan<- *types.Header) {
+	s.Source(nil).Heads(ctx, out)
+}
+
+// shardLog a log from a shard
+type shardLog struct {
+	shard    int
+	log      types.Log
+	received time.Time
+	// progress the shard has delivered every log up to the block of the
+	// log, which is not a log of the chain
+	progress bool
+}
+
+// merge deliver the logs of the shards in chain order: a log is delivered
+// when every shard has delivered the logs of its block, or after it has
+// waited for the window. The progress sent is the block up to which every
+// shard has delivered its logs, start at first, and they have been
+// delivered on out.
+func (s *ShardedSource) merge(ctx context.Context, shards int, start uint64, merged <-chan shardLog, out chan<- types.Log, progress chan<- uint64, health []*SourceHealth) {
+	window := s.Window
+	if window <= 0 {
+		window = ShardWindow
+	}
+	// cursors the block up to which each shard has delivered its logs, the
+	// logs of a shard come in order
+	cursors := make([]uint64, shards)
+	for i := range cursors {
+		cursors[i] = start
+	}
+	// released the block of the last delivered log
+	var released uint64
+	// reported the last progress sent
+	reported := start
+	var pending []shardLog
+	tick := time.NewTicker(window / 4)
+	defer tick.Stop()
+	deliver := func(l shardLog) bool {
+		select {
+		case out <- l.log:
+			health[l.shard].logged()
+			return true
+		case <-ctx.Done():
+			return false
+		}
+	}
+	release := func() bool {
+		complete := cursors[0]
+		for _, c := range cursors {
+			if c < complete {
+				complete = c
+			}
+		}
+		for len(pending) > 0 {
+			l := pending[0]
+			if l.log.BlockNumber > complete && time.Since(l.received) < window {
+				break
+			}
+			if !deliver(l) {
+				return false
+			}
+			if l.log.BlockNumber > released {
+				released = l.log.BlockNumber
+			}
+			pending = pending[1:]
+		}
+		// the logs still waiting are all past complete
+		if complete > reported {
+			reported = complete
+			return sendProgress(ctx, progress, complete)
+		}
+		return true
+	}
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-tick.C:
+			if !release() {
+				return
+			}
+		case l := <-merged:
+			if l.progress {
+				if l.log.BlockNumber > cursors[l.shard] {
+					cursors[l.shard] = l.log.BlockNumber
+				}
+				if !release() {
+					return
+				}
+				continue
+			}
+			if !l.log.Removed && l.log.BlockNumber > cursors[l.shard]+1 {
+				cursors[l.shard] = l.log.BlockNumber - 1
+			}
+			// the logs of the blocks already delivered and the removed
+			// ones cannot wait
+			if l.log.Removed || l.log.BlockNumber < released {
+				if !deliver(l) {
+					return
+				}
+				continue
+			}
+			i := sort.Search(len(pending), func(i int) bool {
+				p := pending[i].log
+				return p.BlockNumber > l.log.BlockNumber || p.BlockNumber == l.log.BlockNumber && p.Index > l.log.Index
+			})
+			pending = append(pending, shardLog{})
+			copy(pending[i+1:], pending[i:])
+			pending[i] = l
+			if !release() {
+				return
+			}
+		}
+	}
+}
+
+var (
+	logSources  map[string]*ShardedSource
+	logSourcesM sync.RWMutex
+)
+
+func init() {
+	logSources = make(map[string]*ShardedSource)
+}
+
+// registerLogSource make the health of the source of a chain available
+func registerLogSource(network string, s LogSource) {
+	sharded, ok := s.(*ShardedSource)
+	if !ok {
+		return
+	}
+	logSourcesM.Lock()
+	defer logSourcesM.Unlock()
+	logSources[network] = sharded
+}
+
+// SourcesHealth the health of the log shards of every chain
+func SourcesHealth() map[string][]SourceStatus {
+	logSourcesM.RLock()
+	defer logSourcesM.RUnlock()
+	health := make(map[string][]SourceStatus, len(logSources))
+	for network, s := range logSources {
+		health[network] = s.Health()
+	}
+	return health
+}
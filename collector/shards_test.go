@@ -0,0 +1,240 @@
+package collector
+
+import (
+	"context"
+	"math/big"
+	"sort"
+	"testing"
+	"time"
+
+	"github.com/ethereum/go-ethereum"
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/core/types"
+	"github.com/stretchr/testify/assert"
+)
+
+// historyNode answers eth_blockNumber and eth_getLogs from a list of logs
+type historyNode struct {
+	head uint64
+	logs []types.Log
+}
+
+func (n *historyNode) BlockNumber(ctx context.Context) (uint64, error) {
+	return n.head, nil
+}
+
+func (n *historyNode) FilterLogs(ctx context.Context, q ethereum.FilterQuery) (logs []types.Log, err error) {
+	for _, l := range n.logs {
+		if l.BlockNumber >= q.FromBlock.Uint64() && l.BlockNumber <= q.ToBlock.Uint64() && containsAddress(q.Addresses, l.Address) {
+			logs = append(logs, l)
+		}
+	}
+	return
+}
+
+func (n *historyNode) SubscribeFilterLogs(ctx context.Context, q ethereum.FilterQuery, ch chan<- types.Log) (ethereum.Subscription, error) {
+	return nil, nil
+}
+
+func TestShard(t *testing.T) {
+	var addresses []common.Address
+	for i := int64(1); i <= 5; i++ {
+		addresses = append(addresses, common.BigToAddress(big.NewInt(i)))
+	}
+	query := ethereum.FilterQuery{Addresses: addresses}
+	shards := shard(query, 2, nil)
+	if assert.Len(t, shards, 3) {
+		assert.Equal(t, addresses[0:2], shards[0].Addresses)
+		assert.Equal(t, addresses[2:4], shards[1].Addresses)
+		assert.Equal(t, addresses[4:], shards[2].Addresses)
+	}
+	assert.Len(t, shard(query, 0, nil), 1)
+	assert.Len(t, shard(query, 5, nil), 1)
+}
+
+func TestShardedSource(t *testing.T) {
+	a, b, c := common.HexToAddress("0x0a"), common.HexToAddress("0x0b"), common.HexToAddress("0x0c")
+	l := func(address common.Address, block uint64, index uint) types.Log {
+		return types.Log{Address: address, BlockNumber: block, Index: index}
+	}
+	// the history is fetched for all the shards together
+	node := &historyNode{head: 3, logs: []types.Log{
+		l(c, 1, 0), l(a, 1, 1), l(b, 2, 0), l(a, 3, 0), l(c, 3, 1),
+	}}
+	// then every shard follows its addresses
+	live := &chainSource{logs: []types.Log{
+		l(a, 4, 0), l(b, 4, 1), l(c, 4, 2), l(c, 5, 0), l(a, 5, 1), l(b, 6, 0),
+	}}
+	source := &ShardedSource{
+		Client: node,
+		Source: func(health *SourceHealth) LogSource { return live },
+		Size:   1,
+		Window: 100 * time.Millisecond,
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	out := make(chan types.Log)
+	go source.Logs(ctx, ethereum.FilterQuery{Addresses: []common.Address{a, b, c}, FromBlock: big.NewInt(1)}, out, nil)
+
+	var got []types.Log
+	for len(got) < len(node.logs)+len(live.logs) {
+		select {
+		case l := <-out:
+			got = append(got, l)
+		case <-time.After(2 * time.Second):
+			t.Fatalf("%d logs delivered, want %d", len(got), len(node.logs)+len(live.logs))
+		}
+	}
+	// the logs of the shards are in chain order
+	assert.True(t, sort.SliceIsSorted(got, func(i, j int) bool {
+		return got[i].BlockNumber < got[j].BlockNumber || got[i].BlockNumber == got[j].BlockNumber && got[i].Index < got[j].Index
+	}), "%+v", got)
+
+	// a query for each shard, after the history
+	live.m.Lock()
+	if assert.Len(t, live.queries, 3) {
+		for _, q := range live.queries {
+			assert.Len(t, q.Addresses, 1)
+			assert.Equal(t, uint64(4), q.FromBlock.Uint64())
+		}
+	}
+	live.m.Unlock()
+	health := source.Health()
+	if assert.Len(t, health, 3) {
+		for i, h := range health {
+			assert.Equal(t, i, h.Shard)
+			assert.Equal(t, 1, h.Addresses)
+			assert.Equal(t, uint64(2), h.Logs)
+		}
+	}
+}
+
+func TestSourceHealth(t *testing.T) {
+	minBackoff, maxBackoff = time.Millisecond, time.Millisecond
+	node := newFakeNode()
+	node.logs = []types.Log{{BlockNumber: 1}}
+	health := &SourceHealth{}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	out := make(chan types.Log)
+	go subscribeLogs(ctx, node, ethereum.FilterQuery{}, out, nil, health)
+
+	<-node.ready
+	go node.emit(types.Log{BlockNumber: 2, Index: 1}, true)
+	<-out
+	assert.Equal(t, SourceLive, health.Status().State)
+
+	// a dropped subscription is counted and reported
+	node.drop()
+	<-node.ready
+	go node.emit(types.Log{BlockNumber: 3, Index: 2}, true)
+	<-out
+	status := health.Status()
+	assert.Equal(t, SourceLive, status.State)
+	assert.Equal(t, 1, status.Reconnects)
+	assert.Contains(t, status.LastError, "abnormal closure")
+
+	// a nil health is not tracked
+	var none *SourceHealth
+	none.connecting()
+	none.down(nil)
+	none.logged()
+}
+
+// scriptedSource a shard source whose logs and progress are pushed by the
+// test
+type scriptedSource struct {
+	logs     chan types.Log
+	progress chan uint64
+}
+
+func (s *scriptedSource) Logs(ctx context.Context, query ethereum.FilterQuery, out chan<- types.Log, progress chan<- uint64) {
+	for {
+		select {
+		case l := <-s.logs:
+			out <- l
+		case n := <-s.progress:
+			progress <- n
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+func (s *scriptedSource) Heads(ctx context.Context, out chan<- *types.Header) {}
+
+func TestShardedSourceBackfillHoldsTheCheckpoint(t *testing.T) {
+	a, b := common.HexToAddress("0x0a"), common.HexToAddress("0x0b")
+	shards := []*scriptedSource{
+		{logs: make(chan types.Log), progress: make(chan uint64)},
+		{logs: make(chan types.Log), progress: make(chan uint64)},
+	}
+	source := &ShardedSource{
+		Source: func(health *SourceHealth) LogSource { return shards[health.status.Shard] },
+		Size:   1,
+		Window: 10 * time.Millisecond,
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	out, progress := make(chan types.Log), make(chan uint64)
+	go source.Logs(ctx, ethereum.FilterQuery{Addresses: []common.Address{a, b}}, out, progress)
+
+	// the checkpoint as the collector moves it, every log is posted at once
+	checkpoint, err := NewCheckpoint(nil, CheckpointKey(big.NewInt(1), nil))
+	assert.Nil(t, err)
+	receive := func() types.Log {
+		for {
+			select {
+			case l := <-out:
+				return l
+			case n := <-progress:
+				checkpoint.Progress(n)
+				checkpoint.Reach(n)
+			case <-time.After(2 * time.Second):
+				t.Fatal("log not delivered")
+			}
+		}
+	}
+
+	reaches := func(block uint64) {
+		assert.Eventually(t, func() bool {
+			select {
+			case n := <-progress:
+				checkpoint.Progress(n)
+				checkpoint.Reach(n)
+			default:
+			}
+			return checkpoint.Block == block
+		}, time.Second, time.Millisecond)
+	}
+
+	// both shards are live up to block 1
+	shards[0].progress <- 1
+	shards[1].progress <- 1
+	reaches(1)
+
+	// the shard of b goes down, the one of a goes on, its logs are
+	// delivered after the window
+	shards[0].logs <- types.Log{Address: a, BlockNumber: 3}
+	shards[0].logs <- types.Log{Address: a, BlockNumber: 5}
+	shards[0].progress <- 6
+	assert.Equal(t, uint64(3), receive().BlockNumber)
+	assert.Equal(t, uint64(5), receive().BlockNumber)
+	time.Sleep(50 * time.Millisecond)
+	select {
+	case n := <-progress:
+		t.Fatalf("progress %d past the shard that is down", n)
+	default:
+	}
+	assert.Equal(t, uint64(1), checkpoint.Block)
+
+	// the shard of b backfills its gap, older than the delivered logs
+	shards[1].logs <- types.Log{Address: b, BlockNumber: 2}
+	assert.Equal(t, uint64(2), receive().BlockNumber)
+	assert.Equal(t, uint64(1), checkpoint.Block)
+	shards[1].logs <- types.Log{Address: b, BlockNumber: 4}
+	assert.Equal(t, uint64(4), receive().BlockNumber)
+	reaches(3)
+	shards[1].progress <- 6
+	reaches(6)
+}
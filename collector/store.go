@@ -1,6 +1,12 @@
 package collector
 
 import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
 	"time"
 
 	"github.com/xujiajun/nutsdb"
@@ -9,29 +15,133 @@ import (
 // Store a store for transactions
 type Store struct {
 	db *nutsdb.DB
+	// lock the file that keeps the other processes out of the store
+	lock *os.File
 }
 
+// ErrStoreLocked the store is used by another process
+var ErrStoreLocked = errors.New("the store is used by another process")
+
+// storeLockFile the file locked by the process that opened the store
+const storeLockFile = "LOCK"
+
+// store is the store opened by Ready, it is nil if the collector runs
+// without persistence
+var store *Store
+
 // OpenStore open the storage for writing
 func OpenStore(storePath string) (db *Store, err error) {
 	// Open the database located in the /tmp/nutsdb directory.
 	// It will be created if it doesn't exist.
-	store := new(Store)
+	db = new(Store)
+	// nutsdb does not lock the folder, two processes writing the same
+	// files would corrupt it
+	if err = os.MkdirAll(storePath, 0755); err != nil {
+		return
+	}
+	if db.lock, err = os.OpenFile(filepath.Join(storePath, storeLockFile), os.O_CREATE|os.O_RDWR, 0644); err != nil {
+		return
+	}
+	if err = lockFile(db.lock); err != nil {
+		db.lock.Close()
+		return nil, fmt.Errorf("%w: %v", ErrStoreLocked, err)
+	}
 	opt := nutsdb.DefaultOptions
 	opt.Dir = storePath
-	store.db, err = nutsdb.Open(opt)
+	if db.db, err = nutsdb.Open(opt); err != nil {
+		db.lock.Close()
+		return nil, err
+	}
 	return
 }
 
-const (
-	txBucket = "txs"
-)
+// Put store the json encoding of value at key
+func (db *Store) Put(bucket, key string, value interface{}) (err error) {
+	return db.PutTTL(bucket, key, value, 0)
+}
+
+// PutTTL store the json encoding of value at key, the value expires after
+// ttl, a ttl of 0 never expires
+func (db *Store) PutTTL(bucket, key string, value interface{}, ttl time.Duration) (err error) {
+	bin, err := json.Marshal(value)
+	if err != nil {
+		return
+	}
+	err = db.db.Update(func(tx *nutsdb.Tx) error {
+		return tx.Put(bucket, []byte(key), bin, uint32(ttl.Seconds()))
+	})
+	return
+}
+
+// Get read the value at key into value, found is false if the key is missing
+func (db *Store) Get(bucket, key string, value interface{}) (found bool, err error) {
+	var bin []byte
+	db.db.View(func(tx *nutsdb.Tx) error {
+		e, err := tx.Get(bucket, []byte(key))
+		if err != nil {
+			// the key or the bucket do not exist
+			return err
+		}
+		bin = e.Value
+		return nil
+	})
+	if bin == nil {
+		return
+	}
+	found = true
+	err = json.Unmarshal(bin, value)
+	return
+}
+
+// Delete remove a key from the bucket, removing a missing key is not an error
+func (db *Store) Delete(bucket, key string) (err error) {
+	err = db.db.Update(func(tx *nutsdb.Tx) error {
+		return tx.Delete(bucket, []byte(key))
+	})
+	return
+}
 
-// Tx store a transaction
-func (db *Store) Tx(from, to string, when time.Time) {
-	//TODO: nohop
+// All call fn for every key in the bucket, sorted by key
+func (db *Store) All(bucket string, fn func(key string, value []byte) error) (err error) {
+	var entries nutsdb.Entries
+	db.db.View(func(tx *nutsdb.Tx) error {
+		// an empty bucket is an error for nutsdb
+		entries, _ = tx.GetAll(bucket)
+		return nil
+	})
+	sort.Slice(entries, func(i, j int) bool {
+		return string(entries[i].Key) < string(entries[j].Key)
+	})
+	for _, e := range entries {
+		if err = fn(string(e.Key), e.Value); err != nil {
+			return
+		}
+	}
+	return
+}
+
+// Range call fn for every key in the bucket from start to end, both
+// included, sorted by key
+func (db *Store) Range(bucket, start, end string, fn func(key string, value []byte) error) (err error) {
+	var entries nutsdb.Entries
+	db.db.View(func(tx *nutsdb.Tx) error {
+		// an empty range is an error for nutsdb
+		entries, _ = tx.RangeScan(bucket, []byte(start), []byte(end))
+		return nil
+	})
+	sort.Slice(entries, func(i, j int) bool {
+		return string(entries[i].Key) < string(entries[j].Key)
+	})
+	for _, e := range entries {
+		if err = fn(string(e.Key), e.Value); err != nil {
+			return
+		}
+	}
+	return
 }
 
-// Close closes the store
+// Close closes the store, and lets the other processes open it
 func (db *Store) Close() {
 	db.db.Close()
+	db.lock.Close()
 }
@@ -0,0 +1,14 @@
+//go:build !windows
+
+package collector
+
+import (
+	"os"
+	"syscall"
+)
+
+// lockFile take an exclusive lock on the file, it fails right away if
+// another process holds it, the lock is released when the file is closed
+func lockFile(f *os.File) error {
+	return syscall.Flock(int(f.Fd()), syscall.LOCK_EX|syscall.LOCK_NB)
+}
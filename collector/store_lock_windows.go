@@ -0,0 +1,10 @@
+package collector
+
+import (
+	"os"
+)
+
+// lockFile there is no flock on windows, the store is not locked there
+func lockFile(f *os.File) error {
+	return nil
+}
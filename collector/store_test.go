@@ -0,0 +1,24 @@
+package collector
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestStoreLock(t *testing.T) {
+	dir := t.TempDir()
+	s, err := OpenStore(dir)
+	assert.Nil(t, err)
+
+	// another process cannot open the store while it is open
+	_, err = OpenStore(dir)
+	assert.True(t, errors.Is(err, ErrStoreLocked), "%v", err)
+
+	// and it can once it is closed
+	s.Close()
+	s, err = OpenStore(dir)
+	assert.Nil(t, err)
+	s.Close()
+}
@@ -0,0 +1,263 @@
+package collector
+
+import (
+	"context"
+	"fmt"
+	"math/big"
+	"time"
+
+	"github.com/ethereum/go-ethereum"
+	"github.com/ethereum/go-ethereum/core/types"
+	"github.com/ethereum/go-ethereum/event"
+	log "github.com/sirupsen/logrus"
+)
+
+// backoff bounds for the subscription retries
+var (
+	minBackoff = time.Second
+	maxBackoff = time.Minute
+)
+
+// LogSubscriber the node api used to follow the chain
+type LogSubscriber interface {
+	ethereum.LogFilterer
+	HeaderByNumber(ctx context.Context, number *big.Int) (*types.Header, error)
+	SubscribeNewHead(ctx context.Context, ch chan<- *types.Header) (ethereum.Subscription, error)
+}
+
+// logCursor the position of the last delivered log
+type logCursor struct {
+	block uint64
+	index uint
+	set   bool
+}
+
+// after tells if the log comes after the cursor
+func (c *logCursor) after(l *types.Log) bool {
+	if !c.set || l.BlockNumber > c.block {
+		return true
+	}
+	return l.BlockNumber == c.block && l.Index > c.index
+}
+
+func (c *logCursor) move(l *types.Log) {
+	if !l.Removed && c.after(l) {
+		c.block, c.index, c.set = l.BlockNumber, l.Index, true
+	}
+}
+
+// SubscribeLogs deliver the logs matching the query on out until ctx is done.
+// When the subscription drops it subscribes again, with an increasing
+// backoff, and backfills the logs emitted while it was down.
+// If the query has a FromBlock the logs from that block up to the head are
+// delivered first, before the ones from the subscription.
+func SubscribeLogs(ctx context.Context, client LogSubscriber, query ethereum.FilterQuery, out chan<- types.Log) {
+	subscribeLogs(ctx, client, query, out, nil, nil)
+}
+
+// subscribeLogs is SubscribeLogs updating the health of the source and
+// sending its progress, if progress is not nil: the head of the backfill,
+// then the block before every new head, whose logs the node notifies first
+func subscribeLogs(ctx context.Context, client LogSubscriber, query ethereum.FilterQuery, out chan<- types.Log, progress chan<- uint64, health *SourceHealth) {
+	var cursor logCursor
+	if query.FromBlock != nil && query.FromBlock.Sign() > 0 {
+		// catch up from the start block
+		cursor = logCursor{block: query.FromBlock.Uint64() - 1, index: ^uint(0), set: true}
+	}
+	// the subscription is for new logs only
+	query.FromBlock, query.ToBlock = nil, nil
+	backoff := minBackoff
+	for {
+		health.connecting()
+		logs := make(chan types.Log)
+		sub, err := client.SubscribeFilterLogs(ctx, query, logs)
+		if err == nil {
+			var heads *progressHeads
+			if heads, err = subscribeProgress(ctx, client, progress); err == nil {
+				// fill the gap since the last delivered log
+				var seen map[string]bool
+				var head uint64
+				seen, head, err = backfill(ctx, client, query, &cursor, out)
+				if err == nil && !sendProgress(ctx, progress, head) {
+					err = ctx.Err()
+				}
+				if err == nil {
+					backoff = minBackoff
+					health.live()
+					err = forward(ctx, sub, logs, out, &cursor, seen, head, heads)
+				}
+				heads.sub.Unsubscribe()
+			}
+			sub.Unsubscribe()
+		}
+		if ctx.Err() != nil {
+			return
+		}
+		health.down(err)
+		log.Warnf("log subscription failed, retrying in %s: %v", backoff, err)
+		if !sleep(ctx, backoff) {
+			return
+		}
+		backoff = nextBackoff(backoff)
+	}
+}
+
+// backfill deliver the logs between the cursor and the head of the chain,
+// it returns the keys of the delivered logs to skip them on the subscription.
+// A cursor that is not set starts from the head, so the gaps of the next
+// subscriptions are backfilled even if no log has been delivered.
+func backfill(ctx context.Context, client LogSubscriber, query ethereum.FilterQuery, cursor *logCursor, out chan<- types.Log) (seen map[string]bool, head uint64, err error) {
+	header, err := client.HeaderByNumber(ctx, nil)
+	if err != nil {
+		return
+	}
+	head = header.Number.Uint64()
+	if !cursor.set {
+		*cursor = logCursor{block: head, index: ^uint(0), set: true}
+		return
+	}
+	from := cursor.block
+	seen = make(map[string]bool)
+	err = FilterLogsRange(ctx, client, query, from, head, func(l types.Log) error {
+		if !cursor.after(&l) {
+			return nil
+		}
+		select {
+		case out <- l:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+		seen[LogKey(l.TxHash, l.Index)] = true
+		cursor.move(&l)
+		return nil
+	})
+	if len(seen) > 0 {
+		log.Infof("backfilled %d logs from block %d to %d", len(seen), from, head)
+	}
+	return
+}
+
+// progressHeads the heads subscription a log subscription reports its
+// progress with
+type progressHeads struct {
+	sub   ethereum.Subscription
+	heads chan *types.Header
+	out   chan<- uint64
+}
+
+// subscribeProgress subscribe the new heads to send the progress on out, when
+// out is nil nothing is subscribed
+func subscribeProgress(ctx context.Context, client LogSubscriber, out chan<- uint64) (p *progressHeads, err error) {
+	p = &progressHeads{out: out}
+	if out == nil {
+		p.sub = event.NewSubscription(func(quit <-chan struct{}) error {
+			<-quit
+			return nil
+		})
+		return
+	}
+	p.heads = make(chan *types.Header)
+	p.sub, err = client.SubscribeNewHead(ctx, p.heads)
+	return
+}
+
+// forward deliver the logs from the subscription, and the progress of the
+// heads, until one of the subscriptions fails
+func forward(ctx context.Context, sub ethereum.Subscription, logs <-chan types.Log, out chan<- types.Log, cursor *logCursor, seen map[string]bool, head uint64, heads *progressHeads) (err error) {
+	// reported the last progress sent, the backfill sent its head
+	reported := head
+	for {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case err = <-sub.Err():
+			if err == nil {
+				err = fmt.Errorf("subscription closed")
+			}
+			return
+		case err = <-heads.sub.Err():
+			if err == nil {
+				err = fmt.Errorf("head subscription closed")
+			}
+			return
+		case h := <-heads.heads:
+			if n := h.Number.Uint64(); n > reported+1 {
+				reported = n - 1
+				if !sendProgress(ctx, heads.out, reported) {
+					return ctx.Err()
+				}
+			}
+		case l := <-logs:
+			if l.BlockNumber > head {
+				// past the backfilled range
+				seen = nil
+			}
+			if !l.Removed && seen[LogKey(l.TxHash, l.Index)] {
+				continue
+			}
+			select {
+			case out <- l:
+			case <-ctx.Done():
+				return ctx.Err()
+			}
+			cursor.move(&l)
+		}
+	}
+}
+
+// SubscribeHeads deliver the new chain heads on out until ctx is done,
+// subscribing again when the subscription drops
+func SubscribeHeads(ctx context.Context, client LogSubscriber, out chan<- *types.Header) {
+	backoff := minBackoff
+	for {
+		heads := make(chan *types.Header)
+		sub, err := client.SubscribeNewHead(ctx, heads)
+		if err == nil {
+			backoff = minBackoff
+		forward:
+			for {
+				select {
+				case <-ctx.Done():
+					sub.Unsubscribe()
+					return
+				case err = <-sub.Err():
+					break forward
+				case h := <-heads:
+					select {
+					case out <- h:
+					case <-ctx.Done():
+					}
+				}
+			}
+			sub.Unsubscribe()
+		}
+		if ctx.Err() != nil {
+			return
+		}
+		log.Warnf("head subscription failed, retrying in %s: %v", backoff, err)
+		if !sleep(ctx, backoff) {
+			return
+		}
+		backoff = nextBackoff(backoff)
+	}
+}
+
+func nextBackoff(d time.Duration) time.Duration {
+	d *= 2
+	if d > maxBackoff {
+		d = maxBackoff
+	}
+	return d
+}
+
+// sleep wait for d, returns false if ctx is done before
+func sleep(ctx context.Context, d time.Duration) bool {
+	t := time.NewTimer(d)
+	defer t.Stop()
+	select {
+	case <-t.C:
+		return true
+	case <-ctx.Done():
+		return false
+	}
+}
@@ -0,0 +1,208 @@
+package collector
+
+import (
+	"context"
+	"errors"
+	"math/big"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/ethereum/go-ethereum"
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/core/types"
+	"github.com/ethereum/go-ethereum/event"
+	"github.com/stretchr/testify/assert"
+)
+
+// fakeNode a node whose subscriptions can be dropped
+type fakeNode struct {
+	m     sync.Mutex
+	logs  []types.Log
+	subs  []chan<- types.Log
+	drops []chan error
+	heads []chan<- *types.Header
+	ready chan bool
+}
+
+func newFakeNode() *fakeNode {
+	return &fakeNode{ready: make(chan bool, 10)}
+}
+
+// emit add a log to the chain and push it to the subscription, if any
+func (n *fakeNode) emit(l types.Log, push bool) {
+	n.m.Lock()
+	n.logs = append(n.logs, l)
+	var sub chan<- types.Log
+	if push && len(n.subs) > 0 {
+		sub = n.subs[len(n.subs)-1]
+	}
+	n.m.Unlock()
+	if sub != nil {
+		sub <- l
+	}
+}
+
+// drop make the current subscription fail
+func (n *fakeNode) drop() {
+	n.m.Lock()
+	drop := n.drops[len(n.drops)-1]
+	n.m.Unlock()
+	drop <- errors.New("websocket: close 1006 (abnormal closure)")
+}
+
+func (n *fakeNode) SubscribeFilterLogs(ctx context.Context, q ethereum.FilterQuery, ch chan<- types.Log) (ethereum.Subscription, error) {
+	n.m.Lock()
+	defer n.m.Unlock()
+	drop := make(chan error)
+	n.subs = append(n.subs, ch)
+	n.drops = append(n.drops, drop)
+	n.ready <- true
+	return event.NewSubscription(func(quit <-chan struct{}) error {
+		select {
+		case err := <-drop:
+			return err
+		case <-quit:
+			return nil
+		}
+	}), nil
+}
+
+func (n *fakeNode) FilterLogs(ctx context.Context, q ethereum.FilterQuery) (logs []types.Log, err error) {
+	n.m.Lock()
+	defer n.m.Unlock()
+	for _, l := range n.logs {
+		if l.BlockNumber >= q.FromBlock.Uint64() && l.BlockNumber <= q.ToBlock.Uint64() {
+			logs = append(logs, l)
+		}
+	}
+	return
+}
+
+func (n *fakeNode) HeaderByNumber(ctx context.Context, number *big.Int) (*types.Header, error) {
+	n.m.Lock()
+	defer n.m.Unlock()
+	var head uint64
+	if len(n.logs) > 0 {
+		head = n.logs[len(n.logs)-1].BlockNumber
+	}
+	return &types.Header{Number: new(big.Int).SetUint64(head)}, nil
+}
+
+// head push a new head to the head subscription
+func (n *fakeNode) head(number uint64) {
+	n.m.Lock()
+	heads := n.heads[len(n.heads)-1]
+	n.m.Unlock()
+	heads <- &types.Header{Number: new(big.Int).SetUint64(number)}
+}
+
+func (n *fakeNode) SubscribeNewHead(ctx context.Context, ch chan<- *types.Header) (ethereum.Subscription, error) {
+	n.m.Lock()
+	defer n.m.Unlock()
+	n.heads = append(n.heads, ch)
+	return event.NewSubscription(func(quit <-chan struct{}) error {
+		<-quit
+		return nil
+	}), nil
+}
+
+func TestSubscribeLogsReconnectsAndBackfills(t *testing.T) {
+	minBackoff, maxBackoff = time.Millisecond, time.Millisecond
+	node := newFakeNode()
+	out := make(chan types.Log)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go SubscribeLogs(ctx, node, ethereum.FilterQuery{}, out)
+
+	mkLog := func(block uint64, index uint) types.Log {
+		return types.Log{BlockNumber: block, Index: index, TxHash: common.BigToHash(big.NewInt(int64(index)))}
+	}
+	<-node.ready
+	go node.emit(mkLog(1, 0), true)
+	assert.Equal(t, uint(0), (<-out).Index)
+
+	// logs are emitted but not delivered, then the connection drops
+	node.emit(mkLog(1, 1), false)
+	node.emit(mkLog(2, 2), false)
+	node.drop()
+	<-node.ready
+
+	// the missed logs are backfilled, the delivered one is not repeated
+	assert.Equal(t, uint(1), (<-out).Index)
+	assert.Equal(t, uint(2), (<-out).Index)
+
+	// the live logs that overlap the backfill are skipped
+	go func() {
+		node.emit(mkLog(2, 2), true)
+		node.emit(mkLog(3, 3), true)
+	}()
+	assert.Equal(t, uint(3), (<-out).Index)
+}
+
+func TestSubscribeLogsCatchesUpFromBlock(t *testing.T) {
+	node := newFakeNode()
+	for i := uint(1); i <= 3; i++ {
+		node.emit(types.Log{BlockNumber: uint64(i), Index: i, TxHash: common.BigToHash(big.NewInt(int64(i)))}, false)
+	}
+	out := make(chan types.Log)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go SubscribeLogs(ctx, node, ethereum.FilterQuery{FromBlock: big.NewInt(2)}, out)
+
+	<-node.ready
+	assert.Equal(t, uint64(2), (<-out).BlockNumber)
+	assert.Equal(t, uint64(3), (<-out).BlockNumber)
+	go node.emit(types.Log{BlockNumber: 4, Index: 4}, true)
+	assert.Equal(t, uint64(4), (<-out).BlockNumber)
+}
+
+func TestSubscribeLogsBackfillsBeforeTheFirstLog(t *testing.T) {
+	minBackoff, maxBackoff = time.Millisecond, time.Millisecond
+	node := newFakeNode()
+	mkLog := func(block uint64, index uint) types.Log {
+		return types.Log{BlockNumber: block, Index: index, TxHash: common.BigToHash(big.NewInt(int64(index)))}
+	}
+	// a log of the history, before the subscription
+	node.emit(mkLog(5, 0), false)
+	out := make(chan types.Log)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	health := &SourceHealth{}
+	go subscribeLogs(ctx, node, ethereum.FilterQuery{}, out, nil, health)
+	<-node.ready
+	assert.Eventually(t, func() bool { return health.Status().State == SourceLive }, time.Second, time.Millisecond)
+
+	// the connection drops before any log is delivered, the gap is
+	// backfilled from the head at the first subscription
+	node.emit(mkLog(6, 1), false)
+	node.drop()
+	<-node.ready
+	assert.Equal(t, uint(1), (<-out).Index)
+}
+
+func TestSubscribeLogsProgress(t *testing.T) {
+	node := newFakeNode()
+	node.emit(types.Log{BlockNumber: 1, TxHash: common.BigToHash(big.NewInt(1))}, false)
+	out, progress := make(chan types.Log), make(chan uint64)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go subscribeLogs(ctx, node, ethereum.FilterQuery{FromBlock: big.NewInt(1)}, out, progress, nil)
+
+	<-node.ready
+	assert.Equal(t, uint64(1), (<-out).BlockNumber)
+	// the backfill is delivered up to the head
+	assert.Equal(t, uint64(1), <-progress)
+
+	// the logs of a block come before its head
+	go func() {
+		node.emit(types.Log{BlockNumber: 3, Index: 1, TxHash: common.BigToHash(big.NewInt(3))}, true)
+		node.head(3)
+	}()
+	assert.Equal(t, uint64(3), (<-out).BlockNumber)
+	assert.Equal(t, uint64(2), <-progress)
+
+	// on a quiet chain the progress follows the heads
+	go node.head(10)
+	assert.Equal(t, uint64(9), <-progress)
+}
@@ -0,0 +1,169 @@
+package collector
+
+import (
+	"context"
+	"fmt"
+	"math/big"
+	"strings"
+
+	"github.com/ethereum/go-ethereum"
+	"github.com/ethereum/go-ethereum/accounts/abi"
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/core/types"
+	lru "github.com/hashicorp/golang-lru"
+	log "github.com/sirupsen/logrus"
+)
+
+// TokenCacheSize how many tokens metadata are cached
+const TokenCacheSize = 4096
+
+// erc20MetadataABI the optional metadata methods of an ERC-20 token
+const erc20MetadataABI = `[
+	{"constant":true,"inputs":[],"name":"name","outputs":[{"name":"","type":"string"}],"type":"function"},
+	{"constant":true,"inputs":[],"name":"symbol","outputs":[{"name":"","type":"string"}],"type":"function"},
+	{"constant":true,"inputs":[],"name":"decimals","outputs":[{"name":"","type":"uint8"}],"type":"function"}
+]`
+
+var (
+	erc20ABI   abi.ABI
+	tokenCache *lru.Cache
+)
+
+func init() {
+	var err error
+	if erc20ABI, err = abi.JSON(strings.NewReader(erc20MetadataABI)); err != nil {
+		panic(err)
+	}
+	tokenCache, _ = lru.New(TokenCacheSize)
+}
+
+// TokenInfo the metadata of an ERC-20 token, the methods are optional so
+// any of them can be missing
+type TokenInfo struct {
+	Address     string
+	Name        string
+	Symbol      string
+	Decimals    uint8
+	HasDecimals bool
+}
+
+// tokenKey a token on the chain of a client, the same address on another
+// chain is another token
+type tokenKey struct {
+	client  ethereum.ContractCaller
+	address common.Address
+}
+
+// Token read the metadata of a token with eth_call, the metadata is cached
+func Token(ctx context.Context, client ethereum.ContractCaller, address common.Address) (info *TokenInfo, err error) {
+	key := tokenKey{client, address}
+	if v, found := tokenCache.Get(key); found {
+		return v.(*TokenInfo), nil
+	}
+	info = &TokenInfo{Address: strings.ToLower(address.Hex())}
+	if info.Name, err = callString(ctx, client, address, "name"); err != nil {
+		return
+	}
+	if info.Symbol, err = callString(ctx, client, address, "symbol"); err != nil {
+		return
+	}
+	out, err := callToken(ctx, client, address, "decimals")
+	if err != nil {
+		return
+	}
+	if values, uerr := erc20ABI.Unpack("decimals", out); uerr == nil && len(values) == 1 {
+		info.Decimals, info.HasDecimals = values[0].(uint8)
+	}
+	tokenCache.Add(key, info)
+	return
+}
+
+// callToken call a metadata method, a method that reverts returns no output
+// and no error, so that the missing methods are cached too
+func callToken(ctx context.Context, client ethereum.ContractCaller, address common.Address, method string) (out []byte, err error) {
+	input, err := erc20ABI.Pack(method)
+	if err != nil {
+		return
+	}
+	out, err = client.CallContract(ctx, ethereum.CallMsg{To: &address, Data: input}, nil)
+	if err != nil && strings.Contains(err.Error(), "revert") {
+		return nil, nil
+	}
+	return
+}
+
+// callString call a method that returns a string, some old tokens return
+// a bytes32 instead
+func callString(ctx context.Context, client ethereum.ContractCaller, address common.Address, method string) (s string, err error) {
+	out, err := callToken(ctx, client, address, method)
+	if err != nil || len(out) == 0 {
+		return
+	}
+	if values, uerr := erc20ABI.Unpack(method, out); uerr == nil && len(values) == 1 {
+		s, _ = values[0].(string)
+		return
+	}
+	if len(out) == 32 {
+		s = strings.TrimRight(string(out), "\x00")
+	}
+	return
+}
+
+// FormatAmount format a raw amount adjusted for the token decimals, without
+// trailing zeros, e.g. 1500000 with 6 decimals is 1.5
+func FormatAmount(raw *big.Int, decimals uint8) string {
+	if decimals == 0 {
+		return raw.String()
+	}
+	unit := new(big.Int).Exp(big.NewInt(10), big.NewInt(int64(decimals)), nil)
+	abs := new(big.Int).Abs(raw)
+	integer, fraction := new(big.Int).QuoRem(abs, unit, new(big.Int))
+	s := integer.String()
+	if fraction.Sign() != 0 {
+		f := fmt.Sprintf("%0*s", decimals, fraction.String())
+		s += "." + strings.TrimRight(f, "0")
+	}
+	if raw.Sign() < 0 {
+		s = "-" + s
+	}
+	return s
+}
+
+// transferAmount the amount moved by an ERC-20 transfer, with the token
+// metadata when it can be read
+func transferAmount(vLog *types.Log, client ethereum.ContractCaller, raw *big.Int) (amount *AssetAmount) {
+	if raw == nil {
+		return
+	}
+	amount = &AssetAmount{Asset: strings.ToLower(vLog.Address.Hex()), Amount: raw.String()}
+	info, err := Token(context.Background(), client, vLog.Address)
+	if err != nil {
+		log.Warnf("cannot read the metadata of token %s: %v", vLog.Address.Hex(), err)
+		return
+	}
+	amount.Symbol = info.Symbol
+	amount.Name = info.Name
+	if info.HasDecimals {
+		decimals := info.Decimals
+		amount.Decimals = &decimals
+		amount.Value = FormatAmount(raw, decimals)
+	}
+	return
+}
+
+// withAmount add the amount of a transfer to the action properties
+func withAmount(a *Action, amount *AssetAmount) {
+	if amount == nil {
+		return
+	}
+	a.Properties[PropAmount] = amount.Amount
+	if amount.Value != "" {
+		a.Properties[PropAmountValue] = amount.Value
+	}
+	if amount.Symbol != "" {
+		a.Properties[PropTokenSymbol] = amount.Symbol
+	}
+	if amount.Name != "" {
+		a.Properties[PropTokenName] = amount.Name
+	}
+}
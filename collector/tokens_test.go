@@ -0,0 +1,91 @@
+package collector
+
+import (
+	"context"
+	"errors"
+	"math/big"
+	"testing"
+
+	"github.com/ethereum/go-ethereum"
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/core/types"
+	"github.com/stretchr/testify/assert"
+)
+
+// fakeToken answers the eth_call of the token metadata
+type fakeToken struct {
+	outputs map[string][]byte
+	calls   int
+}
+
+func (f *fakeToken) CallContract(ctx context.Context, call ethereum.CallMsg, blockNumber *big.Int) ([]byte, error) {
+	f.calls++
+	method, err := erc20ABI.MethodById(call.Data)
+	if err != nil {
+		return nil, err
+	}
+	out, found := f.outputs[method.Name]
+	if !found {
+		return nil, errors.New("execution reverted")
+	}
+	return out, nil
+}
+
+func TestFormatAmount(t *testing.T) {
+	assert.Equal(t, "1.5", FormatAmount(big.NewInt(1500000), 6))
+	assert.Equal(t, "0.000001", FormatAmount(big.NewInt(1), 6))
+	assert.Equal(t, "42", FormatAmount(big.NewInt(42000000), 6))
+	assert.Equal(t, "42", FormatAmount(big.NewInt(42), 0))
+	assert.Equal(t, "-2.25", FormatAmount(big.NewInt(-225), 2))
+	wei, _ := new(big.Int).SetString("1234567890000000000000", 10)
+	assert.Equal(t, "1234.56789", FormatAmount(wei, 18))
+}
+
+func TestTransferAmount(t *testing.T) {
+	name, _ := erc20ABI.Methods["name"].Outputs.Pack("USD Coin")
+	symbol, _ := erc20ABI.Methods["symbol"].Outputs.Pack("USDC")
+	decimals, _ := erc20ABI.Methods["decimals"].Outputs.Pack(uint8(6))
+	usdc := &fakeToken{outputs: map[string][]byte{"name": name, "symbol": symbol, "decimals": decimals}}
+
+	vLog := &types.Log{
+		Address: common.HexToAddress("0xa0b86991c6218b36c1d19d4a2e9eb0ce3606eb48"),
+		Topics: []common.Hash{
+			common.HexToHash("0xddf252ad1be2c89b69c2b068fc378daa952ba7f163c4a11628f55a4df523b3ef"),
+			common.HexToHash("0xa1"),
+			common.HexToHash("0xb2"),
+		},
+	}
+	amount := transferAmount(vLog, usdc, big.NewInt(2500000))
+	if assert.NotNil(t, amount) {
+		assert.Equal(t, "0xa0b86991c6218b36c1d19d4a2e9eb0ce3606eb48", amount.Asset)
+		assert.Equal(t, "2500000", amount.Amount)
+		assert.Equal(t, "2.5", amount.Value)
+		assert.Equal(t, "USDC", amount.Symbol)
+		assert.Equal(t, "USD Coin", amount.Name)
+		assert.Equal(t, uint8(6), *amount.Decimals)
+	}
+	// the metadata is cached
+	calls := usdc.calls
+	transferAmount(vLog, usdc, big.NewInt(2500000))
+	assert.Equal(t, calls, usdc.calls)
+
+	a := NewAction(ActionTransfer, nil, nil)
+	withAmount(a, amount)
+	assert.Equal(t, "2500000", a.Properties["amount"])
+	assert.Equal(t, "2.5", a.Properties["amountValue"])
+	assert.Equal(t, "USDC", a.Properties["tokenSymbol"])
+
+	// old tokens return a bytes32 symbol, and can miss the other methods
+	mkr := &fakeToken{outputs: map[string][]byte{"symbol": common.RightPadBytes([]byte("MKR"), 32)}}
+	vLog.Address = common.HexToAddress("0x9f8f72aa9304c8b593d555f12ef6589cc3a579a2")
+	amount = transferAmount(vLog, mkr, big.NewInt(2500000))
+	if assert.NotNil(t, amount) {
+		assert.Equal(t, "MKR", amount.Symbol)
+		assert.Equal(t, "", amount.Name)
+		assert.Equal(t, "", amount.Value)
+		assert.Nil(t, amount.Decimals)
+	}
+
+	// a transfer without an amount
+	assert.Nil(t, transferAmount(vLog, mkr, nil))
+}
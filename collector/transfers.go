@@ -0,0 +1,274 @@
+package collector
+
+import (
+	"context"
+	"fmt"
+	"math/big"
+	"strings"
+	"time"
+
+	"github.com/ethereum/go-ethereum"
+	"github.com/ethereum/go-ethereum/accounts/abi"
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/core/types"
+	lru "github.com/hashicorp/golang-lru"
+)
+
+// Token standards
+const (
+	StandardERC20   = "erc20"
+	StandardERC721  = "erc721"
+	StandardERC1155 = "erc1155"
+)
+
+// TypeOwnership the relationship of an account with a collection it holds
+// tokens of
+const TypeOwnership = "ownership"
+
+// topics of the token transfer events
+var (
+	transferTopic       = common.HexToHash("0xddf252ad1be2c89b69c2b068fc378daa952ba7f163c4a11628f55a4df523b3ef")
+	transferSingleTopic = common.HexToHash("0xc3d58168c5ae7397731d063d5bbf3d657854427343f4c083240f7aacaa2d0f62")
+	transferBatchTopic  = common.HexToHash("0x4a39dc06d4c0dbc64b70af90fd698a233a518aa5d07e595d983b8c0526c8f7fb")
+)
+
+// erc721InterfaceID the ERC-165 interface id of ERC-721
+var erc721InterfaceID = [4]byte{0x80, 0xac, 0x58, 0xcd}
+
+// erc165ABI the ERC-165 method to query the supported interfaces
+const erc165ABI = `[
+	{"constant":true,"inputs":[{"name":"interfaceId","type":"bytes4"}],"name":"supportsInterface","outputs":[{"name":"","type":"bool"}],"type":"function"}
+]`
+
+var (
+	supportsInterfaceABI abi.ABI
+	batchArgs            abi.Arguments
+	interfacesCache      *lru.Cache
+)
+
+func init() {
+	var err error
+	if supportsInterfaceABI, err = abi.JSON(strings.NewReader(erc165ABI)); err != nil {
+		panic(err)
+	}
+	uint256Array, _ := abi.NewType("uint256[]", "", nil)
+	batchArgs = abi.Arguments{{Name: "ids", Type: uint256Array}, {Name: "values", Type: uint256Array}}
+	interfacesCache, _ = lru.New(TokenCacheSize)
+}
+
+// isTransferEvent tells if the event is a token transfer
+func isTransferEvent(topic common.Hash) bool {
+	return topic == transferTopic || topic == transferSingleTopic || topic == transferBatchTopic
+}
+
+// TokenTransfer a transfer of tokens decoded from a log
+type TokenTransfer struct {
+	Standard string
+	// From and To are lowercase addresses
+	From string
+	To   string
+	// Value the amount of an ERC-20 transfer
+	Value *big.Int
+	// IDs the ids of the nfts, Values how many of each id are moved
+	IDs    []*big.Int
+	Values []*big.Int
+}
+
+// ParseTransfer decode a Transfer, TransferSingle or TransferBatch log. The
+// Transfer of ERC-20 and ERC-721 have the same topic: an ERC-721 has the
+// token id as fourth topic, and when the arguments are not indexed at all the
+// standard is asked to the contract with supportsInterface. A log that does
+// not match its event is an error.
+func ParseTransfer(ctx context.Context, vLog *types.Log, client ethereum.ContractCaller) (t *TokenTransfer, err error) {
+	if len(vLog.Topics) == 0 {
+		return nil, fmt.Errorf("log %s is not a transfer: no topics", LogKey(vLog.TxHash, vLog.Index))
+	}
+	malformed := func() error {
+		return fmt.Errorf("malformed %s log %s: %d topics and %d bytes of data", eventNames[vLog.Topics[0].Hex()], LogKey(vLog.TxHash, vLog.Index), len(vLog.Topics), len(vLog.Data))
+	}
+	switch vLog.Topics[0] {
+	case transferTopic:
+		switch {
+		case len(vLog.Topics) == 3 && len(vLog.Data) == 32:
+			t = &TokenTransfer{
+				Standard: StandardERC20,
+				From:     topicAddress(vLog.Topics[1]),
+				To:       topicAddress(vLog.Topics[2]),
+				Value:    new(big.Int).SetBytes(vLog.Data),
+			}
+		case len(vLog.Topics) == 4 && len(vLog.Data) == 0:
+			t = &TokenTransfer{
+				Standard: StandardERC721,
+				From:     topicAddress(vLog.Topics[1]),
+				To:       topicAddress(vLog.Topics[2]),
+				IDs:      []*big.Int{vLog.Topics[3].Big()},
+				Values:   []*big.Int{big.NewInt(1)},
+			}
+		case len(vLog.Topics) == 1 && len(vLog.Data) == 96:
+			// nothing is indexed
+			t = &TokenTransfer{
+				From: topicAddress(common.BytesToHash(vLog.Data[:32])),
+				To:   topicAddress(common.BytesToHash(vLog.Data[32:64])),
+			}
+			x := new(big.Int).SetBytes(vLog.Data[64:])
+			var nft bool
+			if nft, err = supportsInterface(ctx, client, vLog.Address, erc721InterfaceID); err != nil {
+				return nil, err
+			}
+			if nft {
+				t.Standard, t.IDs, t.Values = StandardERC721, []*big.Int{x}, []*big.Int{big.NewInt(1)}
+			} else {
+				t.Standard, t.Value = StandardERC20, x
+			}
+		default:
+			return nil, malformed()
+		}
+	case transferSingleTopic:
+		if len(vLog.Topics) != 4 || len(vLog.Data) != 64 {
+			return nil, malformed()
+		}
+		t = &TokenTransfer{
+			Standard: StandardERC1155,
+			From:     topicAddress(vLog.Topics[2]),
+			To:       topicAddress(vLog.Topics[3]),
+			IDs:      []*big.Int{new(big.Int).SetBytes(vLog.Data[:32])},
+			Values:   []*big.Int{new(big.Int).SetBytes(vLog.Data[32:])},
+		}
+	case transferBatchTopic:
+		if len(vLog.Topics) != 4 {
+			return nil, malformed()
+		}
+		values, uerr := batchArgs.Unpack(vLog.Data)
+		if uerr != nil || len(values) != 2 {
+			return nil, malformed()
+		}
+		ids, _ := values[0].([]*big.Int)
+		amounts, _ := values[1].([]*big.Int)
+		if len(ids) != len(amounts) {
+			return nil, malformed()
+		}
+		t = &TokenTransfer{
+			Standard: StandardERC1155,
+			From:     topicAddress(vLog.Topics[2]),
+			To:       topicAddress(vLog.Topics[3]),
+			IDs:      ids,
+			Values:   amounts,
+		}
+	default:
+		return nil, fmt.Errorf("log %s is not a transfer", LogKey(vLog.TxHash, vLog.Index))
+	}
+	return
+}
+
+// topicAddress the lowercase address in a topic
+func topicAddress(topic common.Hash) string {
+	return strings.ToLower(common.BytesToAddress(topic.Bytes()).Hex())
+}
+
+// supportsInterface ask a contract if it implements an interface with
+// ERC-165, the contracts that do not implement ERC-165 support nothing.
+// The answer is cached.
+func supportsInterface(ctx context.Context, client ethereum.ContractCaller, address common.Address, id [4]byte) (supported bool, err error) {
+	key := struct {
+		tokenKey
+		id [4]byte
+	}{tokenKey{client, address}, id}
+	if v, found := interfacesCache.Get(key); found {
+		return v.(bool), nil
+	}
+	input, err := supportsInterfaceABI.Pack("supportsInterface", id)
+	if err != nil {
+		return
+	}
+	out, err := client.CallContract(ctx, ethereum.CallMsg{To: &address, Data: input}, nil)
+	if err != nil && !strings.Contains(err.Error(), "revert") {
+		return
+	}
+	err = nil
+	if values, uerr := supportsInterfaceABI.Unpack("supportsInterface", out); uerr == nil && len(values) == 1 {
+		supported, _ = values[0].(bool)
+	}
+	interfacesCache.Add(key, supported)
+	return
+}
+
+// Assets the assets moved by the transfer, with the token metadata when it
+// can be read
+func (t *TokenTransfer) Assets(ctx context.Context, vLog *types.Log, client ethereum.ContractCaller) (assets []AssetAmount) {
+	if t.Standard == StandardERC20 {
+		if amount := transferAmount(vLog, client, t.Value); amount != nil {
+			assets = append(assets, *amount)
+		}
+		return
+	}
+	info, _ := Token(ctx, client, vLog.Address)
+	for i, id := range t.IDs {
+		a := AssetAmount{
+			Asset:   strings.ToLower(vLog.Address.Hex()),
+			TokenID: id.String(),
+			Amount:  t.Values[i].String(),
+		}
+		if info != nil {
+			a.Symbol, a.Name = info.Symbol, info.Name
+		}
+		assets = append(assets, a)
+	}
+	return
+}
+
+// withTransfer add the transfer to the action properties
+func withTransfer(a *Action, t *TokenTransfer, assets []AssetAmount) {
+	a.Properties["tokenStandard"] = t.Standard
+	if t.Standard == StandardERC20 {
+		if len(assets) > 0 {
+			withAmount(a, &assets[0])
+		}
+		return
+	}
+	ids := make([]string, len(t.IDs))
+	for i, id := range t.IDs {
+		ids[i] = id.String()
+	}
+	if len(ids) == 1 {
+		a.Properties["tokenId"] = ids[0]
+	} else {
+		a.Properties["tokenIds"] = ids
+	}
+}
+
+// ownership build the relationships of the accounts with the nft collection
+// of a transfer: the recipient holds the tokens, and the sender of an ERC-721
+// no longer does. Mints are ownerships too.
+func ownership(vLog *types.Log, client CodeReader, chain *Chain, t *TokenTransfer, timestamp time.Time, p *parsedLog) {
+	if t.Standard == StandardERC20 {
+		return
+	}
+	zero := strings.ToLower(ZeroAddress)
+	collection, _ := chain.criteria(Address(vLog.Address.Hex()), client)
+	rel := func(account string, owner bool, i int) {
+		e, isNew := chain.criteria(NewAddressFromString(account), client)
+		if isNew {
+			p.entities = append(p.entities, newAddressEntity(account, e))
+		}
+		r := NewTrustRelationship()
+		r.Type = TypeOwnership
+		r.SourceCriteria = e
+		r.TargetCriteria = collection
+		r.Properties["owner"] = owner
+		r.Properties["tokenStandard"] = t.Standard
+		r.Properties["tokenId"] = t.IDs[i].String()
+		r.Properties["amount"] = t.Values[i].String()
+		r.Properties["txId"] = vLog.TxHash.Hex()
+		r.Properties["timestamp"] = timestamp
+		r.Properties["source"] = SourceEventLog
+		p.relationships = append(p.relationships, r)
+	}
+	for i := range t.IDs {
+		if t.To != zero {
+			rel(t.To, true, i)
+		}
+		if t.Standard == StandardERC721 && t.From != zero {
+			rel(t.From, false, i)
+		}
+	}
+}
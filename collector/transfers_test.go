@@ -0,0 +1,176 @@
+package collector
+
+import (
+	"context"
+	"math/big"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/ethereum/go-ethereum"
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/core/types"
+	"github.com/stretchr/testify/assert"
+)
+
+// erc165Token answers supportsInterface
+type erc165Token struct {
+	nft   bool
+	calls int
+}
+
+func (f *erc165Token) CallContract(ctx context.Context, call ethereum.CallMsg, blockNumber *big.Int) ([]byte, error) {
+	f.calls++
+	return supportsInterfaceABI.Methods["supportsInterface"].Outputs.Pack(f.nft)
+}
+
+func addressTopic(address string) common.Hash {
+	return common.BytesToHash(common.HexToAddress(address).Bytes())
+}
+
+func TestParseTransfer(t *testing.T) {
+	ctx := context.Background()
+	from, to := addressTopic("0xa1"), addressTopic("0xb2")
+	operator := addressTopic("0xc3")
+
+	// erc20
+	tr, err := ParseTransfer(ctx, &types.Log{
+		Topics: []common.Hash{transferTopic, from, to},
+		Data:   common.BigToHash(big.NewInt(2500000)).Bytes(),
+	}, nil)
+	if assert.Nil(t, err) {
+		assert.Equal(t, StandardERC20, tr.Standard)
+		assert.Equal(t, topicAddress(from), tr.From)
+		assert.Equal(t, topicAddress(to), tr.To)
+		assert.Equal(t, "2500000", tr.Value.String())
+	}
+
+	// erc721, the token id is indexed
+	tr, err = ParseTransfer(ctx, &types.Log{
+		Topics: []common.Hash{transferTopic, from, to, common.BigToHash(big.NewInt(7))},
+	}, nil)
+	if assert.Nil(t, err) {
+		assert.Equal(t, StandardERC721, tr.Standard)
+		assert.Nil(t, tr.Value)
+		assert.Equal(t, []*big.Int{big.NewInt(7)}, tr.IDs)
+		assert.Equal(t, []*big.Int{big.NewInt(1)}, tr.Values)
+	}
+
+	// nothing is indexed, the contract tells the standard
+	data := append(append(from.Bytes(), to.Bytes()...), common.BigToHash(big.NewInt(9)).Bytes()...)
+	nft := &erc165Token{nft: true}
+	tr, err = ParseTransfer(ctx, &types.Log{Address: common.HexToAddress("0x721"), Topics: []common.Hash{transferTopic}, Data: data}, nft)
+	if assert.Nil(t, err) {
+		assert.Equal(t, StandardERC721, tr.Standard)
+		assert.Equal(t, []*big.Int{big.NewInt(9)}, tr.IDs)
+	}
+	ParseTransfer(ctx, &types.Log{Address: common.HexToAddress("0x721"), Topics: []common.Hash{transferTopic}, Data: data}, nft)
+	assert.Equal(t, 1, nft.calls)
+	tr, err = ParseTransfer(ctx, &types.Log{Address: common.HexToAddress("0x20"), Topics: []common.Hash{transferTopic}, Data: data}, &erc165Token{})
+	if assert.Nil(t, err) {
+		assert.Equal(t, StandardERC20, tr.Standard)
+		assert.Equal(t, "9", tr.Value.String())
+	}
+
+	// erc1155
+	tr, err = ParseTransfer(ctx, &types.Log{
+		Topics: []common.Hash{transferSingleTopic, operator, from, to},
+		Data:   append(common.BigToHash(big.NewInt(3)).Bytes(), common.BigToHash(big.NewInt(10)).Bytes()...),
+	}, nil)
+	if assert.Nil(t, err) {
+		assert.Equal(t, StandardERC1155, tr.Standard)
+		assert.Equal(t, topicAddress(from), tr.From)
+		assert.Equal(t, topicAddress(to), tr.To)
+		assert.Equal(t, []*big.Int{big.NewInt(3)}, tr.IDs)
+		assert.Equal(t, []*big.Int{big.NewInt(10)}, tr.Values)
+	}
+	batch, _ := batchArgs.Pack([]*big.Int{big.NewInt(1), big.NewInt(2)}, []*big.Int{big.NewInt(5), big.NewInt(6)})
+	tr, err = ParseTransfer(ctx, &types.Log{Topics: []common.Hash{transferBatchTopic, operator, from, to}, Data: batch}, nil)
+	if assert.Nil(t, err) {
+		assert.Equal(t, StandardERC1155, tr.Standard)
+		assert.Equal(t, []*big.Int{big.NewInt(1), big.NewInt(2)}, tr.IDs)
+		assert.Equal(t, []*big.Int{big.NewInt(5), big.NewInt(6)}, tr.Values)
+	}
+
+	// malformed logs are errors
+	for _, l := range []*types.Log{
+		{Topics: []common.Hash{transferTopic, from, to}},
+		{Topics: []common.Hash{transferTopic, from}, Data: make([]byte, 32)},
+		{Topics: []common.Hash{transferTopic, from, to, operator}, Data: make([]byte, 32)},
+		{Topics: []common.Hash{transferTopic}, Data: make([]byte, 40)},
+		{Topics: []common.Hash{transferSingleTopic, operator, from, to}, Data: make([]byte, 32)},
+		{Topics: []common.Hash{transferSingleTopic, from, to}, Data: make([]byte, 64)},
+		{Topics: []common.Hash{transferBatchTopic, operator, from, to}, Data: make([]byte, 17)},
+		{Topics: []common.Hash{transferBatchTopic, operator}, Data: batch},
+		{},
+	} {
+		_, err = ParseTransfer(ctx, l, nil)
+		assert.Error(t, err)
+	}
+}
+
+func TestOwnership(t *testing.T) {
+	collection := common.HexToAddress("0x0000000000000000000000000000000000000721")
+	Mainnet.cachePush(collection.Hex(), strings.ToLower(collection.Hex()), TypeDefiProtocol)
+	from, to := topicAddress(addressTopic("0xa1")), topicAddress(addressTopic("0xb2"))
+	vLog := &types.Log{Address: collection, TxHash: common.HexToHash("0x01")}
+
+	// erc721: the recipient is the new owner
+	var p parsedLog
+	ownership(vLog, nil, nil, &TokenTransfer{Standard: StandardERC721, From: from, To: to, IDs: []*big.Int{big.NewInt(7)}, Values: []*big.Int{big.NewInt(1)}}, time.Now(), &p)
+	if assert.Len(t, p.relationships, 2) {
+		r := p.relationships[0]
+		assert.Equal(t, TypeOwnership, r.Type)
+		assert.Equal(t, to, r.SourceCriteria.Ids["address"])
+		assert.Equal(t, strings.ToLower(collection.Hex()), r.TargetCriteria.Ids["address"])
+		assert.Equal(t, true, r.Properties["owner"])
+		assert.Equal(t, "7", r.Properties["tokenId"])
+		assert.Equal(t, from, p.relationships[1].SourceCriteria.Ids["address"])
+		assert.Equal(t, false, p.relationships[1].Properties["owner"])
+	}
+
+	// erc1155 mint: only the recipient, one relationship per id
+	p = parsedLog{}
+	ownership(vLog, nil, nil, &TokenTransfer{Standard: StandardERC1155, From: strings.ToLower(ZeroAddress), To: to, IDs: []*big.Int{big.NewInt(1), big.NewInt(2)}, Values: []*big.Int{big.NewInt(5), big.NewInt(6)}}, time.Now(), &p)
+	if assert.Len(t, p.relationships, 2) {
+		assert.Equal(t, "2", p.relationships[1].Properties["tokenId"])
+		assert.Equal(t, "6", p.relationships[1].Properties["amount"])
+	}
+
+	// erc20 has no ownership
+	p = parsedLog{}
+	ownership(vLog, nil, nil, &TokenTransfer{Standard: StandardERC20, From: from, To: to, Value: big.NewInt(1)}, time.Now(), &p)
+	assert.Empty(t, p.relationships)
+}
+
+func TestParseLogTransfers(t *testing.T) {
+	node := newCountingNode()
+	collection := common.HexToAddress("0x0000000000000000000000000000000000001155")
+	Mainnet.cachePush(collection.Hex(), strings.ToLower(collection.Hex()), TypeDefiProtocol)
+	header := testHeader(1)
+
+	// an nft mint is an ownership
+	mint := &types.Log{
+		Address:     collection,
+		Topics:      []common.Hash{transferSingleTopic, addressTopic("0xc3"), common.Hash{}, addressTopic("0xb2")},
+		Data:        append(common.BigToHash(big.NewInt(3)).Bytes(), common.BigToHash(big.NewInt(1)).Bytes()...),
+		BlockNumber: 1,
+		BlockHash:   header.Hash(),
+		TxHash:      common.HexToHash("0x1155"),
+	}
+	cs, err := ParseLog(mint, node)
+	assert.Nil(t, err)
+	if assert.Len(t, cs.Relationship, 1) {
+		assert.Equal(t, TypeOwnership, cs.Relationship[0].Type)
+		assert.Equal(t, StandardERC1155, cs.Relationship[0].Properties["tokenStandard"])
+	}
+
+	// a malformed transfer is an error, not a panic
+	_, err = ParseLog(&types.Log{
+		Address:     collection,
+		Topics:      []common.Hash{transferSingleTopic, addressTopic("0xc3")},
+		BlockNumber: 1,
+		BlockHash:   header.Hash(),
+	}, node)
+	assert.Error(t, err)
+}
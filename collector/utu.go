@@ -16,6 +16,11 @@ const (
 	TypeDefiProtocol = "DeFiProtocol"
 	TypeAddress      = "Address"
 	TypeInteraction  = "interaction"
+	// the types of the classified addresses
+	TypeEOA         = "EOA"
+	TypeContract    = "Contract"
+	TypeProxy       = "Proxy"
+	TypeSmartWallet = "SmartWallet"
 )
 
 // NewUTUClient create a new utu client
@@ -133,6 +138,15 @@ func NewTrustRelationship() *TrustRelationship {
 type TrustAPIChangeSet struct {
 	Entities     []*TrustEntity
 	Relationship []*TrustRelationship
+	// Key the idempotency key of the changeset, a changeset with a key is
+	// posted only once
+	Key string
+	// chain the chain of the addresses, set when the changeset is tagged
+	chain *Chain
+	// posted the functions called once the changeset has been posted
+	posted []func()
+	// retryDelay how long the changeset waited after its last failure
+	retryDelay time.Duration
 }
 
 // NewChangeset create a new changeset
@@ -147,6 +161,20 @@ func (cs *TrustAPIChangeSet) AddRel(r *TrustRelationship) {
 	cs.Relationship = append(cs.Relationship, r)
 }
 
+// onPosted register fn to be called once the changeset has been posted, or
+// skipped because it has been posted already
+func (cs *TrustAPIChangeSet) onPosted(fn func()) {
+	cs.posted = append(cs.posted, fn)
+}
+
+// acknowledge call the functions waiting for the changeset to be posted
+func (cs *TrustAPIChangeSet) acknowledge() {
+	for _, fn := range cs.posted {
+		fn()
+	}
+	cs.posted = nil
+}
+
 // AddEntity add a relationship to the changeset
 func (cs *TrustAPIChangeSet) AddEntity(e *TrustEntity) {
 	cs.Entities = append(cs.Entities, e)
@@ -2,6 +2,8 @@ package config
 
 import (
 	"fmt"
+	"strings"
+	"time"
 
 	"github.com/spf13/viper"
 )
@@ -15,10 +17,40 @@ type ServicesSchema struct {
 	GlitchtipDsn string `mapstructure:"glitchtip_dsn"`
 }
 
-// EthereumSchema config for ethereum related resources
+// EthereumSchema config for ethereum related resources, it is also the
+// configuration of each chain in the chains list
 type EthereumSchema struct {
+	// Network the name of the chain, e.g. mainnet, polygon, gnosis
+	Network           string `mapstructure:"network"`
 	WssURL            string `mapstructure:"node_wss_url"`
+	HTTPURL           string `mapstructure:"node_http_url"`
 	EtherscanAPIToken string `mapstructure:"etherscan_api_token"`
+	// EtherscanRateLimit the calls per second allowed by the etherscan plan
+	EtherscanRateLimit float64 `mapstructure:"etherscan_rate_limit"`
+	// EtherscanRetries how many times a query that failed for a temporary
+	// error is retried, with a backoff from EtherscanRetryDelay
+	EtherscanRetries    int           `mapstructure:"etherscan_retries"`
+	EtherscanRetryDelay time.Duration `mapstructure:"etherscan_retry_delay"`
+	// Confirmations how many blocks a log must be buried under before it is processed
+	Confirmations uint64 `mapstructure:"confirmations"`
+	// LogSource is either subscription (websocket) or polling (http or websocket)
+	LogSource    string        `mapstructure:"log_source"`
+	PollInterval time.Duration `mapstructure:"poll_interval"`
+	// ShardSize how many addresses go in a log subscription, the monitored
+	// addresses are split in shards followed separately, 0 is one shard
+	ShardSize int `mapstructure:"shard_size"`
+	// ExplorerURL the block explorer used for the links, e.g. https://polygonscan.com
+	ExplorerURL string `mapstructure:"explorer_url"`
+	// DefiSourcesFile the protocols deployed on the chain
+	DefiSourcesFile string `mapstructure:"defi_sources_file"`
+}
+
+// NodeURL the url to connect to the node, polling prefers the http endpoint
+func (e EthereumSchema) NodeURL() string {
+	if e.HTTPURL != "" && (e.LogSource == "polling" || e.WssURL == "") {
+		return e.HTTPURL
+	}
+	return e.WssURL
 }
 
 // TrustEngineSchema the trust engine client configuration
@@ -26,6 +58,24 @@ type TrustEngineSchema struct {
 	URL           string `mapstructure:"url"`
 	Authorization string `mapstructure:"authorization"`
 	DryRun        bool   `mapstructure:"dry_run"`
+	// DedupRetention how long the keys of the posted changesets are kept to
+	// skip the ones delivered again, 0 keeps them forever
+	DedupRetention time.Duration `mapstructure:"dedup_retention"`
+}
+
+// ScanSchema the exploration of the addresses related to a subscribed one
+type ScanSchema struct {
+	// Depth how many levels of counterparties are explored, 1 is the
+	// counterparties of the address
+	Depth int `mapstructure:"depth"`
+	// MaxNodes how many addresses a scan explores at most, 0 for no limit
+	MaxNodes int `mapstructure:"max_nodes"`
+	// FanOut how many new counterparties are explored at each level, 0 for
+	// no limit
+	FanOut int `mapstructure:"fan_out"`
+	// Skip the hub addresses, like exchanges and routers, that are never
+	// explored
+	Skip []string `mapstructure:"skip"`
 }
 
 // ServerSchema the schema for server
@@ -37,16 +87,70 @@ type ServerSchema struct {
 type Schema struct {
 	BalanceAPI         map[string]string `mapstructure:"balance_api"`
 	Ethereum           EthereumSchema    `mapstructure:"eth"`
+	Chains             []EthereumSchema  `mapstructure:"chains"`
 	UTUTrustAPI        TrustEngineSchema `mapstructure:"utu_trust_api"`
 	DefiSourcesFile    string            `mapstructure:"defi_sources_file"`
 	LogOutputFile      string            `mapstructure:"log_output_file"`
+	DBFolder           string            `mapstructure:"db_folder"`
 	Services           ServicesSchema    `mapstructure:"services"`
 	Server             ServerSchema      `mapstructure:"server"`
+	Scan               ScanSchema        `mapstructure:"scan"`
 	RuntimeVersion     string            `mapstructure:"-"`
 	RuntimeEnvironment string            `mapstructure:"-"`
 	RuntimeName        string            `mapstructure:"-"`
 }
 
+// AllChains the chains to collect the protocols events from, when the chains
+// list is empty it is the eth node with the defi_sources_file protocols
+func (s Schema) AllChains() (chains []EthereumSchema) {
+	if len(s.Chains) == 0 {
+		eth := s.Ethereum
+		if eth.Network == "" {
+			eth.Network = "mainnet"
+		}
+		if eth.DefiSourcesFile == "" {
+			eth.DefiSourcesFile = s.DefiSourcesFile
+		}
+		return []EthereumSchema{eth}
+	}
+	for _, c := range s.Chains {
+		// the defaults are not applied to the list items
+		if c.LogSource == "" {
+			c.LogSource = s.Ethereum.LogSource
+		}
+		if c.PollInterval == 0 {
+			c.PollInterval = s.Ethereum.PollInterval
+		}
+		if c.ShardSize == 0 {
+			c.ShardSize = s.Ethereum.ShardSize
+		}
+		chains = append(chains, c)
+	}
+	return
+}
+
+// SetProtocolsFile override the protocols file of the eth node, e.g. from the
+// command line, the chains of the chains list have their own files so they
+// cannot be overridden
+func (s *Schema) SetProtocolsFile(file string) error {
+	if len(s.Chains) > 0 {
+		return fmt.Errorf("cannot override the protocols file with %s, the chains list is configured: set defi_sources_file of each chain", file)
+	}
+	s.DefiSourcesFile = file
+	s.Ethereum.DefiSourcesFile = file
+	return nil
+}
+
+// Chain the chain with the network name, the first chain if network is empty
+func (s Schema) Chain(network string) (chain EthereumSchema, found bool) {
+	for _, c := range s.AllChains() {
+		if network == "" || strings.EqualFold(network, c.Network) {
+			return c, true
+		}
+	}
+	return
+}
+
 // Defaults configure defaults for the configuration
 func Defaults() {
 	// scheduler defaults
@@ -55,18 +159,68 @@ func Defaults() {
 	viper.SetDefault("log_output_file", "output.json")
 	viper.SetDefault("track_topics", []string{"transfer"})
 	viper.SetDefault("db_folder", "db")
+	viper.SetDefault("eth.confirmations", 0)
+	viper.SetDefault("eth.log_source", "subscription")
+	viper.SetDefault("eth.poll_interval", "15s")
+	viper.SetDefault("eth.shard_size", 100)
+	viper.SetDefault("eth.etherscan_rate_limit", 5)
+	viper.SetDefault("eth.etherscan_retries", 5)
+	viper.SetDefault("eth.etherscan_retry_delay", "1s")
 	// utu api
 	viper.SetDefault("utu_trust_api.url", "https://api.ututrust.com")
+	viper.SetDefault("utu_trust_api.dedup_retention", "720h")
 	viper.SetDefault("utu_trust_api.client_id", "defiPortal")
 	viper.SetDefault("utu_trust_api.client_id_header", "UTU-Trust-Api-Client-Id")
 	// server
 	viper.SetDefault("server.listen_address", ":2011")
+	// scan
+	viper.SetDefault("scan.depth", 1)
+	viper.SetDefault("scan.max_nodes", 100)
+	viper.SetDefault("scan.fan_out", 25)
 }
 
 // Validate a configuration
 func Validate(schema *Schema) (err []error) {
-	if schema.Ethereum.WssURL == "" {
-		err = append(err, fmt.Errorf("missing Eth wss URL"))
+	networks := make(map[string]bool)
+	for _, c := range schema.AllChains() {
+		name := c.Network
+		if name == "" {
+			err = append(err, fmt.Errorf("missing network name for chain %s", c.NodeURL()))
+		}
+		if networks[name] {
+			err = append(err, fmt.Errorf("duplicated network %s", name))
+		}
+		networks[name] = true
+		switch c.LogSource {
+		case "", "subscription":
+			if c.WssURL == "" {
+				err = append(err, fmt.Errorf("missing %s wss URL", name))
+			}
+		case "polling":
+			if c.NodeURL() == "" {
+				err = append(err, fmt.Errorf("missing %s http URL", name))
+			}
+		default:
+			err = append(err, fmt.Errorf("unknown %s log source '%s'", name, c.LogSource))
+		}
+		if c.DefiSourcesFile == "" {
+			err = append(err, fmt.Errorf("missing %s protocols file", name))
+		}
+		if c.ShardSize < 0 {
+			err = append(err, fmt.Errorf("invalid %s shard size %d", name, c.ShardSize))
+		}
+	}
+	if schema.UTUTrustAPI.DedupRetention < 0 {
+		err = append(err, fmt.Errorf("invalid dedup retention %s", schema.UTUTrustAPI.DedupRetention))
+	}
+	if schema.Scan.Depth < 0 || schema.Scan.MaxNodes < 0 || schema.Scan.FanOut < 0 {
+		err = append(err, fmt.Errorf("invalid scan depth %d, max nodes %d or fan out %d", schema.Scan.Depth, schema.Scan.MaxNodes, schema.Scan.FanOut))
+	}
+	if schema.Ethereum.EtherscanRateLimit < 0 {
+		err = append(err, fmt.Errorf("invalid etherscan rate limit %v", schema.Ethereum.EtherscanRateLimit))
+	}
+	if schema.Ethereum.EtherscanRetries < 0 || schema.Ethereum.EtherscanRetryDelay < 0 {
+		err = append(err, fmt.Errorf("invalid etherscan retries %d or retry delay %s", schema.Ethereum.EtherscanRetries, schema.Ethereum.EtherscanRetryDelay))
 	}
 	if schema.Ethereum.EtherscanAPIToken == "" {
 		err = append(err, fmt.Errorf("missing Etherscan API Token"))
@@ -58,6 +58,7 @@ func PipelineAll(log *log.Logger) (*PipelineResult, error) {
 				id
 			  }
 			  price: lastPriceValue
+			  estimatedUSDValue
 			}
 			orderCount
 		  }}`
@@ -161,6 +162,7 @@ func pipelineUsers(datatokensResponse []DatatokenResponse, log *log.Logger) (add
 			wrapper.Amount = oo.Amount
 			wrapper.Timestamp = oo.Timestamp
 			wrapper.Price = oo.Price
+			wrapper.ValueUSD = oo.EstimatedUSDValue
 			ordersByUser[oo.User.ID] = append(ordersByUser[oo.User.ID], wrapper)
 		}
 	}
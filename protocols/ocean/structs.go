@@ -4,8 +4,8 @@ import (
 	"fmt"
 	"log"
 	"strconv"
+	"time"
 
-	"github.com/fatih/structs"
 	"github.com/utu-crowdsale/defi-portal-scanner/collector"
 )
 
@@ -35,14 +35,18 @@ func (a *Asset) toTrustEntity() (te *collector.TrustEntity) {
 	te.Ids["address_datatoken"] = a.Datatoken.Address
 	te.Ids["DID"] = a.DID
 
-	te.Properties = structs.Map(a)
+	// The Datatoken and the DID are already represented as other UTU Trust
+	// Entity objects or ids, no need to duplicate them here
+	te.Properties["name"] = a.Name
+	te.Properties["description"] = a.Description
+	te.Properties["publishedBy"] = a.PublishedBy
+	te.Properties["publishedByAddress"] = a.PublishedByAddress
+	te.Properties["purgatory"] = a.Purgatory
+	te.Properties["consumed"] = a.Consumed
+	te.Properties["tags"] = a.Tags
+	te.Properties["categories"] = a.Categories
 	te.Name = a.Name
 	te.Type = "Asset"
-
-	// These are already represented as other UTU Trust Entity objects, no need
-	// to duplicate them as maps here
-	delete(te.Properties, "Datatoken")
-	delete(te.Properties, "DID")
 	return
 }
 
@@ -75,7 +79,8 @@ type OrderResponse struct {
 	User      struct {
 		ID string
 	}
-	Price string
+	Price             string
+	EstimatedUSDValue string
 }
 
 type Address struct {
@@ -97,18 +102,12 @@ func (a *Address) toTrustEntity() (te *collector.TrustEntity) {
 
 func (a *Address) datatokenInteractionsToTrustRelationships(datatokensMap map[string]*collector.TrustEntity, log *log.Logger) (tr []*collector.TrustRelationship) {
 	for _, dti := range a.DatatokenInteractions {
-		t := collector.NewTrustRelationship()
-		t.SourceCriteria = a.toTrustEntity()
 		x, ok := datatokensMap[dti.AddressDatatoken]
 		if !ok {
 			log.Printf("%#v mentioned a datatoken %s but I don't know anything about it\n", dti, dti.AddressDatatoken)
 			continue
 		}
-		t.TargetCriteria = x
-		t.Type = "interaction"
-		t.Properties = structs.Map(dti)
-		t.Properties["action"] = "Consumption"
-		tr = append(tr, t)
+		tr = append(tr, dti.toAction(a.toTrustEntity(), x).Relationship())
 	}
 	return tr
 }
@@ -136,7 +135,9 @@ func NewAddressFromUserResponse(user string, orders []OrderWrapper, purgatoryMap
 			SymbolDatatoken:  x.Token.Symbol,
 			Timestamp:        x.Timestamp,
 			TxHash:           x.TxHash,
+			Amount:           x.Amount,
 			Price:            x.Price,
+			ValueUSD:         x.ValueUSD,
 		}
 		a.DatatokenInteractions = append(a.DatatokenInteractions, dti)
 	}
@@ -164,8 +165,11 @@ func (d *Datatoken) Identifier() string {
 func (d *Datatoken) toTrustEntity() (te *collector.TrustEntity) {
 	te = collector.NewTrustEntity(fmt.Sprintf("Datatoken %s", d.Address))
 	te.Ids["address"] = d.Address
-	te.Properties = structs.Map(d)
-	delete(te.Properties, "NFT")
+	te.Properties["address"] = d.Address
+	te.Properties["name"] = d.Name
+	te.Properties["symbol"] = d.Symbol
+	te.Properties["orderCount"] = d.OrderCount
+	te.Properties["publisher"] = d.Publisher
 	te.Type = "Datatoken"
 	return
 }
@@ -198,7 +202,33 @@ type DatatokenInteraction struct {
 	SymbolDatatoken  string `json:"symbol_datatoken"`
 	Timestamp        uint64 `json:"timestamp"`
 	TxHash           string `json:"txhash"`
+	Amount           string `json:"amount,omitempty"`
 	Price            string `json:"price,omitempty"`
+	ValueUSD         string `json:"value_usd,omitempty"`
+}
+
+// toAction an order of a datatoken is the consumption of the asset, the
+// legacy name of the ocean relationships is kept as the event
+func (dti *DatatokenInteraction) toAction(actor, datatoken *collector.TrustEntity) *collector.Action {
+	a := collector.NewAction(collector.ActionConsume, actor, datatoken)
+	a.Event = "Consumption"
+	a.TxHash = dti.TxHash
+	a.Timestamp = time.Unix(int64(dti.Timestamp), 0)
+	a.Source = collector.SourceOcean
+	a.AssetsIn = []collector.AssetAmount{{
+		Asset:  dti.AddressDatatoken,
+		Symbol: dti.SymbolDatatoken,
+		Amount: dti.Amount,
+	}}
+	if v, err := strconv.ParseFloat(dti.ValueUSD, 64); err == nil {
+		a.ValueUSD = &v
+	}
+	a.Properties[collector.PropAmount] = dti.Amount
+	a.Properties[collector.PropTokenSymbol] = dti.SymbolDatatoken
+	if dti.Price != "" {
+		a.Properties[collector.PropPrice] = dti.Price
+	}
+	return a
 }
 
 type OrderWrapper struct {
@@ -207,6 +237,7 @@ type OrderWrapper struct {
 	TxHash    string
 	Token     OrderToken
 	Price     string
+	ValueUSD  string
 }
 
 type OrderToken struct {
@@ -0,0 +1,34 @@
+package ocean
+
+import (
+	"log"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/utu-crowdsale/defi-portal-scanner/collector"
+)
+
+func TestDatatokenInteractionsToTrustRelationships(t *testing.T) {
+	a, err := NewAddressFromUserResponse("0xuser", []OrderWrapper{
+		{Timestamp: 1600000000, Amount: "1", TxHash: "0x01", Token: OrderToken{ID: "0xdt", Symbol: "DT-1"}, Price: "2", ValueUSD: "0.5"},
+		{Timestamp: 1600000001, Amount: "1", TxHash: "0x02", Token: OrderToken{ID: "0xunknown"}},
+	}, map[string]string{})
+	assert.Nil(t, err)
+	datatoken := NewDataToken("0xdt", "Datatoken", "DT-1", 1, "0xpublisher", "0xnft").toTrustEntity()
+
+	rels := a.datatokenInteractionsToTrustRelationships(map[string]*collector.TrustEntity{"0xdt": datatoken}, log.Default())
+	if assert.Len(t, rels, 1) {
+		// the canonical action, the legacy ocean name is the event
+		assert.Equal(t, "interaction", rels[0].Type)
+		assert.Equal(t, "consume", rels[0].Properties["action"])
+		assert.Equal(t, "Consumption", rels[0].Properties["event"])
+		assert.Equal(t, "0x01", rels[0].Properties["txId"])
+		assert.Equal(t, "1", rels[0].Properties["amount"])
+		assert.Equal(t, "DT-1", rels[0].Properties["tokenSymbol"])
+		assert.Equal(t, "2", rels[0].Properties["price"])
+		assert.Equal(t, 0.5, rels[0].Properties["valueUSD"])
+		_, legacy := rels[0].Properties["TxHash"]
+		assert.False(t, legacy)
+		assert.Equal(t, datatoken, rels[0].TargetCriteria)
+	}
+}
@@ -22,6 +22,13 @@ func PostAssetsToUTU(assets []*Asset, u *collector.UTUClient, log *log.Logger) {
 func postAsset(asset *Asset, u *collector.UTUClient, log *log.Logger, wg *sizedwaitgroup.SizedWaitGroup) {
 	defer wg.Done()
 	assetTe := asset.toTrustEntity()
+	datatokenTe := asset.Datatoken.toTrustEntity()
+	assetDatatokenRelationship := asset.datatokenToTrustRelationship()
+	// the assets are on mainnet
+	cs := collector.NewChangeset(assetTe, datatokenTe)
+	cs.AddRel(assetDatatokenRelationship)
+	collector.Mainnet.Tag(cs)
+
 	err := u.PostEntity(assetTe)
 	if err != nil {
 		log.Println(err)
@@ -29,7 +36,6 @@ func postAsset(asset *Asset, u *collector.UTUClient, log *log.Logger, wg *sizedw
 		log.Printf("%s posted to UTU\n", asset.Identifier())
 	}
 
-	datatokenTe := asset.Datatoken.toTrustEntity()
 	err = u.PostEntity(datatokenTe)
 	if err != nil {
 		log.Println(err)
@@ -37,7 +43,6 @@ func postAsset(asset *Asset, u *collector.UTUClient, log *log.Logger, wg *sizedw
 		log.Printf("%s posted to UTU\n", asset.Datatoken.Identifier())
 	}
 
-	assetDatatokenRelationship := asset.datatokenToTrustRelationship()
 	err = u.PostRelationship(assetDatatokenRelationship)
 	if err != nil {
 		log.Println(err)
@@ -64,6 +69,7 @@ func PostAddressesToUTU(addresses []*Address, assets []*Asset, u *collector.UTUC
 	for _, address := range addresses {
 		// Convert users to UTU Trust Entities
 		userTe := address.toTrustEntity()
+		collector.Mainnet.Tag(collector.NewChangeset(userTe))
 		addressesMap[address.Address] = userTe
 	}
 
@@ -85,6 +91,11 @@ func postAddress(address *Address, usersMap, datatokensMap map[string]*collector
 	// Now we can create the relationships between the Users and the
 	// Datatokens.
 	dtiTes := address.datatokenInteractionsToTrustRelationships(datatokensMap, log)
+	cs := collector.NewChangeset()
+	for _, r := range dtiTes {
+		cs.AddRel(r)
+	}
+	collector.Mainnet.Tag(cs)
 
 	if len(dtiTes) > 0 {
 		fmt.Println("datatokenRelationships", len(dtiTes))